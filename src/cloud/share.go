@@ -94,6 +94,10 @@ func (cc *Cloud) DeleteShare(name_hmac string) error {
 		return fs.Trace(err)
 	}
 
+	if resp.StatusCode == 404 {
+		return ErrNotFound
+	}
+
 	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		return fmt.Errorf("HTTP %s", resp.Status)
 	}
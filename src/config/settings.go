@@ -11,6 +11,7 @@ type Settings struct {
 	Cloud string
 	Passwd string
 	Master string
+	Device string // Names this device in share logs
 }
 
 func GetSettings() Settings {
@@ -24,6 +25,14 @@ func GetSettings() Settings {
 		ss.Master = hex.EncodeToString(fs.RandomBytes(16))
 	}
 
+	if ss.Device == "" {
+		ss.Device = hex.EncodeToString(fs.RandomBytes(8))
+
+		if err == nil {
+			ss.Save()
+		}
+	}
+
 	return ss
 }
 
@@ -6,7 +6,6 @@ import (
 	"bufio"
 	"os"
 	"io"
-	"io/ioutil"
 )
 
 type BlockArchive struct {
@@ -99,11 +98,9 @@ func (ba *BlockArchive) Extract(eft *EFT) error {
 }
 
 func (ba *BlockArchive) Add(eft *EFT, hash [32]byte) error {
-	name := eft.BlockPath(hash)
-
-	ctxt, err := ioutil.ReadFile(name)
+	ctxt, err := eft.store().Get(hash)
 	if err != nil {
-		return err
+		return err // Could be ErrNotFound
 	}
 
 	_, err = ba.file.Write(hash[:])
@@ -149,7 +146,7 @@ func (ba *BlockArchive) AddList(eft *EFT, src_path string) error {
 		hash := [32]byte{}
 		copy(hash[:], hsli)
 		err = ba.Add(eft, hash)
-		if os.IsNotExist(err) {
+		if err == ErrNotFound {
 			continue
 		}
 		if err != nil {
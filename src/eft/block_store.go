@@ -0,0 +1,280 @@
+package eft
+
+// Where the encrypted blocks of an EFT are kept. Stores only deal in
+// ciphertext named by its hash; sealing and checking blocks is done by
+// the EFT. The other files in EFT.Dir (snaps, synced, refs, the added
+// list) stay on disk whatever the store.
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"io/ioutil"
+	"path"
+	"sync"
+	"os"
+)
+
+type BlockStore interface {
+	Get(hash [32]byte) ([]byte, error) // ErrNotFound if missing
+	Put(hash [32]byte, ctxt []byte) error
+	Has(hash [32]byte) (bool, error)
+	Delete(hash [32]byte) error // ErrNotFound if missing
+	Iterate(fn func(hash [32]byte) error) error
+}
+
+// Stores that can reclaim the space of deleted blocks.
+type compactStore interface {
+	Compact() error
+}
+
+// The default store, used when EFT.Store is nil, is a PackStore if Dir
+// has packs and a DirStore otherwise.
+func (eft *EFT) store() BlockStore {
+	eft.smutex.Lock()
+	defer eft.smutex.Unlock()
+
+	if eft.Store == nil {
+		packs := path.Join(eft.Dir, "packs")
+
+		_, err := os.Stat(packs)
+		if err == nil {
+			eft.Store = NewPackStore(packs)
+		} else {
+			eft.Store = &DirStore{Dir: path.Join(eft.Dir, "blocks")}
+		}
+	}
+
+	return eft.Store
+}
+
+// Keeps each block in its own file, as Dir/xx/hash where xx is the first
+// byte of the hash.
+type DirStore struct {
+	Dir string
+}
+
+func (ds *DirStore) Path(hash [32]byte) string {
+	text := hex.EncodeToString(hash[:])
+	return path.Join(ds.Dir, text[0:2], text)
+}
+
+func (ds *DirStore) Get(hash [32]byte) ([]byte, error) {
+	ctxt, err := ioutil.ReadFile(ds.Path(hash))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return ctxt, nil
+}
+
+func (ds *DirStore) Put(hash [32]byte, ctxt []byte) error {
+	name := ds.Path(hash)
+
+	err := os.MkdirAll(path.Dir(name), 0700)
+	if err != nil {
+		return trace(err)
+	}
+
+	err = ioutil.WriteFile(name, ctxt, 0600)
+	if err != nil {
+		return trace(err)
+	}
+
+	return nil
+}
+
+func (ds *DirStore) Has(hash [32]byte) (bool, error) {
+	_, err := os.Stat(ds.Path(hash))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, trace(err)
+	}
+
+	return true, nil
+}
+
+func (ds *DirStore) Delete(hash [32]byte) error {
+	err := os.Remove(ds.Path(hash))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return trace(err)
+	}
+
+	return nil
+}
+
+func (ds *DirStore) Iterate(fn func(hash [32]byte) error) error {
+	walk_fn := func(pp string, sysi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return trace(err)
+		}
+
+		_, name := filepath.Split(pp)
+		if len(name) != 64 {
+			return nil
+		}
+
+		_, err = hex.DecodeString(name)
+		if err != nil {
+			return nil
+		}
+
+		return fn(HexToHash(name))
+	}
+
+	return filepath.Walk(ds.Dir, walk_fn)
+}
+
+// Keeps blocks in memory, for tests.
+type MemStore struct {
+	blocks map[[32]byte][]byte
+	mutex  sync.Mutex
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{blocks: make(map[[32]byte][]byte)}
+}
+
+func (ms *MemStore) Get(hash [32]byte) ([]byte, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ctxt, ok := ms.blocks[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return append([]byte{}, ctxt...), nil
+}
+
+func (ms *MemStore) Put(hash [32]byte, ctxt []byte) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.blocks[hash] = append([]byte{}, ctxt...)
+	return nil
+}
+
+func (ms *MemStore) Has(hash [32]byte) (bool, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	_, ok := ms.blocks[hash]
+	return ok, nil
+}
+
+func (ms *MemStore) Delete(hash [32]byte) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	_, ok := ms.blocks[hash]
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(ms.blocks, hash)
+	return nil
+}
+
+// Works on a copy of the list, so fn can change the store.
+func (ms *MemStore) Iterate(fn func(hash [32]byte) error) error {
+	ms.mutex.Lock()
+	hashes := make([][32]byte, 0, len(ms.blocks))
+	for hash := range(ms.blocks) {
+		hashes = append(hashes, hash)
+	}
+	ms.mutex.Unlock()
+
+	for _, hash := range(hashes) {
+		err := fn(hash)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return nil
+}
+
+// Reads from Main, then from Old for blocks that haven't been moved over,
+// as when a PackStore import was interrupted. New blocks go to Main.
+type FallbackStore struct {
+	Main BlockStore
+	Old  BlockStore
+}
+
+func (fb *FallbackStore) Get(hash [32]byte) ([]byte, error) {
+	ctxt, err := fb.Main.Get(hash)
+	if err == ErrNotFound {
+		return fb.Old.Get(hash)
+	}
+	return ctxt, err
+}
+
+func (fb *FallbackStore) Put(hash [32]byte, ctxt []byte) error {
+	return fb.Main.Put(hash, ctxt)
+}
+
+func (fb *FallbackStore) Has(hash [32]byte) (bool, error) {
+	have, err := fb.Main.Has(hash)
+	if err != nil || have {
+		return have, err
+	}
+	return fb.Old.Has(hash)
+}
+
+func (fb *FallbackStore) Delete(hash [32]byte) error {
+	err0 := fb.Main.Delete(hash)
+	if err0 != nil && err0 != ErrNotFound {
+		return trace(err0)
+	}
+
+	err1 := fb.Old.Delete(hash)
+	if err1 != nil && err1 != ErrNotFound {
+		return trace(err1)
+	}
+
+	if err0 == ErrNotFound && err1 == ErrNotFound {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// Blocks in both stores are only listed once.
+func (fb *FallbackStore) Iterate(fn func(hash [32]byte) error) error {
+	err := fb.Main.Iterate(fn)
+	if err != nil {
+		return trace(err)
+	}
+
+	return fb.Old.Iterate(func(hash [32]byte) error {
+		have, err := fb.Main.Has(hash)
+		if err != nil {
+			return trace(err)
+		}
+
+		if have {
+			return nil
+		}
+
+		return fn(hash)
+	})
+}
+
+func (fb *FallbackStore) Compact() error {
+	cs, ok := fb.Main.(compactStore)
+	if !ok {
+		return nil
+	}
+	return cs.Compact()
+}
@@ -0,0 +1,99 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestMemStore(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	store := NewMemStore()
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir, Store: store}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	small := path.Join(src_dir, "small")
+	large := path.Join(src_dir, "large")
+
+	err = ioutil.WriteFile(small, []byte("kept in memory\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	err = ioutil.WriteFile(large, RandomBytes(3 * DATA_SIZE), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, small)
+	putTestFile(eft, large)
+
+	old_blocks := testItemBlocks(eft, large)
+
+	err = ioutil.WriteFile(large, RandomBytes(3 * DATA_SIZE), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, large)
+
+	_, err = os.Stat(path.Join(eft_dir, "blocks"))
+	if err == nil {
+		fmt.Println("Blocks written to disk")
+		tt.Fail()
+	}
+
+	testCollect(eft)
+
+	for hash := range(old_blocks) {
+		have, err := store.Has(hash)
+		if err != nil {
+			panic(err)
+		}
+
+		if have {
+			fmt.Println("Old block not collected")
+			tt.Fail()
+		}
+	}
+
+	report, err := eft.Verify()
+	if err != nil {
+		panic(err)
+	}
+
+	if !report.OK() || report.Blocks == 0 {
+		fmt.Println("Bad blocks in memory store:", report.Problems)
+		tt.Fail()
+	}
+
+	checkTestItem(tt, eft, small, testReadBytes(small))
+	checkTestItem(tt, eft, large, testReadBytes(large))
+
+	count := 0
+	err = store.Iterate(func(hash [32]byte) error {
+		count += 1
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// The last snapshot list and log replaced are kept for one more
+	// checkpoint.
+	if count < report.Blocks || count > report.Blocks + 2 {
+		fmt.Println("Wrong number of stored blocks:", count, report.Blocks)
+		tt.Fail()
+	}
+}
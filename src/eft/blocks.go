@@ -1,10 +1,7 @@
 package eft
 
 import (
-	"io/ioutil"
 	"fmt"
-	"path"
-	"os"
 )
 
 var DATA_SIZE = BLOCK_SIZE - BLOCK_OVERHEAD
@@ -18,19 +15,12 @@ func (eft *EFT) saveEncBlock(hash [32]byte, ctxt []byte) error {
 	}
 
 	// Second, validate block mac
-	_, err := DecryptBlock(ctxt, eft.Key)
+	_, err := eft.openBlock(ctxt)
 	if err != nil {
 		return trace(err)
 	}
 
-	name := eft.BlockPath(hash)
-
-	err = os.MkdirAll(path.Dir(name), 0700)
-	if err != nil {
-		return trace(err)
-	}
-
-	err = ioutil.WriteFile(name, ctxt, 0600)
+	err = eft.store().Put(hash, ctxt)
 	if err != nil {
 		return trace(err)
 	}
@@ -38,47 +28,98 @@ func (eft *EFT) saveEncBlock(hash [32]byte, ctxt []byte) error {
 	return nil
 }
 
+// Saves up to PACK_MAX bytes of data in one block, see compress.go.
 func (eft *EFT) saveBlock(data []byte) ([32]byte, error) {
-	ctxt := EncryptBlock(data, eft.Key)
+	ctxt, err := eft.seal(data)
+	if err != nil {
+		return ZERO_HASH, err // Could be ErrBlockFull
+	}
+
 	hash := HashSlice(ctxt)
-	name := eft.BlockPath(hash)
 
-	err := os.MkdirAll(path.Dir(name), 0700)
+	err = eft.putSealed(hash, ctxt)
 	if err != nil {
 		return hash, trace(err)
 	}
 
-	err = ioutil.WriteFile(name, ctxt, 0600)
+	return hash, nil
+}
+
+func (eft *EFT) seal(data []byte) ([]byte, error) {
+	block, err := eft.packBlock(data)
 	if err != nil {
-		return hash, trace(err)
+		return nil, err
+	}
+
+	if eft.Convergent {
+		return EncryptBlockConvergent(block, eft.Key, eft.NonceKey), nil
+	} else {
+		return EncryptBlock(block, eft.Key), nil
+	}
+}
+
+// Stores a sealed block and adds it to the current transaction.
+func (eft *EFT) putSealed(hash [32]byte, ctxt []byte) error {
+	// A convergent block we already have is already in use or in the added
+	// list. Adding it again would make an abort delete it.
+	if eft.Convergent {
+		have, err := eft.store().Has(hash)
+		if err != nil {
+			return trace(err)
+		}
+		if have {
+			return nil
+		}
+	}
+
+	err := eft.store().Put(hash, ctxt)
+	if err != nil {
+		return trace(err)
 	}
 
 	err = eft.blockAdded(hash)
 	if err != nil {
-		return hash, trace(err)
+		return trace(err)
 	}
 
-	return hash, nil
+	return nil
 }
 
 func (eft *EFT) loadBlock(hash [32]byte) ([]byte, error) {
-	name := eft.BlockPath(hash)
+	ctxt, ok := eft.pendingNode(hash)
 
-	ctxt, err := ioutil.ReadFile(name)
+	var err error
+	if !ok {
+		ctxt, err = eft.store().Get(hash)
+	}
 	if err != nil {
+		if err == ErrNotFound {
+			eft.setDamaged(true)
+		}
 		return nil, trace(err)
 	}
 
 	hash1 := HashSlice(ctxt)
 	if !HashesEqual(hash, hash1) {
+		eft.setDamaged(true)
 		return nil, fmt.Errorf("Hash mismatch for %s", HashToHex(hash))
 	}
 	
-	data, err := DecryptBlock(ctxt, eft.Key)
+	data, err := eft.openBlock(ctxt)
 	if err != nil {
+		eft.setDamaged(true)
 		return nil, trace(err)
 	}
 
 	return data, nil
 }
 
+// Decrypts a block, which may be compressed.
+func (eft *EFT) openBlock(ctxt []byte) ([]byte, error) {
+	block, err := DecryptBlock(ctxt, eft.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return eft.unpackBlock(block)
+}
@@ -33,6 +33,8 @@ type TrieNode struct {
 	hdr [2048]byte
 	ovr [16][32]byte
 	tab [256]TrieEntry 
+
+	hash [32]byte // Last loaded or saved as
 }
 
 var ErrNotFound = errors.New("EFT: record not found")
@@ -94,6 +96,7 @@ func (tn *TrieNode) load(hash [32]byte) error {
 		entry := TrieEntry{}
 		copy(entry.Hash[:], rec[0:32])
 		entry.Type = rec[32]
+		entry.Resv = rec[33]
 		copy(entry.Pkey[:], rec[34:42])
 		copy(entry.Data[:], rec[42:48])
 		tn.tab[ii] = entry
@@ -104,6 +107,7 @@ func (tn *TrieNode) load(hash [32]byte) error {
 		copy(tn.ovr[ii][:], data[offset:offset + 32])
 	}
 
+	tn.hash = hash
 	return nil
 }
 
@@ -119,6 +123,7 @@ func (tn *TrieNode) save() ([32]byte, error) {
 		entry := tn.tab[ii]
 		copy(rec[0:32], entry.Hash[:])
 		rec[32] = entry.Type
+		rec[33] = entry.Resv
 		copy(rec[34:42], entry.Pkey[:])
 		copy(rec[42:48], entry.Data[:])
 	}
@@ -128,44 +133,63 @@ func (tn *TrieNode) save() ([32]byte, error) {
 		copy(data[offset:offset + 32], tn.ovr[ii][:])
 	}
 
-	hash, err := tn.eft.saveBlock(data)
+	var hash [32]byte
+	var err error
+
+	// Nodes of the path and directory tries are rewritten by every change,
+	// so a Txn keeps them in memory until it commits.
+	switch tn.tri.(type) {
+	case *PathTrie, *DirTrie:
+		hash, err = tn.eft.saveNode(data, tn.hash)
+	default:
+		hash, err = tn.eft.saveBlock(data)
+	}
 	if err != nil {
 		return hash, trace(err)
 	}
 
+	tn.hash = hash
 	return hash, nil
 }
 
 func (tn *TrieNode) find(key []byte) ([32]byte, error) {
+	entry, err := tn.findEntry(key)
+	return entry.Hash, err
+}
+
+func (tn *TrieNode) findEntry(key []byte) (TrieEntry, error) {
 	slot := key[tn.dep]
 	entry := tn.tab[slot]
 
 	switch entry.Type {
 	case TRIE_TYPE_NONE:
-		return [32]byte{}, ErrNotFound
+		return TrieEntry{}, ErrNotFound
 
 	case TRIE_TYPE_MORE:
 		next, err := tn.loadChild(entry.Hash)
 		if err != nil {
-			return [32]byte{}, err // Could be ErrNotFound, no trace
+			return TrieEntry{}, err // Could be ErrNotFound, no trace
 		}
 
-		return next.find(key)
+		return next.findEntry(key)
+
+	case TRIE_TYPE_OVRF:
+		return tn.findOverflow(key)
 
 	case TRIE_TYPE_ITEM:
 		key1, err := tn.tri.KeyBytes(entry)
 		if err != nil {
-			return [32]byte{}, trace(err)
+			return TrieEntry{}, trace(err)
 		}
 
 		if bytes.Compare(key, key1) == 0 {
-			return entry.Hash, nil
+			return entry, nil
 		} else {
-			return [32]byte{}, ErrNotFound
+			return TrieEntry{}, ErrNotFound
 		}
 
 	default:
-		return [32]byte{}, trace(fmt.Errorf("Unknown type in node entry: %d", entry.Type))
+		return TrieEntry{}, trace(fmt.Errorf("Unknown type in node entry: %d", entry.Type))
 	}
 }
 
@@ -174,6 +198,7 @@ func (tn *TrieNode) insert(key []byte, new_ent TrieEntry) error {
 	entry := tn.tab[slot]
 
 	new_ent.Type = TRIE_TYPE_ITEM
+	new_ent.Resv = 0
 
 	switch entry.Type {
 	case TRIE_TYPE_NONE:
@@ -190,6 +215,20 @@ func (tn *TrieNode) insert(key []byte, new_ent TrieEntry) error {
 			// Replace
 			tn.tab[slot] = new_ent
 
+		} else if tn.canOverflow(key) {
+			// Move both entries to the overflow tables
+			tn.tab[slot] = TrieEntry{ Type: TRIE_TYPE_OVRF }
+
+			err = tn.insert(curr_key, entry)
+			if err != nil {
+				return trace(err)
+			}
+
+			err = tn.insert(key, new_ent)
+			if err != nil {
+				return trace(err)
+			}
+
 		} else {
 			// Push down
 
@@ -216,6 +255,12 @@ func (tn *TrieNode) insert(key []byte, new_ent TrieEntry) error {
 			tn.tab[slot] = next_entry
 		}
 
+	case TRIE_TYPE_OVRF:
+		err := tn.insertOverflow(key, new_ent)
+		if err != nil {
+			return trace(err)
+		}
+
 	case TRIE_TYPE_MORE:
 		next, err := tn.loadChild(entry.Hash)
 		if err != nil {
@@ -251,9 +296,19 @@ func (tn *TrieNode) remove(key []byte) error {
 		return ErrNotFound
 
 	case TRIE_TYPE_ITEM:
+		curr_key, err := tn.tri.KeyBytes(entry)
+		if err != nil {
+			return trace(err)
+		}
+
+		if bytes.Compare(key, curr_key) != 0 {
+			return ErrNotFound
+		}
+
 		tn.tab[slot] = TrieEntry{}
 
-		fmt.Println("TODO (EFT): Figure out merge on remove")
+	case TRIE_TYPE_OVRF:
+		return tn.removeOverflow(key)
 
 	case TRIE_TYPE_MORE:
 		next, err := tn.loadChild(entry.Hash)
@@ -285,7 +340,8 @@ func (tn *TrieNode) visitEachEntry(fn func(ent *TrieEntry) error) error {
 	for ii := 0; ii < 256; ii++ {
 		ent := &tn.tab[ii]
 
-		if ent.Type == TRIE_TYPE_NONE {
+		if ent.Type == TRIE_TYPE_NONE || ent.Type == TRIE_TYPE_OVRF {
+			// Overflowed entries are visited below
 			continue
 		}
 
@@ -305,13 +361,9 @@ func (tn *TrieNode) visitEachEntry(fn func(ent *TrieEntry) error) error {
 				return trace(err)
 			}
 		}
-
-		if ent.Type == TRIE_TYPE_OVRF {
-			panic("TODO: Handle overflow tables")
-		}
 	}
 
-	return nil
+	return tn.visitOverflow(fn)
 }
 
 func (tn *TrieNode) debugDump() {
@@ -328,7 +380,7 @@ func (tn *TrieNode) debugDump() {
 		case TRIE_TYPE_MORE:
 			fmt.Println(ii, "\tMORE")
 		case TRIE_TYPE_OVRF:
-			fmt.Println(ii, "\tOVRF")
+			fmt.Println(ii, "\tOVRF", ent.ovrfCount())
 		case TRIE_TYPE_ITEM:
 			info, err := tn.eft.loadItemInfo(ent.Hash)
 			if err != nil {
@@ -341,4 +393,10 @@ func (tn *TrieNode) debugDump() {
 	}
 
 	fmt.Println("Skipped empties:", empties)
+
+	for oi := 0; oi < 16; oi++ {
+		if tn.ovr[oi] != ZERO_HASH {
+			fmt.Println("Overflow table", oi, HashToHex(tn.ovr[oi]))
+		}
+	}
 }
@@ -3,23 +3,49 @@ package eft
 import (
 	"os"
 	"path"
+	"fmt"
 )
 
+// A checkpoint holds a pin on its root instead of the EFT lock, so the
+// EFT can be used while it's uploaded. Only one checkpoint is open at a
+// time, until Commit or Abort.
 type Checkpoint struct {
 	Trie *EFT
 	Hash string
 	Adds string
 	Dels string
+	root [32]byte
 }
 
 func (eft *EFT) MakeCheckpoint() (*Checkpoint, error) {
+	eft.cmutex.Lock()
 	eft.Lock()
 
 	eft.begin()
 
+	snap := eft.mainSnap()
+
+	_, err := eft.purgeTombs(snap, false)
+	if err != nil {
+		eft.abort()
+		eft.Unlock()
+		eft.cmutex.Unlock()
+		return nil, trace(err)
+	}
+
+	err = eft.logCheckpoint(snap)
+	if err != nil {
+		eft.abort()
+		eft.Unlock()
+		eft.cmutex.Unlock()
+		return nil, trace(err)
+	}
+
 	dels, err := eft.collect()
 	if err != nil {
 		eft.abort()
+		eft.Unlock()
+		eft.cmutex.Unlock()
 		return nil, trace(err)
 	}
 	
@@ -27,35 +53,85 @@ func (eft *EFT) MakeCheckpoint() (*Checkpoint, error) {
 
 	hash, err := eft.loadSnapsHash()
 	if err != nil {
+		eft.Unlock()
+		eft.cmutex.Unlock()
 		return nil, trace(err)
 	}
 
+	err = eft.saveHashFile("refs/checkpoint", hash)
+	if err != nil {
+		// The next full collection will find it.
+		fmt.Println(trace(err))
+		eft.RequestFullCollect()
+	}
+
 	adds := eft.TempName()
 
 	err = os.Rename(path.Join(eft.Dir, "added"), adds)
 	if err != nil {
+		eft.Unlock()
+		eft.cmutex.Unlock()
 		return nil, trace(err)
 	}
 
+	// Collections skip pinned roots, so the checkpoint's blocks stay
+	// until it's done.
+	eft.pin(hash)
+	eft.Unlock()
+
 	cp := &Checkpoint{
 		Trie: eft,
 		Hash: HashToHex(hash),
 		Adds: adds,
 		Dels: dels,
+		root: hash,
 	}
 
 	return cp, nil
 }
 
+// Puts the checkpoint's blocks back in the added list, after any added
+// since, so the next checkpoint uploads them.
 func (cp *Checkpoint) Abort() {
-	defer cp.Trie.Unlock()
+	eft := cp.Trie
+	defer eft.cmutex.Unlock()
+
 	os.Remove(cp.Dels)
-	os.Rename(cp.Adds, path.Join(cp.Trie.Dir, "added"))
+
+	eft.Lock()
+	err := appendFile(path.Join(eft.Dir, "added"), cp.Adds)
+	eft.Unlock()
+
+	if err != nil {
+		fmt.Println(trace(err))
+	} else {
+		os.Remove(cp.Adds)
+	}
+
+	eft.unpin(cp.root)
 }
 
 func (cp *Checkpoint) Commit() {
-	defer cp.Trie.Unlock()
+	defer cp.Trie.cmutex.Unlock()
+
 	os.Remove(cp.Adds)
 	os.Remove(cp.Dels)
+
+	cp.Trie.unpin(cp.root)
+}
+
+
+// Records the checkpoint as the last root both this EFT and the remote
+// copy agree on. It is used as the common ancestor for the next merge,
+// so only call this once the checkpoint has been uploaded.
+func (cp *Checkpoint) MarkSynced() error {
+	return cp.Trie.saveSyncedHash(HexToHash(cp.Hash))
 }
 
+func (eft *EFT) loadSyncedHash() ([32]byte, error) {
+	return eft.loadHashFile("synced")
+}
+
+func (eft *EFT) saveSyncedHash(hash [32]byte) error {
+	return eft.saveHashFile("synced", hash)
+}
@@ -0,0 +1,330 @@
+package eft
+
+// With EFT.Chunking set, large items are split at points picked by a
+// rolling hash of their content (a "gear" hash, as in FastCDC) instead of
+// at fixed DATA_SIZE offsets. Inserting bytes into a file then only changes
+// the chunks around the insert; the chunks after it end at the same places
+// as before, so they are matched to the blocks of the previous version and
+// not saved again.
+//
+// Chunks are still stored one per block, numbered in the block list trie.
+// The data field of each entry holds the chunk length and a short checksum
+// of the chunk, used to find matching blocks. Entries with a zero length are
+// fixed size blocks, so both kinds of items are read the same way.
+//
+// With EFT.Compress also set, chunks are longer, up to PACK_MAX, and are
+// compressed into one block each. A chunk that doesn't fit once
+// compressed is split into blocks of DATA_SIZE, which then dedupe against
+// the pieces of the same chunk in the previous version.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Chunks are at least CHUNK_MIN bytes and at most a full block. Past the
+// minimum, a cut is made on average every 4k, so chunks average around
+// 3/4 of a block. Compressed chunks are at least a block, and are cut on
+// average every 32k past that, up to PACK_MAX.
+var CHUNK_MIN = DATA_SIZE / 2
+var CHUNK_MASK = uint64(0xFFF) << 52
+var CHUNK_MIN_PACKED = DATA_SIZE
+var CHUNK_MASK_PACKED = uint64(0x7FFF) << 49
+
+var gearTable [256]uint64
+
+func init() {
+	for ii := range(gearTable) {
+		sum := sha256.Sum256([]byte{'g', 'e', 'a', 'r', byte(ii)})
+		gearTable[ii] = binary.LittleEndian.Uint64(sum[0:8])
+	}
+}
+
+type chunker struct {
+	src  *bufio.Reader
+	buf  []byte
+	min  int
+	mask uint64
+}
+
+func newChunker(src io.Reader, packed bool) *chunker {
+	if packed {
+		return &chunker{
+			src:  bufio.NewReader(src),
+			buf:  make([]byte, PACK_MAX),
+			min:  CHUNK_MIN_PACKED,
+			mask: CHUNK_MASK_PACKED,
+		}
+	}
+
+	return &chunker{
+		src:  bufio.NewReader(src),
+		buf:  make([]byte, DATA_SIZE),
+		min:  CHUNK_MIN,
+		mask: CHUNK_MASK,
+	}
+}
+
+// Gets the next chunk, which is only valid until the next call. Returns
+// io.EOF after the last chunk.
+func (ck *chunker) next() ([]byte, error) {
+	hh := uint64(0)
+
+	for nn := 0; nn < len(ck.buf); nn++ {
+		bb, err := ck.src.ReadByte()
+		if err == io.EOF {
+			if nn == 0 {
+				return nil, io.EOF
+			}
+			return ck.buf[:nn], nil
+		}
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		ck.buf[nn] = bb
+		hh = (hh << 1) + gearTable[bb]
+
+		if nn + 1 >= ck.min && hh & ck.mask == 0 {
+			return ck.buf[:nn + 1], nil
+		}
+	}
+
+	return ck.buf, nil
+}
+
+func chunkSum(data []byte) uint32 {
+	sum := sha256.Sum256(data)
+	return binary.LittleEndian.Uint32(sum[0:4])
+}
+
+// Gets the number of bytes of item data in the block for an entry.
+func chunkLen(ent TrieEntry) int {
+	size := int(binary.LittleEndian.Uint16(ent.Data[0:2]))
+	if size == 0 {
+		return DATA_SIZE
+	}
+	return size
+}
+
+func (trie *LargeTrie) insertChunk(ii uint64, hash [32]byte, data []byte) error {
+	le := binary.LittleEndian
+
+	entry := TrieEntry{}
+	entry.Hash = hash
+	le.PutUint64(entry.Pkey[:], ii)
+	le.PutUint16(entry.Data[0:2], uint16(len(data)))
+	le.PutUint32(entry.Data[2:6], chunkSum(data))
+
+	return trie.root.insert(entry.Pkey[:], entry)
+}
+
+func (trie *LargeTrie) findEntry(ii uint64) (TrieEntry, error) {
+	var iile [8]byte
+	binary.LittleEndian.PutUint64(iile[:], ii)
+
+	return trie.root.findEntry(iile[:])
+}
+
+// Checks for variable length blocks, from chunking or compression.
+func (trie *LargeTrie) chunked() (bool, error) {
+	ent, err := trie.findEntry(0)
+	if err != nil {
+		return false, trace(err)
+	}
+
+	return binary.LittleEndian.Uint16(ent.Data[0:2]) != 0, nil
+}
+
+// Gets the end offset of each chunk, in order. Only for chunked items.
+func (trie *LargeTrie) chunkEnds() ([]uint64, error) {
+	ents := make([]TrieEntry, 0)
+
+	err := trie.root.visitEachEntry(func(ent *TrieEntry) error {
+		if ent.Type == TRIE_TYPE_ITEM {
+			ents = append(ents, *ent)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	// Chunks are numbered from zero with no gaps.
+	ends := make([]uint64, len(ents))
+
+	for _, ent := range(ents) {
+		ii := binary.LittleEndian.Uint64(ent.Pkey[:])
+		if ii >= uint64(len(ends)) {
+			return nil, trace(fmt.Errorf("Bad chunk number: %d", ii))
+		}
+
+		ends[ii] = uint64(chunkLen(ent))
+	}
+
+	for ii := 1; ii < len(ends); ii++ {
+		ends[ii] += ends[ii - 1]
+	}
+
+	return ends, nil
+}
+
+// Maps chunk length and checksum to the blocks of the previous version of
+// an item, so unchanged chunks can reuse them.
+type chunkIndex map[[6]byte][][32]byte
+
+func (eft *EFT) loadChunkIndex(snap *Snapshot, name string) (chunkIndex, error) {
+	index := make(chunkIndex)
+
+	info, hash, err := eft.getTree(snap, name)
+	if err == ErrNotFound {
+		return index, nil
+	}
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	if info.Type != INFO_FILE || info.Size <= SMALL_MAX {
+		return index, nil
+	}
+
+	trie, err := eft.loadLargeTrie(hash)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	err = trie.root.visitEachEntry(func(ent *TrieEntry) error {
+		if ent.Type == TRIE_TYPE_ITEM {
+			index[ent.Data] = append(index[ent.Data], ent.Hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return index, nil
+}
+
+// Finds a block from the index with the same content as data.
+func (eft *EFT) matchChunk(index chunkIndex, data []byte) ([32]byte, bool, error) {
+	key := [6]byte{}
+	binary.LittleEndian.PutUint16(key[0:2], uint16(len(data)))
+	binary.LittleEndian.PutUint32(key[2:6], chunkSum(data))
+
+	for _, hash := range(index[key]) {
+		block, err := eft.loadBlock(hash)
+		if err != nil {
+			return hash, false, trace(err)
+		}
+
+		if len(block) >= len(data) && bytes.Equal(block[:len(data)], data) {
+			return hash, true, nil
+		}
+	}
+
+	return ZERO_HASH, false, nil
+}
+
+func (eft *EFT) saveChunkedItem(snap *Snapshot, info ItemInfo, src_path string) ([32]byte, error) {
+	hash := [32]byte{}
+
+	index, err := eft.loadChunkIndex(snap, info.Path)
+	if err != nil {
+		return hash, trace(err)
+	}
+
+	src, err := os.Open(src_path)
+	if err != nil {
+		return hash, trace(err)
+	}
+	defer src.Close()
+
+	trie := eft.newLargeTrie(info)
+	ck := newChunker(src, eft.Compress)
+
+	reused := 0
+	ii := uint64(0)
+
+	for {
+		data, err := ck.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return hash, trace(err)
+		}
+
+		pieces := [][]byte{data}
+
+		for len(pieces) > 0 {
+			piece := pieces[0]
+			pieces = pieces[1:]
+
+			b_hash, found, err := eft.matchChunk(index, piece)
+			if err != nil {
+				return hash, trace(err)
+			}
+
+			if found {
+				reused++
+			} else {
+				b_hash, err = eft.saveChunk(piece)
+				if err == ErrBlockFull {
+					pieces = append(splitChunk(piece), pieces...)
+					continue
+				}
+				if err != nil {
+					return hash, trace(err)
+				}
+			}
+
+			err = trie.insertChunk(ii, b_hash, piece)
+			if err != nil {
+				return hash, trace(err)
+			}
+
+			ii++
+		}
+	}
+
+	if reused > 0 {
+		fmt.Println("XX - Reused", reused, "chunks for", info.Path)
+	}
+
+	hash, err = trie.save()
+	if err != nil {
+		return hash, trace(err)
+	}
+
+	return hash, nil
+}
+
+// Saves a chunk in one block. Chunks longer than a block are compressed,
+// and ErrBlockFull means they didn't fit.
+func (eft *EFT) saveChunk(data []byte) ([32]byte, error) {
+	if len(data) > DATA_SIZE {
+		return eft.saveBlock(data)
+	}
+
+	block := make([]byte, DATA_SIZE)
+	copy(block, data)
+
+	return eft.saveBlock(block)
+}
+
+func splitChunk(data []byte) [][]byte {
+	pieces := make([][]byte, 0)
+
+	for len(data) > DATA_SIZE {
+		pieces = append(pieces, data[:DATA_SIZE])
+		data = data[DATA_SIZE:]
+	}
+
+	return append(pieces, data)
+}
@@ -0,0 +1,193 @@
+package eft
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"bytes"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestChunkedItems(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir, Chunking: true}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	name := path.Join(src_dir, "image")
+	data := RandomBytes(40 * DATA_SIZE)
+
+	err = ioutil.WriteFile(name, data, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, name)
+	blocks0 := testItemBlocks(eft, name)
+
+	// Insert a few bytes at the start and in the middle.
+	data1 := append([]byte("header"), data[:20 * DATA_SIZE]...)
+	data1 = append(data1, []byte("inserted")...)
+	data1 = append(data1, data[20 * DATA_SIZE:]...)
+
+	err = ioutil.WriteFile(name, data1, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, name)
+	blocks1 := testItemBlocks(eft, name)
+
+	shared := 0
+	for hash := range(blocks1) {
+		if blocks0[hash] {
+			shared++
+		}
+	}
+
+	if shared < len(blocks1) - 4 {
+		fmt.Println("Only", shared, "of", len(blocks1), "chunks reused")
+		tt.Fail()
+	}
+
+	checkTestItem(tt, eft, name, data1)
+
+	ir, err := eft.Open(name)
+	if err != nil {
+		panic(err)
+	}
+	defer ir.Close()
+
+	for ii := 0; ii < 20; ii++ {
+		off := rand.Intn(len(data1))
+		buf := make([]byte, rand.Intn(2 * DATA_SIZE))
+
+		nn, err := ir.ReadAt(buf, int64(off))
+		if err != nil && nn != len(data1) - off {
+			panic(err)
+		}
+
+		if !bytes.Equal(buf[:nn], data1[off:off + nn]) {
+			fmt.Println("Wrong data read from chunked item at", off)
+			tt.Fail()
+		}
+	}
+
+	// Without chunking, updates fall back to a full Put.
+	eft.Chunking = false
+
+	info, err := FastItemInfo(name)
+	if err != nil {
+		panic(err)
+	}
+
+	err = eft.Update(info, name)
+	if err != nil {
+		panic(err)
+	}
+
+	checkTestItem(tt, eft, name, data1)
+}
+
+func testItemBlocks(eft *EFT, name string) map[[32]byte]bool {
+	eft.Lock()
+	defer eft.Unlock()
+
+	_, hash, err := eft.getTree(eft.mainSnap(), name)
+	if err != nil {
+		panic(err)
+	}
+
+	trie, err := eft.loadLargeTrie(hash)
+	if err != nil {
+		panic(err)
+	}
+
+	blocks := make(map[[32]byte]bool)
+
+	err = trie.root.visitEachEntry(func(ent *TrieEntry) error {
+		if ent.Type == TRIE_TYPE_ITEM {
+			blocks[ent.Hash] = true
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return blocks
+}
+
+func TestChunkedCompressed(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir, Chunking: true, Compress: true}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	text := &bytes.Buffer{}
+	for text.Len() < 40 * DATA_SIZE {
+		fmt.Fprintf(text, "Line %d of a compressible log file.\n", rand.Intn(100000))
+	}
+
+	// The random part doesn't compress, so its chunks are split.
+	data := append(text.Bytes(), RandomBytes(10 * DATA_SIZE)...)
+
+	name := path.Join(src_dir, "log")
+
+	err = ioutil.WriteFile(name, data, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, name)
+	checkTestItem(tt, eft, name, data)
+
+	blocks0 := testItemBlocks(eft, name)
+
+	if len(blocks0) > 40 / 2 + 10 + 4 {
+		fmt.Println("Compressed chunks took", len(blocks0), "blocks")
+		tt.Fail()
+	}
+
+	data1 := append([]byte("header"), data...)
+
+	err = ioutil.WriteFile(name, data1, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, name)
+	checkTestItem(tt, eft, name, data1)
+
+	blocks1 := testItemBlocks(eft, name)
+
+	shared := 0
+	for hash := range(blocks1) {
+		if blocks0[hash] {
+			shared++
+		}
+	}
+
+	if shared < len(blocks1) - 4 {
+		fmt.Println("Only", shared, "of", len(blocks1), "compressed chunks reused")
+		tt.Fail()
+	}
+}
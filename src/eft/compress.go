@@ -0,0 +1,225 @@
+package eft
+
+// Blocks are a fixed size, so compressing a single block's worth of data
+// doesn't save any space. Instead, saveBlock takes up to PACK_MAX bytes
+// and compresses anything over DATA_SIZE to fit in one block, and with
+// EFT.Compress set, large items pack as much data into each block as will
+// fit once compressed.
+//
+// A compressed block holds:
+//
+//   [ 0, 16]: Block mark, derived from the EFT key
+//   [16, 17]: Compression method (1 = flate)
+//   [17, 21]: Length of the uncompressed data (little-endian uint32)
+//   [21,   ]: Compressed data, padded with zeros
+//
+// Plain blocks are stored exactly as before. The mark and flag byte are
+// sealed along with the data, so compressed blocks look like any other
+// block from outside, and loadBlock tells them apart by checking the mark
+// once the block is decrypted. Plain data that happens to start with the
+// mark is stored compressed, so it can't be mistaken for a compressed block.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrBlockFull = errors.New("EFT: data doesn't fit in a block")
+
+const BLOCK_FLATE = 1
+const MARK_SIZE = 16
+const PACK_HEADER = MARK_SIZE + 5
+
+// Entries store the data length in 16 bits.
+var PACK_MAX = 4 * DATA_SIZE
+
+func (eft *EFT) blockMark() []byte {
+	mark := HashSlice(append(eft.Key[:], []byte("compressed")...))
+	return mark[0:MARK_SIZE]
+}
+
+// Gets the plaintext of a block for data, compressing it if needed.
+func (eft *EFT) packBlock(data []byte) ([]byte, error) {
+	mark := eft.blockMark()
+
+	if len(data) == DATA_SIZE && !bytes.Equal(data[0:MARK_SIZE], mark) {
+		return data, nil
+	}
+
+	if len(data) > PACK_MAX {
+		return nil, ErrBlockFull
+	}
+
+	block, ok, err := compressBlock(data)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	if !ok {
+		return nil, ErrBlockFull
+	}
+
+	copy(block[0:MARK_SIZE], mark)
+	return block, nil
+}
+
+// Gets the data in a decrypted block.
+func (eft *EFT) unpackBlock(block []byte) ([]byte, error) {
+	if !bytes.Equal(block[0:MARK_SIZE], eft.blockMark()) {
+		return block, nil
+	}
+
+	return uncompressBlock(block)
+}
+
+// Gets a compressed block for data, or false if it doesn't fit in one.
+// The mark is left for the caller to fill in.
+func compressBlock(data []byte) ([]byte, bool, error) {
+	zbuf := &bytes.Buffer{}
+
+	zw, err := flate.NewWriter(zbuf, flate.DefaultCompression)
+	if err != nil {
+		return nil, false, trace(err)
+	}
+
+	_, err = zw.Write(data)
+	if err != nil {
+		return nil, false, trace(err)
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, false, trace(err)
+	}
+
+	if zbuf.Len() > DATA_SIZE - PACK_HEADER {
+		return nil, false, nil
+	}
+
+	block := make([]byte, DATA_SIZE)
+	block[MARK_SIZE] = BLOCK_FLATE
+	binary.LittleEndian.PutUint32(block[MARK_SIZE + 1:PACK_HEADER], uint32(len(data)))
+	copy(block[PACK_HEADER:], zbuf.Bytes())
+
+	return block, true, nil
+}
+
+func uncompressBlock(block []byte) ([]byte, error) {
+	if block[MARK_SIZE] != BLOCK_FLATE {
+		return nil, fmt.Errorf("Unknown block compression: %d", block[MARK_SIZE])
+	}
+
+	size := binary.LittleEndian.Uint32(block[MARK_SIZE + 1:PACK_HEADER])
+	if size < uint32(DATA_SIZE) || size > uint32(PACK_MAX) {
+		return nil, fmt.Errorf("Bad compressed block size: %d", size)
+	}
+
+	zr := flate.NewReader(bytes.NewReader(block[PACK_HEADER:]))
+	defer zr.Close()
+
+	data := make([]byte, size)
+
+	_, err := io.ReadFull(zr, data)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return data, nil
+}
+
+// Saves the next block of a large item from src, compressed if that packs
+// in more data. Returns the item data in the block.
+func (eft *EFT) savePackedBlock(src *bufio.Reader) ([32]byte, []byte, error) {
+	hash := [32]byte{}
+
+	data, err := src.Peek(PACK_MAX)
+	if err != nil && err != io.EOF {
+		return hash, nil, trace(err)
+	}
+
+	if len(data) == 0 {
+		return hash, nil, io.EOF
+	}
+
+	for size := len(data); size > DATA_SIZE; size /= 2 {
+		hash, err = eft.saveBlock(data[:size])
+		if err == ErrBlockFull {
+			continue
+		}
+		if err != nil {
+			return hash, nil, trace(err)
+		}
+
+		data, err = readBuffered(src, size)
+		return hash, data, err
+	}
+
+	size := len(data)
+	if size > DATA_SIZE {
+		size = DATA_SIZE
+	}
+
+	block := make([]byte, DATA_SIZE)
+	copy(block, data[:size])
+
+	hash, err = eft.saveBlock(block)
+	if err != nil {
+		return hash, nil, trace(err)
+	}
+
+	data, err = readBuffered(src, size)
+	return hash, data, err
+}
+
+// Takes size bytes already peeked at from src.
+func readBuffered(src *bufio.Reader, size int) ([]byte, error) {
+	data := make([]byte, size)
+
+	_, err := io.ReadFull(src, data)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return data, nil
+}
+
+func (eft *EFT) savePackedItem(info ItemInfo, src_path string) ([32]byte, error) {
+	hash := [32]byte{}
+
+	file, err := os.Open(src_path)
+	if err != nil {
+		return hash, trace(err)
+	}
+	defer file.Close()
+
+	src := bufio.NewReaderSize(file, PACK_MAX)
+	trie := eft.newLargeTrie(info)
+
+	for ii := uint64(0); true; ii++ {
+		b_hash, data, err := eft.savePackedBlock(src)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return hash, trace(err)
+		}
+
+		err = trie.insertChunk(ii, b_hash, data)
+		if err != nil {
+			return hash, trace(err)
+		}
+	}
+
+	hash, err = trie.save()
+	if err != nil {
+		return hash, trace(err)
+	}
+
+	return hash, nil
+}
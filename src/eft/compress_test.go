@@ -0,0 +1,157 @@
+package eft
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"bytes"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestPackedItems(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir, Compress: true}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	text := &bytes.Buffer{}
+	for text.Len() < 20 * DATA_SIZE {
+		fmt.Fprintf(text, "Line %d of a compressible log file.\n", rand.Intn(1000))
+	}
+
+	mixed := append(RandomBytes(3 * DATA_SIZE), text.Bytes()[:5 * DATA_SIZE]...)
+
+	for _, data := range([][]byte{text.Bytes(), RandomBytes(5 * DATA_SIZE + 7), mixed}) {
+		name := path.Join(src_dir, fmt.Sprintf("file-%d", len(data)))
+
+		err = ioutil.WriteFile(name, data, 0600)
+		if err != nil {
+			panic(err)
+		}
+
+		putTestFile(eft, name)
+		checkTestItem(tt, eft, name, data)
+
+		ir, err := eft.Open(name)
+		if err != nil {
+			panic(err)
+		}
+
+		data1, err := ioutil.ReadAll(ir)
+		if err != nil {
+			panic(err)
+		}
+
+		if !bytes.Equal(data, data1) {
+			fmt.Println("Wrong data read from packed item")
+			tt.Fail()
+		}
+
+		ir.Close()
+	}
+
+	blocks := testItemBlocks(eft, path.Join(src_dir, fmt.Sprintf("file-%d", text.Len())))
+
+	if len(blocks) > 20 / 4 + 1 {
+		fmt.Println("Text took", len(blocks), "blocks")
+		tt.Fail()
+	}
+}
+
+func TestCompressBlock(tt *testing.T) {
+	eft := &EFT{Key: [32]byte{}, Dir: TmpRandomName(), Store: NewMemStore()}
+	defer os.RemoveAll(eft.Dir)
+
+	eft.Lock()
+	defer eft.Unlock()
+
+	eft.begin()
+	defer eft.commit()
+
+	data := bytes.Repeat([]byte("goats!"), DATA_SIZE / 2)
+
+	hash, err := eft.saveBlock(data)
+	if err != nil {
+		panic(err)
+	}
+
+	ctxt, err := eft.store().Get(hash)
+	if err != nil {
+		panic(err)
+	}
+
+	// Sealed under the EFT key, marked inside.
+	block, err := DecryptBlock(ctxt, eft.Key)
+	if err != nil {
+		panic(err)
+	}
+
+	if !bytes.Equal(block[0:MARK_SIZE], eft.blockMark()) || block[MARK_SIZE] != BLOCK_FLATE {
+		fmt.Println("Compressed block not marked")
+		tt.Fail()
+	}
+
+	data1, err := eft.loadBlock(hash)
+	if err != nil {
+		panic(err)
+	}
+
+	if !bytes.Equal(data, data1) {
+		fmt.Println("Compressed block didn't round trip")
+		tt.Fail()
+	}
+
+	_, err = eft.saveBlock(RandomBytes(2 * DATA_SIZE))
+	if err != ErrBlockFull {
+		fmt.Println("Random data compressed:", err)
+		tt.Fail()
+	}
+
+	// Plain data that looks like a compressed block is stored compressed.
+	fake := make([]byte, DATA_SIZE)
+	copy(fake, eft.blockMark())
+	fake[MARK_SIZE] = 99
+
+	hash, err = eft.saveBlock(fake)
+	if err != nil {
+		panic(err)
+	}
+
+	fake1, err := eft.loadBlock(hash)
+	if err != nil {
+		panic(err)
+	}
+
+	if !bytes.Equal(fake, fake1) {
+		fmt.Println("Marked plain block misread")
+		tt.Fail()
+	}
+
+	plain := RandomBytes(DATA_SIZE)
+
+	hash, err = eft.saveBlock(plain)
+	if err != nil {
+		panic(err)
+	}
+
+	ctxt, err = eft.store().Get(hash)
+	if err != nil {
+		panic(err)
+	}
+
+	block, err = DecryptBlock(ctxt, eft.Key)
+	if err != nil || !bytes.Equal(block, plain) {
+		fmt.Println("Plain block not stored as is")
+		tt.Fail()
+	}
+}
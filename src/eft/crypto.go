@@ -3,6 +3,7 @@ package eft
 import (
 	"encoding/hex"
 	"crypto/rand"
+	"crypto/hmac"
 	"crypto/sha256"
 	"golang.org/x/crypto/nacl/secretbox"
 	"os"
@@ -76,6 +77,25 @@ func EncryptBlock(data []byte, key [32]byte) []byte {
 	return secretbox.Seal(ctxt, data, &nonce, &key) 
 }
 
+// Encrypts with a nonce derived from the data, so the same data always
+// gives the same block. This lets identical content added on different
+// devices share blocks, but someone watching the stored blocks can tell
+// when the same content is stored again.
+func EncryptBlockConvergent(data []byte, key [32]byte, nonce_key [32]byte) []byte {
+	if len(data) != (BLOCK_SIZE - BLOCK_OVERHEAD) {
+		panic("EncryptBlock: Bad block size")
+	}
+
+	mac := hmac.New(sha256.New, nonce_key[:])
+	mac.Write(data)
+	ctxt := mac.Sum(nil)[0:24]
+
+	var nonce [24]byte
+	copy(nonce[:], ctxt[0:24])
+
+	return secretbox.Seal(ctxt, data, &nonce, &key)
+}
+
 func DecryptBlock(ctxt []byte, key [32]byte) ([]byte, error) {
 	if len(ctxt) != BLOCK_SIZE {
 		return nil, fmt.Errorf("eft.DecryptBlock: Bad block size")
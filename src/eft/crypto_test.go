@@ -40,3 +40,34 @@ func TestRoundtripBlock(tt *testing.T) {
 	}
 }
 
+
+func TestConvergentBlock(tt *testing.T) {
+	data := make([]byte, DATA_SIZE)
+	data[29] = byte(42)
+
+	var key [32]byte
+	var nonce_key [32]byte
+
+	ctxt0 := EncryptBlockConvergent(data, key, nonce_key)
+	ctxt1 := EncryptBlockConvergent(data, key, nonce_key)
+
+	if bytes.Compare(ctxt0, ctxt1) != 0 {
+		tt.Fail()
+	}
+
+	nonce_key[0] = 1
+	ctxt2 := EncryptBlockConvergent(data, key, nonce_key)
+
+	if bytes.Compare(ctxt0, ctxt2) == 0 {
+		tt.Fail()
+	}
+
+	ptxt, err := DecryptBlock(ctxt0, key)
+	if err != nil {
+		panic(err)
+	}
+
+	if bytes.Compare(data, ptxt) != 0 {
+		tt.Fail()
+	}
+}
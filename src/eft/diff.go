@@ -0,0 +1,170 @@
+package eft
+
+// Lists the items that differ between two versions of the main tree. The
+// path tries are compared with diffEntries, which skips slots whose
+// entries match, so only the parts that changed are loaded.
+
+import (
+	"sort"
+)
+
+const (
+	DIFF_ADDED    = "added"
+	DIFF_MODIFIED = "modified"
+	DIFF_DELETED  = "deleted"
+	DIFF_RETYPED  = "type changed"
+)
+
+type ItemChange struct {
+	Kind string
+	Path string
+	Old  ItemInfo // Zero if added
+	New  ItemInfo // Tombstone if deleted, zero if no longer present
+}
+
+type changesByPath []ItemChange
+
+func (cc changesByPath) Len() int {
+	return len(cc)
+}
+
+func (cc changesByPath) Less(ii, jj int) bool {
+	return cc[ii].Path < cc[jj].Path
+}
+
+func (cc changesByPath) Swap(ii, jj int) {
+	cc[ii], cc[jj] = cc[jj], cc[ii]
+}
+
+// Compares the main trees of two EFT roots, as given by RootHash. A zero
+// hash is an empty EFT.
+func (eft *EFT) Diff(root_a, root_b [32]byte) ([]ItemChange, error) {
+	eft.Lock()
+	defer eft.Unlock()
+
+	snap_a, err := eft.rootMainSnap(root_a)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	snap_b, err := eft.rootMainSnap(root_b)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return eft.diffSnaps(snap_a, snap_b)
+}
+
+// Compares two snapshots in the current snapshot list.
+func (eft *EFT) DiffSnapshots(idx_a, idx_b int) ([]ItemChange, error) {
+	eft.Lock()
+	defer eft.Unlock()
+
+	snap_a, err := eft.snapAt(idx_a)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	snap_b, err := eft.snapAt(idx_b)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return eft.diffSnaps(*snap_a, *snap_b)
+}
+
+func (eft *EFT) rootMainSnap(root [32]byte) (Snapshot, error) {
+	if root == ZERO_HASH {
+		return Snapshot{eft: eft}, nil
+	}
+
+	snaps, err := eft.loadSnapsFrom(root)
+	if err != nil {
+		return Snapshot{}, trace(err)
+	}
+
+	return snaps[0], nil
+}
+
+func (eft *EFT) diffSnaps(snap_a, snap_b Snapshot) ([]ItemChange, error) {
+	changes := make([]ItemChange, 0)
+
+	if snap_a.Root == snap_b.Root {
+		return changes, nil
+	}
+
+	pt_a, err := eft.loadPathTrie(snap_a.Root)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	pt_b, err := eft.loadPathTrie(snap_b.Root)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	err = pt_a.root.diffEntries(pt_b.root, func(ent0, ent1 *TrieEntry) error {
+		info0 := ItemInfo{}
+		info1 := ItemInfo{}
+
+		if ent0 != nil {
+			info, err := eft.loadItemInfo(ent0.Hash)
+			if err != nil {
+				return trace(err)
+			}
+			info0 = info
+		}
+
+		if ent1 != nil {
+			info, err := eft.loadItemInfo(ent1.Hash)
+			if err != nil {
+				return trace(err)
+			}
+			info1 = info
+		}
+
+		kind := diffKind(info0, info1)
+		if kind == "" {
+			return nil
+		}
+
+		item_path := info1.Path
+		if ent1 == nil {
+			item_path = info0.Path
+		}
+
+		changes = append(changes, ItemChange{
+			Kind: kind,
+			Path: item_path,
+			Old:  info0,
+			New:  info1,
+		})
+
+		return nil
+	})
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	sort.Sort(changesByPath(changes))
+	return changes, nil
+}
+
+// Deleted items are normally tombstones, which count as not being there.
+func diffKind(info0, info1 ItemInfo) string {
+	live0 := info0.Type != 0 && !info0.IsTomb()
+	live1 := info1.Type != 0 && !info1.IsTomb()
+
+	switch {
+	case !live0 && !live1:
+		return ""
+	case !live0:
+		return DIFF_ADDED
+	case !live1:
+		return DIFF_DELETED
+	case info0.Type != info1.Type:
+		return DIFF_RETYPED
+	}
+
+	return DIFF_MODIFIED
+}
@@ -0,0 +1,138 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestDiff(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	names := make(map[string]string)
+	for _, nn := range([]string{"same", "edit", "gone", "new", "link"}) {
+		names[nn] = path.Join(src_dir, nn)
+	}
+
+	for _, nn := range([]string{"same", "edit", "gone", "link"}) {
+		err = ioutil.WriteFile(names[nn], []byte("version one of " + nn), 0600)
+		if err != nil {
+			panic(err)
+		}
+
+		putTestFile(eft, names[nn])
+	}
+
+	root0 := HexToHash(eft.RootHash1())
+
+	err = ioutil.WriteFile(names["edit"], []byte("version two"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	putTestFile(eft, names["edit"])
+
+	err = ioutil.WriteFile(names["new"], []byte("brand new"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	putTestFile(eft, names["new"])
+
+	err = eft.Del(names["gone"])
+	if err != nil {
+		panic(err)
+	}
+
+	err = os.Remove(names["link"])
+	if err != nil {
+		panic(err)
+	}
+
+	err = os.Symlink(names["same"], names["link"])
+	if err != nil {
+		panic(err)
+	}
+	putTestFile(eft, names["link"])
+
+	root1 := HexToHash(eft.RootHash1())
+
+	changes, err := eft.Diff(root0, root1)
+	if err != nil {
+		panic(err)
+	}
+
+	expect := map[string]string{
+		names["edit"]: DIFF_MODIFIED,
+		names["gone"]: DIFF_DELETED,
+		names["new"]:  DIFF_ADDED,
+		names["link"]: DIFF_RETYPED,
+	}
+
+	if len(changes) != len(expect) {
+		fmt.Println("Wrong number of changes:", changes)
+		tt.Fail()
+	}
+
+	for _, ch := range(changes) {
+		if expect[ch.Path] != ch.Kind {
+			fmt.Println("Wrong change for", ch.Path, ch.Kind)
+			tt.Fail()
+		}
+
+		if ch.Kind == DIFF_MODIFIED && ch.Old.Hash == ch.New.Hash {
+			fmt.Println("Modified item with unchanged content")
+			tt.Fail()
+		}
+	}
+
+	// Going back undoes everything.
+	changes, err = eft.Diff(root1, root0)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, ch := range(changes) {
+		if ch.Path == names["new"] && ch.Kind != DIFF_DELETED {
+			fmt.Println("Reverse diff didn't delete new item")
+			tt.Fail()
+		}
+
+		if ch.Path == names["gone"] && ch.Kind != DIFF_ADDED {
+			fmt.Println("Reverse diff didn't add deleted item")
+			tt.Fail()
+		}
+	}
+
+	// Everything is new compared to an empty tree.
+	changes, err = eft.Diff(ZERO_HASH, root0)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(changes) != 4 {
+		fmt.Println("Wrong number of changes from empty:", len(changes))
+		tt.Fail()
+	}
+
+	changes, err = eft.Diff(root1, root1)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(changes) != 0 {
+		fmt.Println("Changes between identical roots:", changes)
+		tt.Fail()
+	}
+}
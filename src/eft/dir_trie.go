@@ -0,0 +1,291 @@
+package eft
+
+// The directory index lets a directory be listed without visiting every
+// item in the EFT. Since the path trie is keyed by the hash of each path,
+// items in the same directory are spread all over it.
+//
+// The index is a second trie, mapping the same item blocks as the path
+// trie, keyed by:
+//
+//   HashString(parent directory)[0:8] + HashString(path)
+//
+// All the children of a directory share the first 8 bytes of their key,
+// so they are found together under one branch of the trie. The trie
+// has a node for each byte of a shared prefix, so it's kept short: a
+// longer one would mean a chain of nodes to rewrite on every change in a
+// large directory. Other directories can share the prefix, and list
+// skips their children. The hash of the index root is stored in the
+// header of the path trie root node.
+
+import (
+	"path"
+)
+
+type DirTrie struct {
+	root *TrieNode
+}
+
+const DIR_PREFIX = 8
+
+func dirPrefix(dir string) []byte {
+	dir_hash := HashString(dir)
+	return dir_hash[0:DIR_PREFIX]
+}
+
+func dirKey(item_path string) []byte {
+	path_hash := HashString(item_path)
+	return append(dirPrefix(path.Dir(item_path)), path_hash[:]...)
+}
+
+func (dt *DirTrie) KeyBytes(ee TrieEntry) ([]byte, error) {
+	info, err := dt.root.eft.loadItemInfo(ee.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return dirKey(info.Path), nil
+}
+
+// Siblings share the directory prefix, so the partial key is taken from
+// the path hash after it.
+func (dt *DirTrie) pkeyOffset() int {
+	return DIR_PREFIX
+}
+
+func (eft *EFT) emptyDirTrie() *DirTrie {
+	dt := &DirTrie{}
+
+	dt.root = &TrieNode{
+		eft: eft,
+		tri: dt,
+		dep: 0,
+	}
+
+	return dt
+}
+
+func (eft *EFT) loadDirTrie(hash [32]byte) (*DirTrie, error) {
+	dt := eft.emptyDirTrie()
+
+	if hash != ZERO_HASH {
+		err := dt.root.load(hash)
+		if err != nil {
+			return nil, trace(err)
+		}
+	}
+
+	return dt, nil
+}
+
+func (dt *DirTrie) save() ([32]byte, error) {
+	return dt.root.save()
+}
+
+func (dt *DirTrie) insert(item_path string, data_hash [32]byte) error {
+	key := dirKey(item_path)
+
+	entry := TrieEntry{}
+	entry.Hash = data_hash
+	copy(entry.Pkey[:], key[DIR_PREFIX:])
+
+	return dt.root.insert(key, entry)
+}
+
+func (dt *DirTrie) remove(item_path string) error {
+	return dt.root.remove(dirKey(item_path))
+}
+
+// Calls fn with the info for each direct child of dir.
+func (dt *DirTrie) list(dir string, fn func(info ItemInfo) error) error {
+	prefix := dirPrefix(dir)
+
+	visit := func(ent *TrieEntry) error {
+		if ent.Type != TRIE_TYPE_ITEM {
+			return nil
+		}
+
+		info, err := dt.root.eft.loadItemInfo(ent.Hash)
+		if err != nil {
+			return trace(err)
+		}
+
+		if info.Path == dir || path.Dir(info.Path) != dir {
+			return nil
+		}
+
+		return fn(info)
+	}
+
+	tn := dt.root
+
+	// Follow the directory prefix down to the branch holding its children.
+	for tn.dep < len(prefix) {
+		slot := prefix[tn.dep]
+		ent := tn.tab[slot]
+
+		if ent.Type != TRIE_TYPE_MORE {
+			ents, err := tn.slotEntries(slot)
+			if err != nil {
+				return trace(err)
+			}
+
+			for ii := range(ents) {
+				err := visit(&ents[ii])
+				if err != nil {
+					return trace(err)
+				}
+			}
+
+			return nil
+		}
+
+		next, err := tn.loadChild(ent.Hash)
+		if err != nil {
+			return trace(err)
+		}
+
+		tn = next
+	}
+
+	return tn.visitEachEntry(visit)
+}
+
+func (dt *DirTrie) visitEachBlock(fn func(hash [32]byte) error) error {
+	return dt.root.visitEachEntry(func (ent *TrieEntry) error {
+		switch ent.Type {
+		case TRIE_TYPE_MORE, TRIE_TYPE_OVRF:
+			return fn(ent.Hash)
+		}
+
+		// Items are shared with the path trie.
+		return nil
+	})
+}
+
+func (pt *PathTrie) dirsHash() [32]byte {
+	hash := [32]byte{}
+	copy(hash[:], pt.root.hdr[0:32])
+	return hash
+}
+
+// Gets the directory index for a path trie. Tries saved before the index
+// existed get one built from scratch.
+func (pt *PathTrie) dirTrie() (*DirTrie, error) {
+	if pt.dirs != nil {
+		return pt.dirs, nil
+	}
+
+	eft := pt.root.eft
+
+	dt, err := eft.loadDirTrie(pt.dirsHash())
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	if pt.dirsHash() == ZERO_HASH {
+		err = pt.root.visitEachEntry(func (ent *TrieEntry) error {
+			if ent.Type != TRIE_TYPE_ITEM {
+				return nil
+			}
+
+			info, err := eft.loadItemInfo(ent.Hash)
+			if err != nil {
+				return trace(err)
+			}
+
+			return dt.insert(info.Path, ent.Hash)
+		})
+		if err != nil {
+			return nil, trace(err)
+		}
+	}
+
+	pt.dirs = dt
+	return dt, nil
+}
+
+// Brings the directory index from pt0 up to date with the entries in pt.
+func (pt *PathTrie) updateDirs(pt0 *PathTrie) error {
+	eft := pt.root.eft
+
+	if pt0.dirsHash() == ZERO_HASH {
+		pt.dirs = nil
+		return nil
+	}
+
+	dt, err := eft.loadDirTrie(pt0.dirsHash())
+	if err != nil {
+		return trace(err)
+	}
+
+	err = pt0.root.diffEntries(pt.root, func(ent0, ent1 *TrieEntry) error {
+		if ent1 == nil {
+			info, err := eft.loadItemInfo(ent0.Hash)
+			if err != nil {
+				return trace(err)
+			}
+
+			err = dt.remove(info.Path)
+			if err != nil && err != ErrNotFound {
+				return trace(err)
+			}
+
+			return nil
+		}
+
+		info, err := eft.loadItemInfo(ent1.Hash)
+		if err != nil {
+			return trace(err)
+		}
+
+		return dt.insert(info.Path, ent1.Hash)
+	})
+	if err != nil {
+		return trace(err)
+	}
+
+	pt.dirs = dt
+	return nil
+}
+
+func (eft *EFT) listDir(snap *Snapshot, dir string) ([]ItemInfo, error) {
+	infos := make([]ItemInfo, 0)
+
+	add := func(info ItemInfo) error {
+		infos = append(infos, info)
+		return nil
+	}
+
+	pt, err := eft.loadPathTrie(snap.Root)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	if pt.dirsHash() == ZERO_HASH {
+		// No index yet; it gets built on the next update.
+		err = eft.visitTree(snap, func(info ItemInfo, _ [32]byte) error {
+			if info.Path == dir || path.Dir(info.Path) != dir {
+				return nil
+			}
+
+			return add(info)
+		})
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		return infos, nil
+	}
+
+	dt, err := eft.loadDirTrie(pt.dirsHash())
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	err = dt.list(dir, add)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return infos, nil
+}
@@ -0,0 +1,113 @@
+package eft
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestListDir(tt *testing.T) {
+	eft0_dir := TmpRandomName()
+	eft1_dir := TmpRandomName()
+	src_dir  := TmpRandomName()
+
+	defer os.RemoveAll(eft0_dir)
+	defer os.RemoveAll(eft1_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft0 := &EFT{Key: [32]byte{}, Dir: eft0_dir}
+	eft1 := &EFT{Key: [32]byte{}, Dir: eft1_dir}
+
+	doc  := path.Join(src_dir, "Doc")
+	docs := path.Join(src_dir, "Documents")
+
+	names0 := writeTestFiles(doc, 600)
+	names1 := writeTestFiles(docs, 20)
+	names2 := writeTestFiles(path.Join(doc, "sub"), 5)
+
+	for _, name := range(names0) {
+		putTestFile(eft0, name)
+	}
+
+	for _, name := range(append(names1, names2...)) {
+		putTestFile(eft1, name)
+	}
+
+	syncTestEFTs(eft1, eft0)
+
+	counts := map[string]int{
+		doc:  len(names0),
+		docs: len(names1),
+		path.Join(doc, "sub"): len(names2),
+		src_dir: 0,
+	}
+
+	for dir, count := range(counts) {
+		infos, err := eft0.ListDir(dir)
+		if err != nil {
+			panic(err)
+		}
+
+		if len(infos) != count {
+			fmt.Println("Listed", len(infos), "items in", dir, "expected", count)
+			tt.Fail()
+		}
+
+		for _, info := range(infos) {
+			if path.Dir(info.Path) != dir {
+				fmt.Println("Listed", info.Path, "in", dir)
+				tt.Fail()
+			}
+		}
+	}
+
+	infos, err := eft0.ListDir("/")
+	if err != nil {
+		panic(err)
+	}
+
+	if len(infos) != 0 {
+		fmt.Println("Listed", len(infos), "items in /, expected none")
+		tt.Fail()
+	}
+}
+
+func TestDirIndexPutBlocks(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	names := writeTestFiles(src_dir, 501)
+
+	for _, name := range(names[:500]) {
+		putTestFile(eft, name)
+	}
+
+	before := testAddedCount(eft)
+	putTestFile(eft, names[500])
+	added := testAddedCount(eft) - before
+
+	// The item, a few path trie nodes, the snapshot list and update log,
+	// and a node for each byte of the directory prefix in the index. A
+	// whole hash as the prefix took 38.
+	if added > 20 {
+		fmt.Println("Put in a large directory added", added, "blocks")
+		tt.Fail()
+	}
+}
+
+func testAddedCount(eft *EFT) int {
+	data, err := ioutil.ReadFile(path.Join(eft.Dir, "added"))
+	if err != nil {
+		panic(err)
+	}
+
+	return strings.Count(string(data), "\n")
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"sync"
 	"path"
+	"time"
 	"os"
 	"fmt"
 )
@@ -15,22 +16,39 @@ type EFT struct {
 	Key  [32]byte // Key for cipher and MAC
 	Dir  string   // Path to block store
 
+	LogKeep  time.Duration // How long to keep update log entries
+	TombKeep time.Duration // How long to keep tombstones, see purge.go
+	Device   string        // Names this device in the update log
+	Chunking bool          // Split large items at content-defined boundaries
+	Compress bool          // Pack compressed data into large item blocks, or chunks
+
+	Convergent bool     // Derive block nonces from content, see EncryptBlockConvergent
+	NonceKey   [32]byte // Key for convergent nonces
+
+	Store BlockStore // Where blocks are kept, nil for a DirStore in Dir/blocks
+
 	// Current transaction
 	Snaps []Snapshot
 
+	damaged int32 // A block failed to load, see Repair
+
 	added *os.File
 	addedName string
+
+	pins   map[[32]byte]int          // Roots of open views, see RootView
+	held   bool                      // New views wait, see holdViews
+	nodes  map[[32]byte]*pendingNode // Trie nodes of an open Txn
+	smutex sync.Mutex                // Guards pins, held, nodes and setting up Store
 	
 	// Synchronize access
 	mutex  sync.Mutex
+	cmutex sync.Mutex // Held by a checkpoint until Commit or Abort
 	lockf  *os.File
 	locked bool
 }
 
+// The snaps file is replaced atomically, so this doesn't need the lock.
 func (eft *EFT) RootHash() (string, error) {
-	eft.Lock()
-	defer eft.Unlock()
-
 	hash, err := eft.loadSnapsHash()
 	if err != nil {
 		return "", trace(err)
@@ -47,6 +65,7 @@ func (eft *EFT) RootHash1() string {
 	return hash
 }
 
+// Where a DirStore in Dir/blocks keeps a block.
 func (eft *EFT) BlockPath(hash [32]byte) string {
 	text := hex.EncodeToString(hash[:])
 	d0 := text[0:2]
@@ -59,7 +78,15 @@ func (eft *EFT) Put(info ItemInfo, src_path string) error {
 
 	eft.begin()
 
-	err := eft.putItem(eft.mainSnap(), info, src_path)
+	snap := eft.mainSnap()
+
+	err := eft.putItem(snap, info, src_path)
+	if err != nil {
+		eft.abort()
+		return trace(err)
+	}
+
+	err = eft.logEvent(snap, newLogEntry(LOG_PUT, info.Path))
 	if err != nil {
 		eft.abort()
 		return trace(err)
@@ -70,34 +97,25 @@ func (eft *EFT) Put(info ItemInfo, src_path string) error {
 	return nil
 }
 
+// Reads go through a RootView, so they don't wait for the lock.
 func (eft *EFT) Get(name string, dst_path string) (ItemInfo, error) {
-	eft.Lock()
-	defer eft.Unlock()
-
-	dst_parent := path.Dir(dst_path)
-	err := os.MkdirAll(dst_parent, 0755)
+	rv, err := eft.View()
 	if err != nil {
-		panic(err)
+		return ItemInfo{}, trace(err)
 	}
+	defer rv.Close()
 
-	info, err := eft.getItem(eft.mainSnap(), name, dst_path)
-	if err != nil {
-		return info, err
-	}
-
-	return info, nil
+	return rv.Get(name, dst_path)
 }
 
 func (eft *EFT) GetInfo(name string) (ItemInfo, error) {
-	eft.Lock()
-	defer eft.Unlock()
-
-	info, _, err := eft.getTree(eft.mainSnap(), name)
+	rv, err := eft.View()
 	if err != nil {
-		return info, err
+		return ItemInfo{}, trace(err)
 	}
+	defer rv.Close()
 
-	return info, nil
+	return rv.GetInfo(name)
 }
 
 func (eft *EFT) Del(name string) error {
@@ -114,25 +132,25 @@ func (eft *EFT) Del(name string) error {
 		return err
 	}
 
+	err = eft.logEvent(snap, newLogEntry(LOG_DEL, name))
+	if err != nil {
+		eft.abort()
+		return trace(err)
+	}
+
 	eft.commit()
 	return nil
 }
 
-func (eft *EFT) ListDir(path string) ([]ItemInfo, error) {
-	infos, err := eft.ListInfos()
+// Lists the items directly inside a directory.
+func (eft *EFT) ListDir(dir string) ([]ItemInfo, error) {
+	rv, err := eft.View()
 	if err != nil {
-		return nil, err
-	}
-
-	list := make([]ItemInfo, 0)
-
-	for _, info := range(infos) {
-		if info.Path[0:len(path)] == path {
-			list = append(list, info)
-		}
+		return nil, trace(err)
 	}
+	defer rv.Close()
 
-	return list, nil
+	return rv.ListDir(dir)
 }
 
 func (eft *EFT) DebugDump() {
@@ -148,10 +166,6 @@ func (eft *EFT) DebugDump() {
 	}
 }
 
-func (eft *EFT) ListBlocks() ([]string, error) {
-	return make([]string, 0), nil
-}
-
 func (eft *EFT) TempName() string {
 	temp  := path.Join(eft.Dir, "tmp")
 	err := os.MkdirAll(temp, 0700)
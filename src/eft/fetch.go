@@ -56,9 +56,58 @@ func (eft *EFT) fetchSnap(snap Snapshot, fetch_fn FetchFn) error {
 		return trace(err)
 	}
 
+	err = eft.fetchDirTrie(pt.dirsHash(), fetch_fn)
+	if err != nil {
+		return trace(err)
+	}
+
+	err = eft.fetchLog(snap.Log, fetch_fn)
+	if err != nil {
+		return trace(err)
+	}
+
 	return nil
 }
 
+func (eft *EFT) fetchLog(hash [32]byte, fetch_fn FetchFn) error {
+	if hash == ZERO_HASH {
+		return nil
+	}
+
+	bs, err := eft.NewBlockSet1(hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	err = eft.fetchBlocks(bs, fetch_fn)
+	if err != nil {
+		return trace(err)
+	}
+
+	ul, err := eft.loadLog(hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	bs, err = eft.NewBlockSet()
+	if err != nil {
+		return trace(err)
+	}
+
+	for _, ref := range(ul.sealed) {
+		err = bs.Add(ref.Hash)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	if bs.Size() == 0 {
+		return nil
+	}
+
+	return eft.fetchBlocks(bs, fetch_fn)
+}
+
 func (eft *EFT) fetchPathTrieNode(ptn *TrieNode, dd int, fetch_fn FetchFn) error {
 	// First, fetch all sub-blocks
 	bs, err := eft.NewBlockSet()
@@ -66,13 +115,9 @@ func (eft *EFT) fetchPathTrieNode(ptn *TrieNode, dd int, fetch_fn FetchFn) error
 		return trace(err)
 	}
 
-	for _, ent := range(ptn.tab) {
-		if ent.Type != TRIE_TYPE_NONE {
-			err := bs.Add(ent.Hash)
-			if err != nil {
-				return trace(err)
-			}
-		}
+	err = ptn.addEntryBlocks(bs)
+	if err != nil {
+		return trace(err)
 	}
 
 	err = eft.fetchBlocks(bs, fetch_fn)
@@ -80,6 +125,19 @@ func (eft *EFT) fetchPathTrieNode(ptn *TrieNode, dd int, fetch_fn FetchFn) error
 		return trace(err)
 	}
 
+	// Then the blocks referenced from overflow tables
+	ovr_ents, err := eft.fetchOverflow(ptn, fetch_fn)
+	if err != nil {
+		return trace(err)
+	}
+
+	for _, ent := range(ovr_ents) {
+		err = eft.fetchItem(ent.Hash, fetch_fn)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
 	// Next, recurse
 	for _, ent := range(ptn.tab) {
 		switch ent.Type {
@@ -100,7 +158,8 @@ func (eft *EFT) fetchPathTrieNode(ptn *TrieNode, dd int, fetch_fn FetchFn) error
 			continue
 
 		case TRIE_TYPE_OVRF:
-			panic("TODO")
+			// Fetched above
+			continue
 
 		case TRIE_TYPE_ITEM:
 			err = eft.fetchItem(ent.Hash, fetch_fn)
@@ -118,7 +177,106 @@ func (eft *EFT) fetchPathTrieNode(ptn *TrieNode, dd int, fetch_fn FetchFn) error
 	return nil
 }
 
+func (eft *EFT) fetchDirTrie(hash [32]byte, fetch_fn FetchFn) error {
+	if hash == ZERO_HASH {
+		return nil
+	}
+
+	bs, err := eft.NewBlockSet1(hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	err = eft.fetchBlocks(bs, fetch_fn)
+	if err != nil {
+		return trace(err)
+	}
+
+	dt, err := eft.loadDirTrie(hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	return eft.fetchTrieNodes(dt.root, fetch_fn)
+}
+
+// Fetches the sub-tries and overflow tables below a node, but not the
+// blocks its items refer to.
+func (eft *EFT) fetchTrieNodes(tn *TrieNode, fetch_fn FetchFn) error {
+	bs, err := eft.NewBlockSet()
+	if err != nil {
+		return trace(err)
+	}
+
+	for _, ent := range(tn.tab) {
+		if ent.Type == TRIE_TYPE_MORE {
+			err = bs.Add(ent.Hash)
+			if err != nil {
+				return trace(err)
+			}
+		}
+	}
+
+	for _, hash := range(tn.ovr) {
+		if hash != ZERO_HASH {
+			err = bs.Add(hash)
+			if err != nil {
+				return trace(err)
+			}
+		}
+	}
+
+	if bs.Size() == 0 {
+		return nil
+	}
+
+	err = eft.fetchBlocks(bs, fetch_fn)
+	if err != nil {
+		return trace(err)
+	}
+
+	for _, ent := range(tn.tab) {
+		if ent.Type != TRIE_TYPE_MORE {
+			continue
+		}
+
+		next, err := tn.loadChild(ent.Hash)
+		if err != nil {
+			return trace(err)
+		}
+
+		err = eft.fetchTrieNodes(next, fetch_fn)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return nil
+}
+
 func (eft *EFT) fetchItem(hash [32]byte, fetch_fn FetchFn) error {
+	spill, err := eft.itemSpill(hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	if spill != ZERO_HASH {
+		bs, err := eft.NewBlockSet()
+		if err != nil {
+			return trace(err)
+		}
+
+		err = bs.Add(spill)
+		if err != nil {
+			return trace(err)
+		}
+
+		err = eft.fetchBlocks(bs, fetch_fn)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
 	info, err := eft.loadItemInfo(hash)
 	if err != nil {
 		return trace(err)
@@ -146,13 +304,9 @@ func (eft *EFT) fetchLargeNode(ltn *TrieNode, dd int, fetch_fn FetchFn) error {
 		return trace(err)
 	}
 
-	for _, ent := range(ltn.tab) {
-		if ent.Type != TRIE_TYPE_NONE {
-			err := bs.Add(ent.Hash)
-			if err != nil {
-				return trace(err)
-			}
-		}
+	err = ltn.addEntryBlocks(bs)
+	if err != nil {
+		return trace(err)
 	}
 	
 	err = eft.fetchBlocks(bs, fetch_fn)
@@ -160,6 +314,11 @@ func (eft *EFT) fetchLargeNode(ltn *TrieNode, dd int, fetch_fn FetchFn) error {
 		return trace(err)
 	}
 
+	_, err = eft.fetchOverflow(ltn, fetch_fn)
+	if err != nil {
+		return trace(err)
+	}
+
 	// Then, recurse
 	for _, ent := range(ltn.tab) {
 		if ent.Type == TRIE_TYPE_MORE {
@@ -178,6 +337,78 @@ func (eft *EFT) fetchLargeNode(ltn *TrieNode, dd int, fetch_fn FetchFn) error {
 	return nil
 }
 
+func (tn *TrieNode) addEntryBlocks(bs *BlockSet) error {
+	for _, ent := range(tn.tab) {
+		if ent.Type == TRIE_TYPE_NONE || ent.Type == TRIE_TYPE_OVRF {
+			continue
+		}
+
+		err := bs.Add(ent.Hash)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	for _, hash := range(tn.ovr) {
+		if hash == ZERO_HASH {
+			continue
+		}
+
+		err := bs.Add(hash)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return nil
+}
+
+// Fetches the blocks directly referenced by entries in the overflow
+// tables of a node, which must already be present. Returns the entries.
+func (eft *EFT) fetchOverflow(tn *TrieNode, fetch_fn FetchFn) ([]TrieEntry, error) {
+	bs, err := eft.NewBlockSet()
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	ents := make([]TrieEntry, 0)
+
+	for oi := 0; oi < 16; oi++ {
+		if tn.ovr[oi] == ZERO_HASH {
+			continue
+		}
+
+		ot, err := tn.loadOverflow(oi)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		for _, ent := range(ot.tab) {
+			if ent.Type != TRIE_TYPE_ITEM {
+				continue
+			}
+
+			ents = append(ents, ent)
+
+			err = bs.Add(ent.Hash)
+			if err != nil {
+				return nil, trace(err)
+			}
+		}
+	}
+
+	if bs.Size() == 0 {
+		return ents, nil
+	}
+
+	err = eft.fetchBlocks(bs, fetch_fn)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return ents, nil
+}
+
 func (eft *EFT) fetchBlocks(bs *BlockSet, fetch_fn FetchFn) error {
 	ba, err := fetch_fn(bs)
 	if err != nil {
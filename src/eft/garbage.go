@@ -8,18 +8,59 @@ package eft
 //  - The EFT is traversed, and all used blocks are marked.
 //  - Unmarked blocks are deleted, and a list of unmarked blocks is
 //    saved to apply to the cloud server.
+//
+// This looks at every block, so normally the reference counts in
+// refcount.go are used instead. A full collection runs when they
+// can't be trusted, and rebuilds them.
 
 import (
 	"github.com/edsrzf/mmap-go"
 	"encoding/hex"
 	"sort"
 	"bytes"
-	"path/filepath"
 	"os"
 	"fmt"
 )
 
-func (eft *EFT) collect() (_ string, eret error) {
+func (eft *EFT) collect() (string, error) {
+	if eft.refsCurrent() {
+		dead_name, err := eft.collectIncremental()
+		if err == nil {
+			eft.compactStore()
+			return dead_name, nil
+		}
+
+		fmt.Println("XX - Incremental GC failed:", err)
+	}
+
+	dead_name, err := eft.collectAll()
+	if err != nil {
+		return "", trace(err)
+	}
+
+	err = eft.rebuildRefs()
+	if err != nil {
+		return "", trace(err)
+	}
+
+	eft.compactStore()
+	return dead_name, nil
+}
+
+// Failing to compact only wastes space, so it doesn't fail a collection.
+func (eft *EFT) compactStore() {
+	cs, ok := eft.store().(compactStore)
+	if !ok {
+		return
+	}
+
+	err := cs.Compact()
+	if err != nil {
+		fmt.Println("XX - Compacting block store failed:", err)
+	}
+}
+
+func (eft *EFT) collectAll() (_ string, eret error) {
 	mm, err := eft.newMarkList()
 	if err != nil {
 		return "", trace(err)
@@ -121,25 +162,11 @@ func (mm *MarkList) scan() error {
 		return trace(err)
 	}
 
-	walk_fn := func(pp string, sysi os.FileInfo, err error) error {
-		if err != nil {
-			return trace(err)
-		}
-
-		_, name := filepath.Split(pp)
-		if len(name) != 64 {
-			return nil
-		}
-
-		hash, err := hex.DecodeString(name)
-		if err != nil {
-			return trace(err)
-		}
-
+	err = mm.eft.store().Iterate(func(hash [32]byte) error {
 		item := make([]byte, 33)
-		copy(item[0:32], hash)
+		copy(item[0:32], hash[:])
 
-		_, err = mm.file.Write(item)
+		_, err := mm.file.Write(item)
 		if err != nil {
 			return trace(err)
 		}
@@ -147,11 +174,7 @@ func (mm *MarkList) scan() error {
 		mm.size = mm.size + 1
 
 		return nil
-	}
-
-	blocks_dir := filepath.Join(mm.eft.Dir, "blocks")
-
-	err = filepath.Walk(blocks_dir, walk_fn)
+	})
 	if err != nil {
 		return trace(err)
 	}
@@ -190,8 +213,73 @@ func (mm *MarkList) mark() error {
 		return trace(err)
 	}
 
-	for _, snap := range(mm.eft.Snaps) {
-		err := mm.markPathTrie(snap.Root)
+	// The saved list only differs from the transaction by the log block
+	// being replaced, which is kept until the next collection.
+	saved, err := mm.eft.loadSnapsFrom(hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	err = mm.markSnaps(saved)
+	if err != nil {
+		return trace(err)
+	}
+
+	err = mm.markSnaps(mm.eft.Snaps)
+	if err != nil {
+		return trace(err)
+	}
+
+	// Roots being read through views.
+	for _, pinned := range(mm.eft.pinnedRoots()) {
+		err = mm.markBlock(pinned)
+		if err != nil {
+			return trace(err)
+		}
+
+		snaps, err := mm.eft.loadSnapsFrom(pinned)
+		if err != nil {
+			return trace(err)
+		}
+
+		err = mm.markSnaps(snaps)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	// Keep the last synced root around as the base for merges.
+	synced, err := mm.eft.loadSyncedHash()
+	if err == ErrNotFound || synced == hash {
+		return nil
+	}
+	if err != nil {
+		return trace(err)
+	}
+
+	err = mm.markBlock(synced)
+	if err != nil {
+		return trace(err)
+	}
+
+	snaps, err := mm.eft.loadSnapsFrom(synced)
+	if err != nil {
+		return trace(err)
+	}
+
+	return mm.markSnaps(snaps)
+}
+
+func (mm *MarkList) markSnaps(snaps []Snapshot) error {
+	for _, snap := range(snaps) {
+		if !snap.isEmpty() {
+			err := mm.markPathTrie(snap.Root)
+			if err != nil {
+				return trace(err)
+			}
+		}
+
+		err := mm.eft.visitLogBlocks(snap.Log, mm.markBlock)
 		if err != nil {
 			return trace(err)
 		}
@@ -289,18 +377,19 @@ func (mm *MarkList) Close() error {
 	return os.Remove(mm.name)
 }
 
+// Gets the blocks a snapshot refers to.
 func (snap *Snapshot) liveBlocks() ([]string, error) {
-	trie, err := snap.eft.loadPathTrie(snap.Root)
+	inv := snap.eft.newInventory()
+
+	err := inv.walkSnap(snap, 0)
 	if err != nil {
 		return nil, trace(err)
 	}
 
-	err = trie.visitEachBlock(func (hash [32]byte) error {
-		return nil
-	})
-	if err != nil {
-		return nil, trace(err)
+	hashes := make([]string, 0, len(inv.blocks))
+	for _, bi := range(inv.blocks) {
+		hashes = append(hashes, bi.Hash)
 	}
 
-	return make([]string, 0), nil
+	return hashes, nil
 }
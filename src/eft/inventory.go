@@ -0,0 +1,249 @@
+package eft
+
+// A listing of every block in the store, saying what each one is for. It
+// follows the same references as the garbage collector, so anything it
+// can't reach from the snapshot list or the last synced root is garbage
+// that hasn't been collected yet.
+
+import (
+	"sort"
+)
+
+type BlockInfo struct {
+	Hash      string   `json:"hash"`
+	Role      string   `json:"role"`
+	Paths     []string `json:"paths,omitempty"` // Items the block belongs to
+	Reachable bool     `json:"reachable"`
+	Snapshots []int    `json:"snapshots"` // Indexes in the snapshot list
+}
+
+var blockRoles = map[int]string{
+	REF_DATA:  "data",
+	REF_SNAPS: "snapshot list",
+	REF_LOG:   "update log",
+	REF_PATH:  "path trie",
+	REF_DIR:   "directory index",
+	REF_ITEM:  "item header",
+	REF_LARGE: "large trie",
+}
+
+type inventory struct {
+	eft    *EFT
+	blocks map[[32]byte]*BlockInfo
+}
+
+func (eft *EFT) newInventory() *inventory {
+	return &inventory{
+		eft:    eft,
+		blocks: make(map[[32]byte]*BlockInfo),
+	}
+}
+
+func (eft *EFT) ListBlocks() ([]BlockInfo, error) {
+	eft.Lock()
+	defer eft.Unlock()
+
+	inv := eft.newInventory()
+
+	// Blocks only kept for the last synced root or an open view aren't in
+	// any of the current snapshots. The first root is zero if there's no
+	// saved snapshot list.
+	roots := make([][32]byte, 0)
+
+	for _, name := range([]string{"snaps", "synced"}) {
+		hash, err := eft.loadHashFile(name)
+		if err != nil && err != ErrNotFound {
+			return nil, trace(err)
+		}
+
+		roots = append(roots, hash)
+	}
+
+	for _, pinned := range(eft.pinnedRoots()) {
+		if pinned != roots[0] {
+			roots = append(roots, pinned)
+		}
+	}
+
+	for ii, hash := range(roots) {
+		if hash == ZERO_HASH {
+			continue
+		}
+
+		err := inv.walk(blockRef{REF_SNAPS, hash}, blockRoles[REF_SNAPS], "", -1)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		snaps, err := eft.loadSnapsFrom(hash)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		for jj := range(snaps) {
+			snap_idx := jj
+			if ii > 0 {
+				snap_idx = -1
+			}
+
+			err = inv.walkSnap(&snaps[jj], snap_idx)
+			if err != nil {
+				return nil, trace(err)
+			}
+		}
+	}
+
+	err := inv.scan()
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return inv.list(), nil
+}
+
+func (inv *inventory) walkSnap(snap *Snapshot, snap_idx int) error {
+	for _, ref := range(snapsRefs([]Snapshot{*snap})) {
+		err := inv.walk(ref, blockRoles[ref.kind], "", snap_idx)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return nil
+}
+
+// Records a block and the blocks below it. These are only visited again
+// if they're reached from another snapshot or item.
+func (inv *inventory) walk(ref blockRef, role string, item_path string, snap_idx int) error {
+	bi, seen := inv.blocks[ref.hash]
+	if !seen {
+		bi = &BlockInfo{
+			Hash:      HashToHex(ref.hash),
+			Role:      role,
+			Reachable: true,
+			Snapshots: []int{},
+		}
+		inv.blocks[ref.hash] = bi
+	}
+
+	fresh := !seen
+
+	if snap_idx >= 0 && !hasInt(bi.Snapshots, snap_idx) {
+		bi.Snapshots = append(bi.Snapshots, snap_idx)
+		fresh = true
+	}
+
+	// Items are only under their own path.
+	if ref.kind == REF_ITEM && !fresh {
+		return nil
+	}
+
+	spill := ZERO_HASH
+
+	if ref.kind == REF_ITEM {
+		info, err := inv.eft.loadItemInfo(ref.hash)
+		if err != nil {
+			return trace(err)
+		}
+		item_path = info.Path
+
+		spill, err = inv.eft.itemSpill(ref.hash)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	if item_path != "" && !hasString(bi.Paths, item_path) {
+		bi.Paths = append(bi.Paths, item_path)
+		fresh = true
+	}
+
+	if !fresh {
+		return nil
+	}
+
+	kids, err := inv.eft.refChildren(ref)
+	if err != nil {
+		return trace(err)
+	}
+
+	for _, kid := range(kids) {
+		kid_role := blockRoles[kid.kind]
+
+		if kid.kind == REF_DATA {
+			switch {
+			case ref.kind == REF_LOG:
+				kid_role = blockRoles[REF_LOG]
+			case kid.hash == spill:
+				kid_role = blockRoles[REF_ITEM]
+			}
+		}
+
+		err = inv.walk(kid, kid_role, item_path, snap_idx)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return nil
+}
+
+// Adds the stored blocks that weren't reached.
+func (inv *inventory) scan() error {
+	return inv.eft.store().Iterate(func(hash [32]byte) error {
+		if _, seen := inv.blocks[hash]; !seen {
+			inv.blocks[hash] = &BlockInfo{
+				Hash:      HashToHex(hash),
+				Role:      "unknown",
+				Reachable: false,
+				Snapshots: []int{},
+			}
+		}
+
+		return nil
+	})
+}
+
+func (inv *inventory) list() []BlockInfo {
+	list := make([]BlockInfo, 0, len(inv.blocks))
+
+	for _, bi := range(inv.blocks) {
+		sort.Ints(bi.Snapshots)
+		list = append(list, *bi)
+	}
+
+	sort.Sort(blocksByHash(list))
+	return list
+}
+
+type blocksByHash []BlockInfo
+
+func (bb blocksByHash) Len() int {
+	return len(bb)
+}
+
+func (bb blocksByHash) Less(ii, jj int) bool {
+	return bb[ii].Hash < bb[jj].Hash
+}
+
+func (bb blocksByHash) Swap(ii, jj int) {
+	bb[ii], bb[jj] = bb[jj], bb[ii]
+}
+
+func hasInt(xs []int, x int) bool {
+	for _, yy := range(xs) {
+		if yy == x {
+			return true
+		}
+	}
+	return false
+}
+
+func hasString(xs []string, x string) bool {
+	for _, yy := range(xs) {
+		if yy == x {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestListBlocks(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	small := path.Join(src_dir, "small")
+	large := path.Join(src_dir, "large")
+
+	err = ioutil.WriteFile(small, []byte("in both snapshots\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	err = ioutil.WriteFile(large, RandomBytes(3 * DATA_SIZE), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, small)
+
+	_, err = eft.TakeSnapshot("before large")
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, large)
+
+	// A block nothing refers to.
+	orphan := RandomBytes(32)
+	orphan_hash := [32]byte{}
+	copy(orphan_hash[:], orphan)
+
+	err = os.MkdirAll(path.Dir(eft.BlockPath(orphan_hash)), 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	err = ioutil.WriteFile(eft.BlockPath(orphan_hash), orphan, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	blocks, err := eft.ListBlocks()
+	if err != nil {
+		panic(err)
+	}
+
+	roles := make(map[string]int)
+
+	reachable := 0
+
+	for _, bi := range(blocks) {
+		if bi.Hash == HashToHex(orphan_hash) {
+			if bi.Reachable || bi.Role != "unknown" {
+				fmt.Println("Orphan block listed as reachable")
+				tt.Fail()
+			}
+		}
+
+		// Old versions stay around until garbage is collected.
+		if !bi.Reachable {
+			continue
+		}
+
+		reachable += 1
+		roles[bi.Role] += 1
+
+		if bi.Role == "data" && (len(bi.Paths) != 1 || bi.Paths[0] != large) {
+			fmt.Println("Data block with wrong paths:", bi.Paths)
+			tt.Fail()
+		}
+
+		if bi.Role == "item header" && len(bi.Paths) == 1 && bi.Paths[0] == small {
+			if len(bi.Snapshots) != 2 {
+				fmt.Println("Shared item in snapshots", bi.Snapshots)
+				tt.Fail()
+			}
+		}
+	}
+
+	if roles["data"] != 3 || roles["snapshot list"] != 1 || roles["item header"] != 2 {
+		fmt.Println("Wrong block roles:", roles)
+		tt.Fail()
+	}
+
+	eft.Lock()
+	live, err := eft.mainSnap().liveBlocks()
+	eft.Unlock()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(live) == 0 || len(live) >= reachable {
+		fmt.Println("Wrong number of live blocks:", len(live))
+		tt.Fail()
+	}
+}
@@ -9,7 +9,7 @@ import (
 var SMALL_MAX = uint64(12 * 1024 - BLOCK_OVERHEAD)
 
 func (eft *EFT) putItem(snap *Snapshot, info ItemInfo, src_path string) error {
-	data_hash, err := eft.saveItem(info, src_path)
+	data_hash, err := eft.saveItemData(snap, info, src_path)
 	if err != nil {
 		return trace(err)
 	}
@@ -23,6 +23,20 @@ func (eft *EFT) putItem(snap *Snapshot, info ItemInfo, src_path string) error {
 	return nil
 }
 
+// Saves an item's blocks. The trie isn't changed until putTree.
+func (eft *EFT) saveItemData(snap *Snapshot, info ItemInfo, src_path string) ([32]byte, error) {
+	large_file := info.Type == INFO_FILE && info.Size > SMALL_MAX
+
+	// Chunked items are compressed chunk by chunk.
+	if eft.Chunking && large_file {
+		return eft.saveChunkedItem(snap, info, src_path)
+	} else if eft.Compress && large_file {
+		return eft.savePackedItem(info, src_path)
+	} else {
+		return eft.saveItem(info, src_path)
+	}
+}
+
 func (eft *EFT) getItem(snap *Snapshot, name string, dst_path string) (ItemInfo, error) {
 	info0, data_hash, err := eft.getTree(snap, name)
 	if err != nil {
@@ -59,11 +73,24 @@ func (eft *EFT) loadItemInfo(hash [32]byte) (ItemInfo, error) {
 		return info, err
 	}
 
-	info = ItemInfoFromBytes(data[0:2048])
+	info, err = eft.infoFromBytes(data[0:2048])
+	if err != nil {
+		return info, trace(err)
+	}
 
 	return info, nil
 }
 
+// Gets the block holding the info fields for an item, if it has one.
+func (eft *EFT) itemSpill(hash [32]byte) ([32]byte, error) {
+	data, err := eft.loadBlock(hash)
+	if err != nil {
+		return ZERO_HASH, trace(err)
+	}
+
+	return infoSpill(data[0:2048]), nil
+}
+
 func (eft *EFT) loadItem(hash [32]byte, dst_path string) (ItemInfo, error) {
 	info, err := eft.loadItemInfo(hash)
 	if err != nil {
@@ -111,6 +138,18 @@ func (eft *EFT) saveItem(info ItemInfo, src_path string) ([32]byte, error) {
 }
 
 func (eft *EFT) visitItemBlocks(hash [32]byte, fn func(hash [32]byte) error) error {
+	spill, err := eft.itemSpill(hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	if spill != ZERO_HASH {
+		err = fn(spill)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
 	info, err := eft.loadItemInfo(hash)
 	if err != nil {
 		return trace(err)
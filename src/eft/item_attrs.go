@@ -0,0 +1,222 @@
+package eft
+
+// Ownership, permissions and extended attributes for items. These are read
+// from the file system when an item is added and can be put back with
+// ItemInfo.Apply when it's extracted.
+
+import (
+	"encoding/binary"
+	"os/user"
+	"syscall"
+	"strconv"
+	"sort"
+	"fmt"
+	"os"
+)
+
+const INFO_MODE_BITS = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+func (info *ItemInfo) readOwner(sysi os.FileInfo) error {
+	stat, ok := sysi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	uid := strconv.Itoa(int(stat.Uid))
+	gid := strconv.Itoa(int(stat.Gid))
+
+	info.User  = uid
+	info.Group = gid
+
+	uu, err := user.LookupId(uid)
+	if err == nil {
+		info.User = uu.Username
+	}
+
+	gg, err := user.LookupGroupId(gid)
+	if err == nil {
+		info.Group = gg.Name
+	}
+
+	return nil
+}
+
+func (info *ItemInfo) readXattrs(src_path string) error {
+	size, err := syscall.Listxattr(src_path, nil)
+	if err != nil || size == 0 {
+		// Not supported here, or none set.
+		return nil
+	}
+
+	list := make([]byte, size)
+	size, err = syscall.Listxattr(src_path, list)
+	if err != nil {
+		return trace(err)
+	}
+
+	attrs := make(map[string][]byte)
+
+	for _, name := range(splitNames(list[:size])) {
+		vsize, err := syscall.Getxattr(src_path, name, nil)
+		if err != nil {
+			continue
+		}
+
+		value := make([]byte, vsize)
+		vsize, err = syscall.Getxattr(src_path, name, value)
+		if err != nil {
+			continue
+		}
+
+		attrs[name] = value[:vsize]
+	}
+
+	info.SetXattrs(attrs)
+	return nil
+}
+
+func splitNames(list []byte) []string {
+	names := make([]string, 0)
+
+	start := 0
+	for ii, bb := range(list) {
+		if bb == 0 {
+			if ii > start {
+				names = append(names, string(list[start:ii]))
+			}
+			start = ii + 1
+		}
+	}
+
+	return names
+}
+
+// Extended attributes are kept sorted by name, each as a 4 byte name
+// length, the name, a 4 byte value length and the value. This keeps
+// ItemInfo comparable with ==.
+func (info *ItemInfo) SetXattrs(attrs map[string][]byte) {
+	be := binary.BigEndian
+
+	names := make([]string, 0, len(attrs))
+	for name := range(attrs) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	data := make([]byte, 0)
+
+	for _, name := range(names) {
+		var size [4]byte
+
+		be.PutUint32(size[:], uint32(len(name)))
+		data = append(data, size[:]...)
+		data = append(data, []byte(name)...)
+
+		be.PutUint32(size[:], uint32(len(attrs[name])))
+		data = append(data, size[:]...)
+		data = append(data, attrs[name]...)
+	}
+
+	info.Xatt = string(data)
+}
+
+func (info *ItemInfo) Xattrs() (map[string][]byte, error) {
+	be := binary.BigEndian
+
+	attrs := make(map[string][]byte)
+	data := []byte(info.Xatt)
+
+	next := func() ([]byte, error) {
+		if len(data) < 4 {
+			return nil, fmt.Errorf("Bad xattrs in ItemInfo")
+		}
+
+		size := be.Uint32(data[0:4])
+		if uint64(size) > uint64(len(data) - 4) {
+			return nil, fmt.Errorf("Bad xattrs in ItemInfo")
+		}
+
+		field := data[4:4 + size]
+		data = data[4 + size:]
+		return field, nil
+	}
+
+	for len(data) > 0 {
+		name, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		attrs[string(name)] = value
+	}
+
+	return attrs, nil
+}
+
+// Sets the permissions and extended attributes of an extracted item, and
+// its owner when running as root.
+func (info *ItemInfo) Apply(dst_path string) error {
+	if info.Type == INFO_LINK || info.Type == INFO_TOMB {
+		return nil
+	}
+
+	if info.Mode != 0 {
+		err := os.Chmod(dst_path, info.FileMode())
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	attrs, err := info.Xattrs()
+	if err != nil {
+		return trace(err)
+	}
+
+	for name, value := range(attrs) {
+		err := syscall.Setxattr(dst_path, name, value, 0)
+		if err != nil {
+			fmt.Println("XX - Setxattr", name, err)
+		}
+	}
+
+	if os.Geteuid() == 0 && info.User != "" {
+		return info.applyOwner(dst_path)
+	}
+
+	return nil
+}
+
+func (info *ItemInfo) applyOwner(dst_path string) error {
+	// Names that aren't known here may be numeric ids.
+	uid, err := strconv.Atoi(info.User)
+	if err != nil {
+		uid = -1
+	}
+
+	gid, err := strconv.Atoi(info.Group)
+	if err != nil {
+		gid = -1
+	}
+
+	uu, err := user.Lookup(info.User)
+	if err == nil {
+		uid, _ = strconv.Atoi(uu.Uid)
+	}
+
+	gg, err := user.LookupGroup(info.Group)
+	if err == nil {
+		gid, _ = strconv.Atoi(gg.Gid)
+	}
+
+	err = os.Lchown(dst_path, uid, gid)
+	if err != nil {
+		return trace(err)
+	}
+
+	return nil
+}
@@ -11,6 +11,7 @@ import (
 )
 
 const INFO_SIZE = 2048
+const INFO_VERSION = 2
 
 const (
 	INFO_FILE = 4
@@ -20,13 +21,18 @@ const (
 )
 
 type ItemInfo struct {
-	Type uint32
-	Size uint64
-	ModT uint64
-	Mode uint32 // executable?
-	Hash [32]byte
-	Path string
-	MoBy string // last modified by (user@host)
+	Type  uint32
+	Size  uint64
+	ModT  uint64
+	Mode  uint32 // os.FileMode permission bits
+	Hash  [32]byte
+	Path  string
+	MoBy  string // last modified by (user@host)
+	User  string // owner name
+	Group string // group name
+	Xatt  string // extended attributes, see Xattrs()
+
+	spill [32]byte // block holding the fields above, until it's loaded
 }
 
 func (info *ItemInfo) TypeName() string {
@@ -63,7 +69,11 @@ func (info *ItemInfo) HashText() string {
 }
 
 func (info *ItemInfo) IsExec() bool {
-	return info.Mode & 1 > 0
+	return info.Mode & 0100 > 0
+}
+
+func (info *ItemInfo) FileMode() os.FileMode {
+	return os.FileMode(info.Mode) & INFO_MODE_BITS
 }
 
 func (info *ItemInfo) IsTomb() bool {
@@ -92,9 +102,21 @@ func NewItemInfo(name string, src_path string, sysi os.FileInfo) (ItemInfo, erro
 		info.Size = uint64(len(link))
 	}
 
+	if info.Type != INFO_LINK {
+		info.Mode = uint32(sysi.Mode() & INFO_MODE_BITS)
+
+		err := info.readOwner(sysi)
+		if err != nil {
+			return info, trace(err)
+		}
+
+		err = info.readXattrs(src_path)
+		if err != nil {
+			return info, trace(err)
+		}
+	}
+
 	if info.Type == INFO_FILE {
-		info.Mode = uint32(sysi.Mode().Perm() & 1)
-	
 		data_hash, err := HashFile(src_path)
 		if err != nil {
 			return info, trace(err)
@@ -147,36 +169,107 @@ func FastItemInfo(src_path string) (ItemInfo, error) {
 	return NewItemInfo(src_path, src_path, sysi)
 }
 
-func ItemInfoFromBytes(data []byte) ItemInfo {
+// Headers come from blocks that may have been damaged or tampered with,
+// so anything that doesn't parse is an error rather than a panic.
+func ItemInfoFromBytes(data []byte) (ItemInfo, error) {
+	info := ItemInfo{}
+
 	if len(data) != INFO_SIZE {
-		panic("ItemInfo block wrong length.")
+		return info, fmt.Errorf("ItemInfo block wrong length: %d", len(data))
 	}
 
 	be := binary.BigEndian
 
-	info := ItemInfo{}
 	info.Type = be.Uint32(data[0 : 4])
 	info.Size = be.Uint64(data[4 :12])
 	info.ModT = be.Uint64(data[12:20])
 	info.Mode = be.Uint32(data[20:24])
 	copy(info.Hash[:], data[32:64])
 
+	if be.Uint32(data[24:28]) == 0 {
+		return itemInfoV1(info, data)
+	}
+
+	copy(info.spill[:], data[64:96])
+	if info.spill != ZERO_HASH {
+		// Fields are filled in by EFT.infoFromBytes
+		return info, nil
+	}
+
+	err := info.setFields(data[96:INFO_SIZE])
+	if err != nil {
+		return info, trace(err)
+	}
+
+	return info, nil
+}
+
+func itemInfoV1(info ItemInfo, data []byte) (ItemInfo, error) {
+	be := binary.BigEndian
+
+	// Version 1 only kept the user execute bit.
+	switch {
+	case info.Type == INFO_DIR || info.Mode & 1 > 0:
+		info.Mode = 0755
+	default:
+		info.Mode = 0644
+	}
+
 	moby_len := be.Uint32(data[512:520])
 	if (moby_len > 508) {
-		panic("Modified By string too long")
+		return info, fmt.Errorf("Modified By string too long")
 	}
 	info.MoBy = string(data[520:520 + moby_len])
 
 	path_len := be.Uint32(data[1024:1028])
 	if (path_len > 980) {
-		panic("Path length too long")
+		return info, fmt.Errorf("Path length too long")
 	}
 	info.Path = string(data[1028:1028 + path_len])
 	
-	return info
+	return info, nil
 }
 
-func (info *ItemInfo) Bytes() []byte {
+// Encodes the variable length fields, each as a 4 byte length and data.
+func (info *ItemInfo) fieldBytes() []byte {
+	be := binary.BigEndian
+
+	data := make([]byte, 0)
+
+	for _, field := range([]string{info.Path, info.MoBy, info.User, info.Group, info.Xatt}) {
+		var size [4]byte
+		be.PutUint32(size[:], uint32(len(field)))
+
+		data = append(data, size[:]...)
+		data = append(data, []byte(field)...)
+	}
+
+	return data
+}
+
+func (info *ItemInfo) setFields(data []byte) error {
+	be := binary.BigEndian
+
+	fields := []*string{&info.Path, &info.MoBy, &info.User, &info.Group, &info.Xatt}
+
+	for _, field := range(fields) {
+		if len(data) < 4 {
+			return fmt.Errorf("ItemInfo fields truncated")
+		}
+
+		size := be.Uint32(data[0:4])
+		if uint64(size) > uint64(len(data) - 4) {
+			return fmt.Errorf("ItemInfo field too long")
+		}
+
+		*field = string(data[4:4 + size])
+		data = data[4 + size:]
+	}
+
+	return nil
+}
+
+func (info *ItemInfo) header(spill [32]byte) []byte {
 	be := binary.BigEndian
 
 	data := make([]byte, INFO_SIZE)
@@ -184,22 +277,81 @@ func (info *ItemInfo) Bytes() []byte {
 	be.PutUint64(data[4 :12], info.Size)
 	be.PutUint64(data[12:20], info.ModT)
 	be.PutUint32(data[20:24], info.Mode)
+	be.PutUint32(data[24:28], INFO_VERSION)
 	copy(data[32:64], info.Hash[:])
+	copy(data[64:96], spill[:])
 
-	moby_len := len(info.MoBy)
-	if (moby_len > 508) {
-		panic("Modified By string too long")
-	}
-	be.PutUint32(data[512:520], uint32(moby_len))
-	copy(data[520:1024], []byte(info.MoBy))
+	return data
+}
 
-	path_len := len(info.Path)
-	if (path_len > 980) {
-		panic("Path length too long")
+// Gets the header for an item. Panics if the fields don't fit in it; the
+// EFT spills them into another block instead.
+func (info *ItemInfo) Bytes() []byte {
+	fields := info.fieldBytes()
+	if len(fields) > INFO_SIZE - 96 {
+		panic("ItemInfo fields too long")
 	}
-	be.PutUint32(data[1024:1028], uint32(path_len))
-	copy(data[1028:2008], []byte(info.Path))
+
+	data := info.header(ZERO_HASH)
+	copy(data[96:], fields)
 
 	return data
 }
 
+// Gets the header for an item, saving a spill block for the fields if they
+// don't fit.
+func (eft *EFT) infoBytes(info ItemInfo) ([]byte, error) {
+	fields := info.fieldBytes()
+	if len(fields) <= INFO_SIZE - 96 {
+		return info.Bytes(), nil
+	}
+
+	if len(fields) > DATA_SIZE {
+		return nil, fmt.Errorf("ItemInfo too large for %s", info.Path)
+	}
+
+	block := make([]byte, DATA_SIZE)
+	copy(block, fields)
+
+	spill, err := eft.saveBlock(block)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return info.header(spill), nil
+}
+
+func (eft *EFT) infoFromBytes(data []byte) (ItemInfo, error) {
+	info, err := ItemInfoFromBytes(data)
+	if err != nil {
+		return info, err
+	}
+
+	if info.spill == ZERO_HASH {
+		return info, nil
+	}
+
+	block, err := eft.loadBlock(info.spill)
+	if err != nil {
+		return info, trace(err)
+	}
+
+	err = info.setFields(block)
+	if err != nil {
+		return info, trace(err)
+	}
+
+	info.spill = ZERO_HASH
+	return info, nil
+}
+
+// Gets the spill block for an item header, or ZERO_HASH if it has none.
+func infoSpill(data []byte) [32]byte {
+	spill := [32]byte{}
+
+	if binary.BigEndian.Uint32(data[24:28]) != 0 {
+		copy(spill[:], data[64:96])
+	}
+
+	return spill
+}
@@ -0,0 +1,168 @@
+package eft
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"bytes"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestItemInfoV2(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	name := path.Join(src_dir, "script")
+
+	err = ioutil.WriteFile(name, []byte("#!/bin/sh\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	err = os.Chmod(name, 0750)
+	if err != nil {
+		panic(err)
+	}
+
+	info0, err := FastItemInfo(name)
+	if err != nil {
+		panic(err)
+	}
+
+	if info0.FileMode() != 0750 || !info0.IsExec() || info0.User == "" {
+		fmt.Println("Mode or owner not read:", info0.FileMode(), info0.User)
+		tt.Fail()
+	}
+
+	// A path too long for the header, with attributes.
+	info0.Path = "/" + strings.Repeat("node_modules/", 300) + "script"
+	info0.SetXattrs(map[string][]byte{"user.origin": []byte("test")})
+
+	err = eft.Put(info0, name)
+	if err != nil {
+		panic(err)
+	}
+
+	// Collect garbage, which should keep the spilled fields.
+	cp, err := eft.MakeCheckpoint()
+	if err != nil {
+		panic(err)
+	}
+	cp.Commit()
+
+	temp := eft.TempName()
+	defer os.Remove(temp)
+
+	info1, err := eft.Get(info0.Path, temp)
+	if err != nil {
+		panic(err)
+	}
+
+	if info0 != info1 {
+		fmt.Println("Long item info didn't round trip")
+		tt.Fail()
+	}
+
+	attrs, err := info1.Xattrs()
+	if err != nil {
+		panic(err)
+	}
+
+	if !bytes.Equal(attrs["user.origin"], []byte("test")) {
+		fmt.Println("Xattrs didn't round trip")
+		tt.Fail()
+	}
+
+	err = info1.Apply(temp)
+	if err != nil {
+		panic(err)
+	}
+
+	sysi, err := os.Stat(temp)
+	if err != nil {
+		panic(err)
+	}
+
+	if sysi.Mode().Perm() != 0750 {
+		fmt.Println("Mode not applied:", sysi.Mode())
+		tt.Fail()
+	}
+}
+
+func TestItemInfoV1(tt *testing.T) {
+	be := binary.BigEndian
+
+	data := make([]byte, INFO_SIZE)
+	be.PutUint32(data[0:4], INFO_FILE)
+	be.PutUint64(data[4:12], 100)
+	be.PutUint32(data[20:24], 1)
+	be.PutUint32(data[512:520], 4)
+	copy(data[520:], "user")
+	be.PutUint32(data[1024:1028], 4)
+	copy(data[1028:], "/foo")
+
+	info, err := ItemInfoFromBytes(data)
+	if err != nil {
+		panic(err)
+	}
+
+	if info.Path != "/foo" || info.MoBy != "user" || info.Size != 100 {
+		fmt.Println("Version 1 info misread:", info.String())
+		tt.Fail()
+	}
+
+	if !info.IsExec() || info.FileMode() != 0755 {
+		fmt.Println("Version 1 exec bit lost")
+		tt.Fail()
+	}
+
+	info1, err := ItemInfoFromBytes(info.Bytes())
+	if err != nil || info1 != info {
+		fmt.Println("Converted info didn't round trip")
+		tt.Fail()
+	}
+}
+
+func TestItemInfoMalformed(tt *testing.T) {
+	be := binary.BigEndian
+
+	info := ItemInfo{Type: INFO_FILE, Path: "/foo", MoBy: "user"}
+	good := info.Bytes()
+
+	bad := make(map[string][]byte)
+
+	bad["short"] = good[0:100]
+
+	long_field := append([]byte{}, good...)
+	be.PutUint32(long_field[96:100], INFO_SIZE)
+	bad["field too long"] = long_field
+
+	truncated := append([]byte{}, good...)
+	be.PutUint32(truncated[96:100], INFO_SIZE - 100)
+	bad["fields truncated"] = truncated
+
+	v1 := make([]byte, INFO_SIZE)
+	be.PutUint32(v1[1024:1028], 5000)
+	bad["v1 path too long"] = v1
+
+	for name, data := range(bad) {
+		_, err := ItemInfoFromBytes(data)
+		if err == nil {
+			fmt.Println("Malformed header read without error:", name)
+			tt.Fail()
+		}
+	}
+}
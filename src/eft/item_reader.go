@@ -0,0 +1,236 @@
+package eft
+
+// An ItemReader reads the content of an item without extracting it to a
+// file first. Blocks of large items are looked up in the block list trie
+// and loaded as they are needed.
+//
+// A reader keeps the root it was opened from pinned, like a RootView, so
+// it can be used while other operations go on. Readers must be closed to
+// let the root's blocks be collected.
+//
+// ReadAt can be called from several goroutines at once, as io.ReaderAt
+// requires. Read and Seek share a position, so they can't.
+
+import (
+	"errors"
+	"sync"
+	"sort"
+	"io"
+)
+
+var ErrNotFile = errors.New("EFT: item has no content")
+
+type ItemReader struct {
+	eft  *EFT
+	info ItemInfo
+	trie *LargeTrie // nil for small items
+	ends []uint64   // Chunk end offsets, nil unless chunked
+	pos  int64
+
+	root   [32]byte // Pinned snapshot list
+	pinned bool
+
+	// Last block read
+	data  []byte
+	bnum  uint64
+	mutex sync.Mutex // Guards trie, data and bnum
+}
+
+func (eft *EFT) Open(name string) (*ItemReader, error) {
+	rv, err := eft.View()
+	if err != nil {
+		return nil, trace(err)
+	}
+	defer rv.Close()
+
+	return rv.Open(name)
+}
+
+func (eft *EFT) openItem(info ItemInfo, hash [32]byte) (*ItemReader, error) {
+	if info.Type != INFO_FILE && info.Type != INFO_LINK {
+		return nil, ErrNotFile
+	}
+
+	ir := &ItemReader{
+		eft:  eft,
+		info: info,
+	}
+
+	if info.Size <= SMALL_MAX {
+		block, err := eft.loadBlock(hash)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		ir.data = block[4096:4096 + info.Size]
+		return ir, nil
+	}
+
+	trie, err := eft.loadLargeTrie(hash)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	chunked, err := trie.chunked()
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	if chunked {
+		ir.ends, err = trie.chunkEnds()
+		if err != nil {
+			return nil, trace(err)
+		}
+	}
+
+	ir.trie = &trie
+	ir.data = nil
+
+	return ir, nil
+}
+
+func (ir *ItemReader) Info() ItemInfo {
+	return ir.info
+}
+
+func (ir *ItemReader) Size() int64 {
+	return int64(ir.info.Size)
+}
+
+func (ir *ItemReader) loadData(bnum uint64) ([]byte, error) {
+	ir.mutex.Lock()
+	trie, data, last := ir.trie, ir.data, ir.bnum
+	ir.mutex.Unlock()
+
+	if trie == nil {
+		if data == nil {
+			return nil, errors.New("EFT: reader closed")
+		}
+		return data, nil
+	}
+
+	if data != nil && last == bnum {
+		return data, nil
+	}
+
+	ent, err := trie.findEntry(bnum)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	block, err := ir.eft.loadBlock(ent.Hash)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	data = block[:chunkLen(ent)]
+
+	ir.mutex.Lock()
+	if ir.trie != nil {
+		ir.data = data
+		ir.bnum = bnum
+	}
+	ir.mutex.Unlock()
+
+	return data, nil
+}
+
+func (ir *ItemReader) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("EFT: negative offset")
+	}
+
+	nn := 0
+
+	for nn < len(buf) {
+		pos := off + int64(nn)
+		if pos >= ir.Size() {
+			return nn, io.EOF
+		}
+
+		bnum := uint64(0)
+		boff := pos
+
+		if ir.ends != nil {
+			bnum, boff = ir.findChunk(pos)
+		} else if ir.info.Size > SMALL_MAX {
+			bnum = uint64(pos / int64(DATA_SIZE))
+			boff = pos % int64(DATA_SIZE)
+		}
+
+		data, err := ir.loadData(bnum)
+		if err != nil {
+			return nn, err
+		}
+
+		// The last block is padded past the end of the item.
+		size := int64(len(data))
+		if rest := ir.Size() - pos + boff; rest < size {
+			size = rest
+		}
+
+		nn += copy(buf[nn:], data[boff:size])
+	}
+
+	return nn, nil
+}
+
+// Finds the chunk holding pos, and the offset of pos in it.
+func (ir *ItemReader) findChunk(pos int64) (uint64, int64) {
+	ii := sort.Search(len(ir.ends), func(ii int) bool {
+		return ir.ends[ii] > uint64(pos)
+	})
+
+	start := uint64(0)
+	if ii > 0 {
+		start = ir.ends[ii - 1]
+	}
+
+	return uint64(ii), pos - int64(start)
+}
+
+func (ir *ItemReader) Read(buf []byte) (int, error) {
+	nn, err := ir.ReadAt(buf, ir.pos)
+	ir.pos += int64(nn)
+
+	if err == io.EOF && nn > 0 {
+		err = nil
+	}
+
+	return nn, err
+}
+
+func (ir *ItemReader) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+
+	switch whence {
+	case 0:
+	case 1:
+		pos += ir.pos
+	case 2:
+		pos += ir.Size()
+	default:
+		return ir.pos, errors.New("EFT: bad whence")
+	}
+
+	if pos < 0 {
+		return ir.pos, errors.New("EFT: negative position")
+	}
+
+	ir.pos = pos
+	return pos, nil
+}
+
+func (ir *ItemReader) Close() error {
+	ir.mutex.Lock()
+	defer ir.mutex.Unlock()
+
+	ir.data = nil
+	ir.trie = nil
+
+	if ir.pinned {
+		ir.eft.unpin(ir.root)
+		ir.pinned = false
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package eft
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"bytes"
+	"path"
+	"fmt"
+	"io"
+	"os"
+)
+
+func TestItemReader(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, size := range([]int{0, 100, 5 * DATA_SIZE + 123}) {
+		name := path.Join(src_dir, fmt.Sprintf("file-%d", size))
+		data := RandomBytes(size)
+
+		err := ioutil.WriteFile(name, data, 0600)
+		if err != nil {
+			panic(err)
+		}
+
+		putTestFile(eft, name)
+
+		ir, err := eft.Open(name)
+		if err != nil {
+			panic(err)
+		}
+
+		data1, err := ioutil.ReadAll(ir)
+		if err != nil {
+			panic(err)
+		}
+
+		if !bytes.Equal(data, data1) {
+			fmt.Println("Read wrong data for size", size)
+			tt.Fail()
+		}
+
+		for ii := 0; ii < 20 && size > 0; ii++ {
+			off := rand.Intn(size)
+			buf := make([]byte, rand.Intn(2 * DATA_SIZE))
+
+			nn, err := ir.ReadAt(buf, int64(off))
+			if err != nil && err != io.EOF {
+				panic(err)
+			}
+
+			if !bytes.Equal(buf[:nn], data[off:off + nn]) {
+				fmt.Println("ReadAt got wrong data at", off)
+				tt.Fail()
+			}
+
+			if nn < len(buf) && off + nn != size {
+				fmt.Println("Short ReadAt at", off)
+				tt.Fail()
+			}
+		}
+
+		pos, err := ir.Seek(-10, 2)
+		if size > 10 && (err != nil || pos != int64(size - 10)) {
+			fmt.Println("Seek from end failed")
+			tt.Fail()
+		}
+
+		ir.Close()
+	}
+}
+
+// Run with -race: ReadAt is called from several goroutines at once.
+func TestItemReaderParallel(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	name := path.Join(src_dir, "large")
+	data := RandomBytes(8 * DATA_SIZE + 17)
+
+	err = ioutil.WriteFile(name, data, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, name)
+
+	ir, err := eft.Open(name)
+	if err != nil {
+		panic(err)
+	}
+	defer ir.Close()
+
+	done := make(chan bool)
+
+	for ii := 0; ii < 8; ii++ {
+		go func(seed int64) {
+			rr := rand.New(rand.NewSource(seed))
+			ok := true
+
+			for jj := 0; jj < 50; jj++ {
+				off := rr.Intn(len(data))
+				buf := make([]byte, rr.Intn(DATA_SIZE))
+
+				nn, err := ir.ReadAt(buf, int64(off))
+				if err != nil && err != io.EOF {
+					panic(err)
+				}
+
+				if !bytes.Equal(buf[:nn], data[off:off + nn]) {
+					ok = false
+				}
+			}
+
+			done <- ok
+		}(int64(ii))
+	}
+
+	for ii := 0; ii < 8; ii++ {
+		if !<-done {
+			fmt.Println("Wrong data from parallel ReadAt")
+			tt.Fail()
+		}
+	}
+}
+
+func TestItemReaderCloseWhileReading(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	name := path.Join(src_dir, "large")
+	data := RandomBytes(4 * DATA_SIZE)
+
+	err = ioutil.WriteFile(name, data, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, name)
+
+	ir, err := eft.Open(name)
+	if err != nil {
+		panic(err)
+	}
+
+	done := make(chan bool)
+
+	for ii := 0; ii < 4; ii++ {
+		go func(seed int64) {
+			rr := rand.New(rand.NewSource(seed))
+			ok := true
+
+			for jj := 0; jj < 50; jj++ {
+				off := rr.Intn(len(data))
+				buf := make([]byte, rr.Intn(DATA_SIZE))
+
+				// Reads after the close fail, but never return the
+				// wrong data.
+				nn, err := ir.ReadAt(buf, int64(off))
+				if err == nil && !bytes.Equal(buf[:nn], data[off:off + nn]) {
+					ok = false
+				}
+			}
+
+			done <- ok
+		}(int64(ii))
+	}
+
+	ir.Close()
+
+	for ii := 0; ii < 4; ii++ {
+		if !<-done {
+			fmt.Println("Wrong data from ReadAt racing Close")
+			tt.Fail()
+		}
+	}
+
+	_, err = ir.ReadAt(make([]byte, 10), 0)
+	if err == nil {
+		fmt.Println("ReadAt worked after Close")
+		tt.Fail()
+	}
+}
@@ -0,0 +1,394 @@
+package eft
+
+// An ItemWriter changes the content of a large item in place. It starts
+// from the block list of the current version of the item, so a block is
+// only saved again when its content actually changed. Editing a few bytes
+// of a large file then costs one new block and a few trie nodes, rather
+// than a full copy of the item.
+//
+// Like a Checkpoint, a writer holds the EFT lock from OpenWriter until
+// Commit or Abort.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var ErrChunked = errors.New("EFT: can't write in place to variable length blocks")
+
+type ItemWriter struct {
+	eft  *EFT
+	snap *Snapshot
+	trie LargeTrie
+	size uint64
+
+	// Block being written
+	data []byte
+	orig []byte // nil if the block is new
+	bnum uint64
+	dirty bool
+
+	zero  [32]byte // Shared block for holes
+	saved int      // Number of blocks saved
+}
+
+func (eft *EFT) OpenWriter(name string) (*ItemWriter, error) {
+	eft.Lock()
+
+	eft.begin()
+
+	iw := &ItemWriter{
+		eft:  eft,
+		snap: eft.mainSnap(),
+		zero: ZERO_HASH,
+	}
+
+	info, hash, err := eft.getTree(iw.snap, name)
+	if err == nil && info.Type == INFO_FILE && info.Size > SMALL_MAX {
+		iw.trie, err = eft.loadLargeTrie(hash)
+		if err != nil {
+			eft.abort()
+			eft.Unlock()
+			return nil, trace(err)
+		}
+
+		chunked, err := iw.trie.chunked()
+		if err != nil {
+			eft.abort()
+			eft.Unlock()
+			return nil, trace(err)
+		}
+
+		if chunked {
+			eft.abort()
+			eft.Unlock()
+			return nil, ErrChunked // No trace
+		}
+
+		iw.size = info.Size
+	} else {
+		if err != nil && err != ErrNotFound {
+			eft.abort()
+			eft.Unlock()
+			return nil, trace(err)
+		}
+
+		// Small items get rewritten in full.
+		iw.trie = eft.newLargeTrie(ItemInfo{})
+	}
+
+	return iw, nil
+}
+
+func (iw *ItemWriter) Size() int64 {
+	return int64(iw.size)
+}
+
+// Gets the block bnum for writing, saving the previous block if needed.
+func (iw *ItemWriter) block(bnum uint64) ([]byte, error) {
+	if iw.data != nil && iw.bnum == bnum {
+		return iw.data, nil
+	}
+
+	err := iw.flush()
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	iw.data = make([]byte, DATA_SIZE)
+	iw.orig = nil
+	iw.bnum = bnum
+	iw.dirty = false
+
+	b_hash, err := iw.trie.find(bnum)
+	if err == ErrNotFound {
+		return iw.data, nil
+	}
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	orig, err := iw.eft.loadBlock(b_hash)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	iw.orig = orig
+	copy(iw.data, orig)
+
+	return iw.data, nil
+}
+
+func (iw *ItemWriter) flush() error {
+	if iw.data == nil || !iw.dirty {
+		return nil
+	}
+
+	iw.dirty = false
+
+	if iw.orig != nil && bytes.Equal(iw.data, iw.orig) {
+		return nil
+	}
+
+	b_hash, err := iw.eft.saveBlock(iw.data)
+	if err != nil {
+		return trace(err)
+	}
+	iw.saved++
+
+	err = iw.trie.insert(iw.bnum, b_hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	iw.orig = make([]byte, len(iw.data))
+	copy(iw.orig, iw.data)
+
+	return nil
+}
+
+func blockCount(size uint64) uint64 {
+	return (size + uint64(DATA_SIZE) - 1) / uint64(DATA_SIZE)
+}
+
+// Grows the item to size bytes. The new space reads as zeros.
+func (iw *ItemWriter) extend(size uint64) error {
+	if size <= iw.size {
+		return nil
+	}
+
+	// The last block is padded with whatever was in the buffer when it
+	// was saved, so clear the part past the old end.
+	tail := iw.size % uint64(DATA_SIZE)
+	if tail != 0 {
+		data, err := iw.block(iw.size / uint64(DATA_SIZE))
+		if err != nil {
+			return trace(err)
+		}
+
+		for ii := tail; ii < uint64(DATA_SIZE); ii++ {
+			data[ii] = 0
+		}
+		iw.dirty = true
+	}
+
+	for ii := blockCount(iw.size); ii < blockCount(size); ii++ {
+		if iw.zero == ZERO_HASH {
+			b_hash, err := iw.eft.saveBlock(make([]byte, DATA_SIZE))
+			if err != nil {
+				return trace(err)
+			}
+			iw.saved++
+
+			iw.zero = b_hash
+		}
+
+		err := iw.trie.insert(ii, iw.zero)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	iw.size = size
+	return nil
+}
+
+func (iw *ItemWriter) WriteAt(buf []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("EFT: negative offset")
+	}
+
+	err := iw.extend(uint64(off) + uint64(len(buf)))
+	if err != nil {
+		return 0, trace(err)
+	}
+
+	nn := 0
+
+	for nn < len(buf) {
+		pos := uint64(off) + uint64(nn)
+
+		data, err := iw.block(pos / uint64(DATA_SIZE))
+		if err != nil {
+			return nn, trace(err)
+		}
+
+		nn += copy(data[pos % uint64(DATA_SIZE):], buf[nn:])
+		iw.dirty = true
+	}
+
+	return nn, nil
+}
+
+func (iw *ItemWriter) Truncate(size int64) error {
+	if size < 0 {
+		return errors.New("EFT: negative size")
+	}
+
+	if uint64(size) >= iw.size {
+		return iw.extend(uint64(size))
+	}
+
+	err := iw.flush()
+	if err != nil {
+		return trace(err)
+	}
+	iw.data = nil
+
+	for ii := blockCount(uint64(size)); ii < blockCount(iw.size); ii++ {
+		err := iw.trie.remove(ii)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	iw.size = uint64(size)
+
+	// Clear the rest of the new last block so a later extend reads zeros.
+	tail := iw.size % uint64(DATA_SIZE)
+	if tail != 0 {
+		data, err := iw.block(iw.size / uint64(DATA_SIZE))
+		if err != nil {
+			return trace(err)
+		}
+
+		for ii := tail; ii < uint64(DATA_SIZE); ii++ {
+			data[ii] = 0
+		}
+		iw.dirty = true
+	}
+
+	return nil
+}
+
+// Saves the new content under info, which must have the written size.
+func (iw *ItemWriter) Commit(info ItemInfo) error {
+	eft := iw.eft
+	defer eft.Unlock()
+
+	hash, err := iw.finish(info)
+	if err != nil {
+		eft.abort()
+		return trace(err)
+	}
+
+	root, err := eft.putTree(iw.snap, info, hash)
+	if err != nil {
+		eft.abort()
+		return trace(err)
+	}
+	iw.snap.Root = root
+
+	err = eft.logEvent(iw.snap, newLogEntry(LOG_PUT, info.Path))
+	if err != nil {
+		eft.abort()
+		return trace(err)
+	}
+
+	eft.commit()
+
+	fmt.Println("XX - Wrote", iw.saved, "of", blockCount(iw.size), "blocks for", info.Path)
+
+	return nil
+}
+
+func (iw *ItemWriter) finish(info ItemInfo) ([32]byte, error) {
+	if info.Type != INFO_FILE {
+		return ZERO_HASH, errors.New("EFT: writer can only save files")
+	}
+
+	if info.Size != iw.size {
+		return ZERO_HASH, fmt.Errorf(
+			"Size (%d) does not match ItemInfo (%d)",
+			iw.size, info.Size)
+	}
+
+	err := iw.flush()
+	if err != nil {
+		return ZERO_HASH, trace(err)
+	}
+
+	if info.Size <= SMALL_MAX {
+		data := make([]byte, 0)
+
+		if info.Size > 0 {
+			block, err := iw.block(0)
+			if err != nil {
+				return ZERO_HASH, trace(err)
+			}
+
+			data = block[0:info.Size]
+		}
+
+		return iw.eft.saveSmallData(info, data)
+	}
+
+	iw.trie.info = info
+	return iw.trie.save()
+}
+
+func (iw *ItemWriter) Abort() {
+	defer iw.eft.Unlock()
+	iw.eft.abort()
+}
+
+// Like Put, but large files reuse the unchanged blocks of the current
+// version of the item. With chunking on, Put already does that, and with
+// compression on, blocks are packed so they can't be updated in place.
+func (eft *EFT) Update(info ItemInfo, src_path string) error {
+	if info.Type != INFO_FILE || info.Size <= SMALL_MAX || eft.Chunking || eft.Compress {
+		return eft.Put(info, src_path)
+	}
+
+	src, err := os.Open(src_path)
+	if err != nil {
+		return trace(err)
+	}
+	defer src.Close()
+
+	iw, err := eft.OpenWriter(info.Path)
+	if err == ErrChunked {
+		return eft.Put(info, src_path)
+	}
+	if err != nil {
+		return trace(err)
+	}
+
+	data := make([]byte, DATA_SIZE)
+	off := int64(0)
+
+	for {
+		nn, err := io.ReadFull(src, data)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			iw.Abort()
+			return trace(err)
+		}
+
+		_, err = iw.WriteAt(data[:nn], off)
+		if err != nil {
+			iw.Abort()
+			return trace(err)
+		}
+
+		off += int64(nn)
+	}
+
+	err = iw.Truncate(off)
+	if err != nil {
+		iw.Abort()
+		return trace(err)
+	}
+
+	err = iw.Commit(info)
+	if err != nil {
+		return trace(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,162 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"bytes"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestItemWriter(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	name := path.Join(src_dir, "big")
+	data := RandomBytes(8 * DATA_SIZE + 100)
+
+	err = ioutil.WriteFile(name, data, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, name)
+
+	// Change one byte in the middle.
+	iw, err := eft.OpenWriter(name)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = iw.WriteAt([]byte{^data[3 * DATA_SIZE + 7]}, int64(3 * DATA_SIZE + 7))
+	if err != nil {
+		panic(err)
+	}
+	data[3 * DATA_SIZE + 7] ^= 0xFF
+
+	if iw.saved != 0 {
+		fmt.Println("Block saved before it was done")
+		tt.Fail()
+	}
+
+	// Unchanged rewrite of another block.
+	_, err = iw.WriteAt(data[5 * DATA_SIZE:6 * DATA_SIZE], int64(5 * DATA_SIZE))
+	if err != nil {
+		panic(err)
+	}
+
+	updateTestInfo(iw, name, data)
+
+	if iw.saved != 1 {
+		fmt.Println("Saved", iw.saved, "blocks for a one byte edit")
+		tt.Fail()
+	}
+
+	checkTestItem(tt, eft, name, data)
+
+	// Shrink, then grow past the old end.
+	iw, err = eft.OpenWriter(name)
+	if err != nil {
+		panic(err)
+	}
+
+	err = iw.Truncate(int64(4 * DATA_SIZE + 10))
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = iw.WriteAt([]byte("end"), int64(7 * DATA_SIZE))
+	if err != nil {
+		panic(err)
+	}
+
+	data1 := make([]byte, 7 * DATA_SIZE + 3)
+	copy(data1, data[:4 * DATA_SIZE + 10])
+	copy(data1[7 * DATA_SIZE:], []byte("end"))
+
+	updateTestInfo(iw, name, data1)
+	checkTestItem(tt, eft, name, data1)
+
+	// Update from a file, with an edit at the start.
+	data1[0] ^= 0xFF
+
+	err = ioutil.WriteFile(name, data1, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	info, err := FastItemInfo(name)
+	if err != nil {
+		panic(err)
+	}
+
+	err = eft.Update(info, name)
+	if err != nil {
+		panic(err)
+	}
+
+	checkTestItem(tt, eft, name, data1)
+
+	// Shrink down to a small item.
+	iw, err = eft.OpenWriter(name)
+	if err != nil {
+		panic(err)
+	}
+
+	err = iw.Truncate(50)
+	if err != nil {
+		panic(err)
+	}
+
+	updateTestInfo(iw, name, data1[:50])
+	checkTestItem(tt, eft, name, data1[:50])
+}
+
+// Writes data to name so the info matches, then commits the writer.
+func updateTestInfo(iw *ItemWriter, name string, data []byte) {
+	err := ioutil.WriteFile(name, data, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	info, err := FastItemInfo(name)
+	if err != nil {
+		panic(err)
+	}
+
+	err = iw.Commit(info)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func checkTestItem(tt *testing.T, eft *EFT, name string, data []byte) {
+	temp := eft.TempName()
+	defer os.Remove(temp)
+
+	_, err := eft.Get(name, temp)
+	if err != nil {
+		panic(err)
+	}
+
+	data1, err := ioutil.ReadFile(temp)
+	if err != nil {
+		panic(err)
+	}
+
+	if !bytes.Equal(data, data1) {
+		fmt.Println("Wrong content after update, size", len(data))
+		tt.Fail()
+	}
+}
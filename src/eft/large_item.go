@@ -44,13 +44,21 @@ func (eft *EFT) loadLargeTrie(hash [32]byte) (LargeTrie, error) {
 		return trie, trace(err)
 	}
 
-	trie.info = ItemInfoFromBytes(trie.root.hdr[:])
+	trie.info, err = eft.infoFromBytes(trie.root.hdr[:])
+	if err != nil {
+		return trie, trace(err)
+	}
 
 	return trie, nil
 }
 
 func (trie *LargeTrie) save() ([32]byte, error) {
-	copy(trie.root.hdr[:], trie.info.Bytes())
+	header, err := trie.root.eft.infoBytes(trie.info)
+	if err != nil {
+		return ZERO_HASH, trace(err)
+	}
+
+	copy(trie.root.hdr[:], header)
 	return trie.root.save()
 }
 
@@ -73,6 +81,15 @@ func (trie *LargeTrie) insert(ii uint64, hash [32]byte) error {
 	return trie.root.insert(entry.Pkey[:], entry)
 }
 
+func (trie *LargeTrie) remove(ii uint64) error {
+	le := binary.LittleEndian
+
+	var iile [8]byte
+	le.PutUint64(iile[:], ii)
+
+	return trie.root.remove(iile[:])
+}
+
 func (eft *EFT) saveLargeItem(info ItemInfo, src_path string) ([32]byte, error) {
 	hash := [32]byte{}
 
@@ -122,7 +139,10 @@ func (eft *EFT) loadLargeItem(hash [32]byte, dst_path string) (_ ItemInfo, eret
 		return info, trace(err)
 	}
 	defer func() {
-		eret = dst.Close()
+		err := dst.Close()
+		if eret == nil {
+			eret = err
+		}
 	}()
 
 	trie, err := eft.loadLargeTrie(hash)
@@ -133,7 +153,7 @@ func (eft *EFT) loadLargeItem(hash [32]byte, dst_path string) (_ ItemInfo, eret
 	info = trie.info
 
 	for ii := uint64(0); true; ii++ {
-		b_hash, err := trie.find(ii)
+		ent, err := trie.findEntry(ii)
 		if err == ErrNotFound {
 			break
 		}
@@ -141,12 +161,12 @@ func (eft *EFT) loadLargeItem(hash [32]byte, dst_path string) (_ ItemInfo, eret
 			return info, trace(err)
 		}
 
-		data, err := eft.loadBlock(b_hash)
+		data, err := eft.loadBlock(ent.Hash)
 		if err != nil {
 			return info, trace(err)
 		}
 
-		_, err = dst.Write(data)
+		_, err = dst.Write(data[:chunkLen(ent)])
 		if err != nil {
 			return info, trace(err)
 		}
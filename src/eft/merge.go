@@ -3,6 +3,7 @@ package eft
 import (
 	"fmt"
 	"bytes"
+	"sort"
 )
 
 func (eft *EFT) MergeRemote(hash [32]byte) error {
@@ -11,35 +12,36 @@ func (eft *EFT) MergeRemote(hash [32]byte) error {
 
 	eft.begin()
 
-	// Merge snapshots
-	snaps, err := eft.loadSnaps()
+	err := eft.mergeRemote(hash, true)
 	if err != nil {
 		eft.abort()
 		return trace(err)
 	}
 
-	rem_snaps, err := eft.loadSnapsFrom(hash)
+	return nil
+}
+
+// Merges a remote snapshot list and commits. Without use_base, the last
+// synced root isn't taken as the common ancestor.
+func (eft *EFT) mergeRemote(hash [32]byte, use_base bool) error {
+	snaps, err := eft.loadSnaps()
 	if err != nil {
-		eft.abort()
 		return trace(err)
 	}
 
-	if len(snaps) != 1 || len(rem_snaps) != 1 {
-		eft.abort()
-		panic("TODO: Handle multiple snapshots")
+	rem_snaps, err := eft.loadSnapsFrom(hash)
+	if err != nil {
+		return trace(err)
 	}
 
-	merged, err := eft.mergeSnaps(snaps[0], rem_snaps[0])
+	merged, err := eft.mergeSnapLists(snaps, rem_snaps, use_base)
 	if err != nil {
-		eft.abort()
 		return trace(err)
 	}
 
-	snaps[0] = merged
-
-	eft.Snaps = snaps
+	eft.Snaps = merged
 	
-	if merged == rem_snaps[0] {
+	if snapListsEqual(merged, rem_snaps) {
 		fmt.Println("XX - Merge: Took remote hash")
 		eft.commit_hash(hash)
 		return nil
@@ -49,8 +51,153 @@ func (eft *EFT) MergeRemote(hash [32]byte) error {
 	}
 }
 
-func (eft *EFT) mergeSnaps(snap0, snap1 Snapshot) (Snapshot, error) {
-	if HashesEqual(snap0.Root, snap1.Root) {
+func snapListsEqual(snaps0, snaps1 []Snapshot) bool {
+	if len(snaps0) != len(snaps1) {
+		return false
+	}
+
+	for ii := range(snaps0) {
+		if snaps0[ii] != snaps1[ii] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Snapshots other than the main one are identified by time and
+// description.
+func (snap *Snapshot) sameSnap(snap1 *Snapshot) bool {
+	return snap.Time == snap1.Time && snap.Desc == snap1.Desc
+}
+
+type snapsByNewest []Snapshot
+
+func (ss snapsByNewest) Len() int           { return len(ss) }
+func (ss snapsByNewest) Less(ii, jj int) bool { return ss[ii].Time > ss[jj].Time }
+func (ss snapsByNewest) Swap(ii, jj int)      { ss[ii], ss[jj] = ss[jj], ss[ii] }
+
+func findSnap(snaps []Snapshot, snap *Snapshot) int {
+	for ii := 1; ii < len(snaps); ii++ {
+		if snaps[ii].sameSnap(snap) {
+			return ii
+		}
+	}
+
+	return -1
+}
+
+// Merges the main snapshots, then combines the other snapshots from
+// both lists. A snapshot missing from one side that was in the last
+// synced list was deleted on that side, so it's dropped.
+func (eft *EFT) mergeSnapLists(snaps0, snaps1 []Snapshot, use_base bool) ([]Snapshot, error) {
+	main, err := eft.mergeSnaps(snaps0[0], snaps1[0], use_base)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	base := make([]Snapshot, 0)
+
+	if use_base {
+		synced, err := eft.loadSyncedHash()
+		if err == nil {
+			base, err = eft.loadSnapsFrom(synced)
+		}
+		if err != nil && err != ErrNotFound {
+			return nil, trace(err)
+		}
+	}
+
+	merged := []Snapshot{main}
+
+	for ii := 1; ii < len(snaps0); ii++ {
+		snap := snaps0[ii]
+
+		if findSnap(snaps1, &snap) < 0 && findSnap(base, &snap) > 0 {
+			continue
+		}
+
+		merged = append(merged, snap)
+	}
+
+	added := make([]Snapshot, 0)
+
+	for ii := 1; ii < len(snaps1); ii++ {
+		snap := snaps1[ii]
+
+		if findSnap(snaps0, &snap) > 0 || findSnap(base, &snap) > 0 {
+			continue
+		}
+
+		added = append(added, snap)
+	}
+
+	// Keep the newest remote snapshots that fit.
+	sort.Stable(snapsByNewest(added))
+
+	room := SNAPS_PER_BLOCK - len(merged)
+	if room < 0 {
+		return nil, fmt.Errorf("Too many local snapshots: %d", len(merged))
+	}
+
+	if len(added) > room {
+		fmt.Println("XX - Merge: Discarding", len(added) - room, "remote snapshots")
+		added = added[:room]
+	}
+
+	merged = append(merged, added...)
+
+	// Keep the result in the same order as the remote list when nothing
+	// was added locally, so the merge can take the remote hash.
+	if len(merged) == len(snaps1) {
+		same := merged[0] == snaps1[0]
+
+		for ii := 1; same && ii < len(snaps1); ii++ {
+			jj := findSnap(merged, &snaps1[ii])
+			same = jj > 0 && merged[jj] == snaps1[ii]
+		}
+
+		if same {
+			return snaps1, nil
+		}
+	}
+
+	return merged, nil
+}
+
+func (eft *EFT) mergeSnaps(snap0, snap1 Snapshot, use_base bool) (Snapshot, error) {
+	if HashesEqual(snap0.Root, snap1.Root) && snap0.Log == snap1.Log {
+		return snap0, nil
+	}
+
+	if snap0.isEmpty() {
+		return snap1, nil
+	}
+
+	log0, err := eft.loadLogEntries(snap0.Log)
+	if err != nil {
+		return Snapshot{}, trace(err)
+	}
+
+	log1, err := eft.loadLogEntries(snap1.Log)
+	if err != nil {
+		return Snapshot{}, trace(err)
+	}
+
+	new0 := logNewEntries(log0, log1)
+	new1 := logNewEntries(log1, log0)
+
+	// With a shared checkpoint, anything not in the other log happened
+	// after the two EFTs last synced.
+	common := logHaveCommonCheckpoint(log0, log1)
+
+	if common && !logHasChanges(new0) {
+		fmt.Println("XX - Merge: Only remote changes")
+		return snap1, nil
+	}
+
+	if common && !logHasChanges(new1) {
+		fmt.Println("XX - Merge: Only local changes")
 		return snap0, nil
 	}
 
@@ -64,9 +211,39 @@ func (eft *EFT) mergeSnaps(snap0, snap1 Snapshot) (Snapshot, error) {
 		return Snapshot{}, trace(err)
 	}
 
-	trie, err := eft.mergePathTries(pt0, pt1)
-	if err != nil {
-		return Snapshot{}, trace(err)
+	ptb, has_base := eft.emptyPathTrie(), false
+
+	if use_base {
+		ptb, has_base, err = eft.loadMergeBase()
+		if err != nil {
+			return Snapshot{}, trace(err)
+		}
+	}
+
+	trie := pt0
+
+	if !common || has_base {
+		trie, err = eft.mergePathTries(ptb, pt0, pt1, logPurgedPaths(new0, new1))
+		if err != nil {
+			return Snapshot{}, trace(err)
+		}
+	}
+
+	// With a base, the three-way merge already took every change made on
+	// only one side. Replaying the logs would let whichever device has
+	// the later clock undo those, so they only decide merges without one.
+	if !has_base {
+		if !common {
+			err = eft.replayLog(&trie, &pt0, new0, new1, true)
+			if err != nil {
+				return Snapshot{}, trace(err)
+			}
+		}
+
+		err = eft.replayLog(&trie, &pt1, new1, new0, false)
+		if err != nil {
+			return Snapshot{}, trace(err)
+		}
 	}
 
 	if trie.Equals(&pt1) {
@@ -80,38 +257,174 @@ func (eft *EFT) mergeSnaps(snap0, snap1 Snapshot) (Snapshot, error) {
 
 		snap0.Root = hash
 	}
+
+	// The remote entries go after the local log, so the blocks already
+	// sealed are kept as they are and don't need uploading again.
+	if len(new1) > 0 {
+		sort.Stable(logEntriesByTime(new1))
+
+		err = eft.logEvents(&snap0, new1)
+		if err != nil {
+			return Snapshot{}, trace(err)
+		}
+	}
 	
 	return snap0, nil
 }
 
-func (eft *EFT) mergePathTries(pt0, pt1 PathTrie) (PathTrie, error) {
-	mtn, err := eft.mergeTrieNodes(*pt0.root, *pt1.root)
+// Loads the main tree from the last root this EFT successfully synced,
+// which is the common ancestor of the local and remote trees.
+func (eft *EFT) loadMergeBase() (PathTrie, bool, error) {
+	hash, err := eft.loadSyncedHash()
+	if err == ErrNotFound {
+		return eft.emptyPathTrie(), false, nil
+	}
+	if err != nil {
+		return PathTrie{}, false, trace(err)
+	}
+
+	snaps, err := eft.loadSnapsFrom(hash)
+	if err != nil {
+		return PathTrie{}, false, trace(err)
+	}
+
+	if snaps[0].isEmpty() {
+		return eft.emptyPathTrie(), false, nil
+	}
+
+	trie, err := eft.loadPathTrie(snaps[0].Root)
+	if err != nil {
+		return PathTrie{}, false, trace(err)
+	}
+
+	return trie, true, nil
+}
+
+// Copies entries from src into trie for each path where the latest event
+// in ents is newer than the latest event for that path in other. A path
+// that was purged in src is removed from trie if it's a tombstone there.
+func (eft *EFT) replayLog(trie, src *PathTrie, ents, other []LogEntry, ties bool) error {
+	latest := logLatestEntries(ents)
+	other_times := logLatestTimes(other)
+
+	for item_path, ent := range(latest) {
+		ot, ok := other_times[item_path]
+		if ok && (ot > ent.Time || (ot == ent.Time && !ties)) {
+			continue
+		}
+
+		if ent.Op == LOG_PRG {
+			err := eft.dropPurged(trie, item_path)
+			if err != nil {
+				return trace(err)
+			}
+			continue
+		}
+
+		hash, err := src.find(item_path)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return trace(err)
+		}
+
+		curr, err := trie.find(item_path)
+		if err == nil && curr == hash {
+			continue
+		}
+		if err != nil && err != ErrNotFound {
+			return trace(err)
+		}
+
+		err = trie.insert(item_path, hash)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return nil
+}
+
+// Merges the trie nodes, then drops the tombstones for purged paths. One
+// side may still have a tombstone the other side purged, and merging the
+// nodes would put it back.
+func (eft *EFT) mergePathTries(ptb, pt0, pt1 PathTrie, purged []string) (PathTrie, error) {
+	mtn, err := eft.mergeTrieNodes(*ptb.root, *pt0.root, *pt1.root)
+	if err != nil {
+		return PathTrie{}, trace(err)
+	}
+
+	trie := PathTrie{root: &mtn}
+
+	err = trie.updateDirs(&pt0)
 	if err != nil {
 		return PathTrie{}, trace(err)
 	}
 
-	return PathTrie{root: &mtn}, nil
+	for _, item_path := range(purged) {
+		err = eft.dropPurged(&trie, item_path)
+		if err != nil {
+			return PathTrie{}, trace(err)
+		}
+	}
+
+	return trie, nil
 }
 
-func (eft *EFT) mergeTrieNodes(tn0, tn1 TrieNode) (TrieNode, error) {
+// Merges two trie nodes against their common ancestor tnb. A slot that
+// matches the ancestor on one side was only changed on the other side, so
+// that side is taken as is. Only slots changed on both sides need to be
+// merged entry by entry. With an empty ancestor, this is a plain two-way
+// merge.
+func (eft *EFT) mergeTrieNodes(tnb, tn0, tn1 TrieNode) (TrieNode, error) {
 	mtn := TrieNode{
 		eft: eft,
 		tri: tn0.tri,
 		dep: tn0.dep,
 	}
 
+	// The merged node starts with the local overflow tables. Entries
+	// that need to be merged into them are inserted at the end, once
+	// every slot in the merged table has been filled in.
+	mtn.ovr = tn0.ovr
+	pending := make([]TrieEntry, 0)
+
 	for ii := 0; ii < 256; ii++ {
 		ent0 := tn0.tab[ii]
 		ent1 := tn1.tab[ii]
 
-		if ent0.Hash == ent1.Hash {
-			// Same block hash means same entry
+		if tnb.sameSlot(&tn1, uint8(ii)) {
+			// Unchanged remotely; the merged node already has the local slot.
 			mtn.tab[ii] = ent0
 			continue
 		}
 
-		if ent0.Type == TRIE_TYPE_NONE {
-			mtn.tab[ii] = ent1
+		if tnb.sameSlot(&tn0, uint8(ii)) || ent0.Type == TRIE_TYPE_NONE {
+			// Unchanged locally; take the remote slot.
+			ents, err := mtn.takeSlot(&tn0, &tn1, uint8(ii))
+			if err != nil {
+				return mtn, trace(err)
+			}
+
+			pending = append(pending, ents...)
+			continue
+		}
+
+		if ent0.Type == TRIE_TYPE_OVRF || ent1.Type == TRIE_TYPE_OVRF {
+			ment, ents, err := mtn.mergeOverflow(&tnb, &tn0, &tn1, uint8(ii))
+			if err != nil {
+				return mtn, trace(err)
+			}
+
+			mtn.tab[ii] = ment
+			pending = append(pending, ents...)
+			continue
+		}
+
+		if ent0.Hash == ent1.Hash {
+			// Same block hash means same entry
+			mtn.tab[ii] = ent0
 			continue
 		}
 
@@ -121,6 +434,11 @@ func (eft *EFT) mergeTrieNodes(tn0, tn1 TrieNode) (TrieNode, error) {
 		}
 
 		if ent0.Type == TRIE_TYPE_MORE && ent1.Type == TRIE_TYPE_MORE {
+			stnb, err := tnb.baseChild(uint8(ii))
+			if err != nil {
+				return mtn, trace(err)
+			}
+
 			stn0, err := tn0.loadChild(ent0.Hash)
 			if err != nil {
 				return mtn, trace(err)
@@ -131,7 +449,7 @@ func (eft *EFT) mergeTrieNodes(tn0, tn1 TrieNode) (TrieNode, error) {
 				return mtn, trace(err)
 			}
 
-			smtn, err := eft.mergeTrieNodes(*stn0, *stn1)
+			smtn, err := eft.mergeTrieNodes(*stnb, *stn0, *stn1)
 			if err != nil {
 				return mtn, trace(err)
 			}
@@ -153,7 +471,7 @@ func (eft *EFT) mergeTrieNodes(tn0, tn1 TrieNode) (TrieNode, error) {
 		}
 
 		if ent0.Type == TRIE_TYPE_MORE && ent1.Type == TRIE_TYPE_ITEM {
-			ment, err := mtn.mergeInsert(ent0, ent1)
+			ment, err := mtn.mergeInsertChanged(&tnb, ent0, []TrieEntry{ent1})
 			if err != nil {
 				return mtn, trace(err)
 			}
@@ -163,7 +481,7 @@ func (eft *EFT) mergeTrieNodes(tn0, tn1 TrieNode) (TrieNode, error) {
 		}
 
 		if ent1.Type == TRIE_TYPE_MORE && ent0.Type == TRIE_TYPE_ITEM {
-			ment, err := mtn.mergeInsert(ent1, ent0)
+			ment, err := mtn.mergeInsertChanged(&tnb, ent1, []TrieEntry{ent0})
 			if err != nil {
 				return mtn, trace(err)
 			}
@@ -173,22 +491,280 @@ func (eft *EFT) mergeTrieNodes(tn0, tn1 TrieNode) (TrieNode, error) {
 		}
 
 		if ent0.Type == TRIE_TYPE_ITEM && ent1.Type == TRIE_TYPE_ITEM {
-			ment, err := mtn.mergeItems(ent0, ent1)
+			ents, err := mtn.mergeEntryLists(&tnb, []TrieEntry{ent0}, []TrieEntry{ent1})
 			if err != nil {
 				return mtn, trace(err)
 			}
 
-			mtn.tab[ii] = ment
+			if len(ents) == 1 {
+				mtn.tab[ii] = ents[0]
+			} else {
+				pending = append(pending, ents...)
+			}
 			continue
 		}
 
 		panic(fmt.Sprintf("Unhandled case (%d, %d)", ent0.Type, ent1.Type))
 	}
 
+	for _, ent := range(pending) {
+		key, err := mtn.KeyBytes(ent)
+		if err != nil {
+			return mtn, trace(err)
+		}
+
+		err = mtn.insert(key, ent)
+		if err != nil {
+			return mtn, trace(err)
+		}
+	}
+
 	return mtn, nil
 }
 
-func (ptn *TrieNode) mergeInsert(ent0, ent1 TrieEntry) (TrieEntry, error) {
+func (tn *TrieNode) sameSlot(tn1 *TrieNode, slot uint8) bool {
+	ent := tn.tab[slot]
+
+	if ent != tn1.tab[slot] {
+		return false
+	}
+
+	// Overflowed entries are only the same if the tables are.
+	return ent.Type != TRIE_TYPE_OVRF || tn.ovr == tn1.ovr
+}
+
+// Replaces the local slot in the merged node with the remote one. Returns
+// any overflowed remote entries, which still need to be inserted.
+func (mtn *TrieNode) takeSlot(tn0, tn1 *TrieNode, slot uint8) ([]TrieEntry, error) {
+	if tn0.tab[slot].Type == TRIE_TYPE_OVRF {
+		mtn.tab[slot] = tn0.tab[slot]
+
+		_, err := mtn.takeOverflow(slot)
+		if err != nil {
+			return nil, trace(err)
+		}
+	}
+
+	if tn1.tab[slot].Type != TRIE_TYPE_OVRF {
+		mtn.tab[slot] = tn1.tab[slot]
+		return nil, nil
+	}
+
+	mtn.tab[slot] = TrieEntry{}
+
+	ents, err := tn1.slotOverflow(slot)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return ents, nil
+}
+
+// Gets the part of an ancestor node below a slot as a child node, to use
+// as the ancestor when merging the sub-tries for that slot.
+func (tn *TrieNode) baseChild(slot uint8) (*TrieNode, error) {
+	ent := tn.tab[slot]
+
+	switch ent.Type {
+	case TRIE_TYPE_MORE:
+		return tn.loadChild(ent.Hash)
+
+	case TRIE_TYPE_ITEM:
+		cc := tn.emptyChild()
+
+		key, err := tn.KeyBytes(ent)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		if cc.dep < len(key) {
+			cc.tab[key[cc.dep]] = ent
+		}
+
+		return cc, nil
+
+	case TRIE_TYPE_OVRF:
+		cc := tn.emptyChild()
+
+		ents, err := tn.slotOverflow(slot)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		for _, ent := range(ents) {
+			key, err := tn.KeyBytes(ent)
+			if err != nil {
+				return nil, trace(err)
+			}
+
+			if cc.dep < len(key) {
+				err = cc.insert(key, ent)
+				if err != nil {
+					return nil, trace(err)
+				}
+			}
+		}
+
+		return cc, nil
+	}
+
+	return tn.emptyChild(), nil
+}
+
+// Whether the ancestor has the same entry, so it's unchanged on that side.
+func (tnb *TrieNode) hasEntry(ent TrieEntry) (bool, error) {
+	key, err := tnb.KeyBytes(ent)
+	if err != nil {
+		return false, trace(err)
+	}
+
+	bent, err := tnb.findEntry(key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, trace(err)
+	}
+
+	return bent.Hash == ent.Hash, nil
+}
+
+// Merges a slot where at least one side has overflowed entries. Returns
+// the merged slot entry and any entries that still need to be inserted
+// into the merged node.
+func (mtn *TrieNode) mergeOverflow(tnb, tn0, tn1 *TrieNode, slot uint8) (TrieEntry, []TrieEntry, error) {
+	ent0 := tn0.tab[slot]
+	ent1 := tn1.tab[slot]
+
+	ents0 := make([]TrieEntry, 0)
+	ents1 := make([]TrieEntry, 0)
+
+	switch ent0.Type {
+	case TRIE_TYPE_OVRF:
+		if ent1.Type == TRIE_TYPE_NONE || (ent1 == ent0 && tn1.ovr == tn0.ovr) {
+			// The merged node already has these in its overflow tables
+			return ent0, nil, nil
+		}
+
+		mtn.tab[slot] = ent0
+
+		ents, err := mtn.takeOverflow(slot)
+		if err != nil {
+			return TrieEntry{}, nil, trace(err)
+		}
+		ents0 = ents
+
+	case TRIE_TYPE_ITEM:
+		ents0 = append(ents0, ent0)
+	}
+
+	switch ent1.Type {
+	case TRIE_TYPE_OVRF:
+		ents, err := tn1.slotOverflow(slot)
+		if err != nil {
+			return TrieEntry{}, nil, trace(err)
+		}
+		ents1 = ents
+
+	case TRIE_TYPE_ITEM:
+		ents1 = append(ents1, ent1)
+	}
+
+	if ent0.Type == TRIE_TYPE_MORE || ent1.Type == TRIE_TYPE_MORE {
+		ment := ent0
+		ents := ents1
+
+		if ent1.Type == TRIE_TYPE_MORE {
+			ment = ent1
+			ents = ents0
+		}
+
+		ment, err := mtn.mergeInsertChanged(tnb, ment, ents)
+		if err != nil {
+			return TrieEntry{}, nil, trace(err)
+		}
+
+		return ment, nil, nil
+	}
+
+	ents, err := mtn.mergeEntryLists(tnb, ents0, ents1)
+	if err != nil {
+		return TrieEntry{}, nil, trace(err)
+	}
+
+	return TrieEntry{}, ents, nil
+}
+
+func (mtn *TrieNode) mergeEntryLists(tnb *TrieNode, ents0, ents1 []TrieEntry) ([]TrieEntry, error) {
+	ents := make([]TrieEntry, 0, len(ents0) + len(ents1))
+	keys := make([][]byte, 0, len(ents0) + len(ents1))
+
+	for _, ent := range(ents0) {
+		key, err := mtn.KeyBytes(ent)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		ents = append(ents, ent)
+		keys = append(keys, key)
+	}
+
+	for _, ent1 := range(ents1) {
+		key1, err := mtn.KeyBytes(ent1)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		found := false
+
+		for jj, key0 := range(keys) {
+			if bytes.Equal(key0, key1) {
+				ment, err := mtn.mergeItems(tnb, ents[jj], ent1)
+				if err != nil {
+					return nil, trace(err)
+				}
+
+				ents[jj] = ment
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			ents = append(ents, ent1)
+			keys = append(keys, key1)
+		}
+	}
+
+	return ents, nil
+}
+
+// Inserts the entries from one side into the sub-trie from the other,
+// skipping those that match the ancestor. The sub-trie already has the
+// current version of those.
+func (ptn *TrieNode) mergeInsertChanged(tnb *TrieNode, ment TrieEntry, ents []TrieEntry) (TrieEntry, error) {
+	for _, ent := range(ents) {
+		same, err := tnb.hasEntry(ent)
+		if err != nil {
+			return TrieEntry{}, trace(err)
+		}
+
+		if same {
+			continue
+		}
+
+		ment, err = ptn.mergeInsert(tnb, ment, ent)
+		if err != nil {
+			return TrieEntry{}, trace(err)
+		}
+	}
+
+	return ment, nil
+}
+
+// Inserts an item into a sub-trie. If the sub-trie has its own version of
+// the item, the two are merged against the ancestor.
+func (ptn *TrieNode) mergeInsert(tnb *TrieNode, ent0, ent1 TrieEntry) (TrieEntry, error) {
 	if ent0.Type != TRIE_TYPE_MORE {
 		return TrieEntry{}, fmt.Errorf("First argument must be TRIE_TYPE_MORE")
 	}
@@ -199,11 +775,7 @@ func (ptn *TrieNode) mergeInsert(ent0, ent1 TrieEntry) (TrieEntry, error) {
 	
 	var err error
 
-	mtn := &TrieNode{
-		eft: ptn.eft,
-		tri: ptn.tri,
-		dep: ptn.dep,
-	}
+	mtn := ptn.emptyChild()
 
 	if !HashesEqual(ent0.Hash, ZERO_HASH) {
 		mtn, err = ptn.loadChild(ent0.Hash)
@@ -217,6 +789,22 @@ func (ptn *TrieNode) mergeInsert(ent0, ent1 TrieEntry) (TrieEntry, error) {
 		return TrieEntry{}, trace(err)
 	}
 
+	cur, err := mtn.findEntry(key)
+	if err != nil && err != ErrNotFound {
+		return TrieEntry{}, trace(err)
+	}
+
+	if err == nil {
+		ent1, err = mtn.mergeItems(tnb, cur, ent1)
+		if err != nil {
+			return TrieEntry{}, trace(err)
+		}
+
+		if ent1.Hash == cur.Hash {
+			return ent0, nil
+		}
+	}
+
 	err = mtn.insert(key, ent1)
 	if err != nil {
 		return TrieEntry{}, trace(err)
@@ -235,7 +823,7 @@ func (ptn *TrieNode) mergeInsert(ent0, ent1 TrieEntry) (TrieEntry, error) {
 	return ment, nil
 }
 
-func (mtn *TrieNode) mergeItems(ent0, ent1 TrieEntry) (TrieEntry, error) {
+func (mtn *TrieNode) mergeItems(tnb *TrieNode, ent0, ent1 TrieEntry) (TrieEntry, error) {
 	if ent0.Type != TRIE_TYPE_ITEM || ent1.Type != TRIE_TYPE_ITEM {
 		return TrieEntry{}, fmt.Errorf("Both arguments must be TRIE_TYPE_ITEM")
 	}
@@ -251,6 +839,19 @@ func (mtn *TrieNode) mergeItems(ent0, ent1 TrieEntry) (TrieEntry, error) {
 	}
 			
 	if bytes.Equal(key0, key1) {
+		bent, err := tnb.findEntry(key0)
+		if err != nil && err != ErrNotFound {
+			return TrieEntry{}, trace(err)
+		}
+
+		// Only changed on one side.
+		if err == nil && bent.Hash == ent0.Hash {
+			return ent1, nil
+		}
+		if err == nil && bent.Hash == ent1.Hash {
+			return ent0, nil
+		}
+
 		info0, err := mtn.eft.loadItemInfo(ent0.Hash)
 		if err != nil {
 			return TrieEntry{}, trace(err)
@@ -263,6 +864,8 @@ func (mtn *TrieNode) mergeItems(ent0, ent1 TrieEntry) (TrieEntry, error) {
 		
 		fmt.Println("XX - Merging", info0.Path, info1.Path)
 
+		// Both sides changed this item since they last synced, so
+		// fall back to the modification time.
 		if info0.ModT > info1.ModT {
 			return ent0, nil
 		} else {
@@ -274,12 +877,12 @@ func (mtn *TrieNode) mergeItems(ent0, ent1 TrieEntry) (TrieEntry, error) {
 		Type: TRIE_TYPE_MORE,
 	}
 
-	ment, err = mtn.mergeInsert(ment, ent0)
+	ment, err = mtn.mergeInsert(tnb, ment, ent0)
 	if err != nil {
 		return TrieEntry{}, trace(err)
 	}
 
-	ment, err = mtn.mergeInsert(ment, ent1)
+	ment, err = mtn.mergeInsert(tnb, ment, ent1)
 	if err != nil {
 		return TrieEntry{}, trace(err)
 	}
@@ -1,7 +1,9 @@
 package eft
 
 import (
+	"io/ioutil"
 	"testing"
+	"time"
 	"fmt"
 	"path"
 	"os"
@@ -74,3 +76,398 @@ func TestTrivialMerge(tt *testing.T) {
 	}
 }
 
+
+func TestThreeWayMerge(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	names := writeTestFiles(src_dir, 4)
+
+	for _, name := range(names) {
+		putTestFile(eft, name)
+	}
+
+	base := testMainRoot(eft)
+
+	// Remote restores an older version of the first file.
+	old := time.Now().Add(-time.Hour)
+	err := ioutil.WriteFile(names[0], []byte("restored"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Chtimes(names[0], old, old)
+	if err != nil {
+		panic(err)
+	}
+	putTestFile(eft, names[0])
+
+	remote := testMainRoot(eft)
+
+	// Local edits the second file and deletes the third, starting
+	// from the common base.
+	testSetMainRoot(eft, base)
+
+	err = ioutil.WriteFile(names[1], []byte("edited"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	putTestFile(eft, names[1])
+
+	err = eft.Del(names[2])
+	if err != nil {
+		panic(err)
+	}
+
+	local := testMainRoot(eft)
+
+	eft.Lock()
+	defer eft.Unlock()
+
+	eft.begin()
+	defer eft.commit()
+
+	ptb, err := eft.loadPathTrie(base)
+	if err != nil {
+		panic(err)
+	}
+
+	pt0, err := eft.loadPathTrie(local)
+	if err != nil {
+		panic(err)
+	}
+
+	pt1, err := eft.loadPathTrie(remote)
+	if err != nil {
+		panic(err)
+	}
+
+	merged, err := eft.mergePathTries(ptb, pt0, pt1, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	for ii, name := range(names) {
+		want := pt0
+
+		if ii == 0 {
+			// Only changed remotely, so its older mtime doesn't matter.
+			want = pt1
+		}
+
+		hash0, err := want.find(name)
+		if err != nil {
+			panic(err)
+		}
+
+		hash1, err := merged.find(name)
+		if err != nil {
+			panic(err)
+		}
+
+		if hash0 != hash1 {
+			fmt.Println("Three-way merge picked the wrong side for", name)
+			tt.Fail()
+		}
+	}
+}
+
+func TestSkewedClockMerge(tt *testing.T) {
+	src_dir := TmpRandomName()
+	defer os.RemoveAll(src_dir)
+
+	names := writeTestFiles(src_dir, 3)
+
+	eft0 := &EFT{Key: [32]byte{}, Dir: TmpRandomName()}
+	eft1 := &EFT{Key: [32]byte{}, Dir: TmpRandomName()}
+
+	defer os.RemoveAll(eft0.Dir)
+	defer os.RemoveAll(eft1.Dir)
+
+	putTestFile(eft0, names[0])
+	putTestFile(eft0, names[1])
+
+	syncTestEFTs(eft0, eft1)
+
+	// Only eft1 edits the first file.
+	err := ioutil.WriteFile(names[0], []byte("edited"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	putTestFile(eft1, names[0])
+
+	// eft0's clock is an hour ahead, and it has touched the same path
+	// without changing the item, along with a real change elsewhere.
+	eft0.Lock()
+	eft0.begin()
+	skewed := uint64(time.Now().Add(time.Hour).UnixNano())
+	err = eft0.logEvents(eft0.mainSnap(), []LogEntry{
+		LogEntry{Time: skewed, Op: LOG_PUT, Arg: names[0]},
+	})
+	if err != nil {
+		panic(err)
+	}
+	eft0.commit()
+	eft0.Unlock()
+
+	putTestFile(eft0, names[2])
+
+	syncTestEFTs(eft1, eft0)
+
+	checkTestItem(tt, eft0, names[0], []byte("edited"))
+	checkTestItem(tt, eft0, names[2], testReadBytes(names[2]))
+}
+
+func TestMergeItemIntoSubTrie(tt *testing.T) {
+	src_dir := TmpRandomName()
+	defer os.RemoveAll(src_dir)
+
+	name := writeTestFiles(src_dir, 1)[0]
+
+	eft := &EFT{Key: [32]byte{}, Dir: TmpRandomName()}
+	defer os.RemoveAll(eft.Dir)
+
+	// The ancestor version of an item, then an older and a newer edit.
+	hashes := make([][32]byte, 0)
+	now := time.Now()
+
+	for ii := 0; ii < 3; ii++ {
+		err := ioutil.WriteFile(name, []byte(fmt.Sprintf("version %d", ii)), 0600)
+		if err != nil {
+			panic(err)
+		}
+
+		mod_t := now.Add(time.Duration(ii) * time.Minute)
+
+		err = os.Chtimes(name, mod_t, mod_t)
+		if err != nil {
+			panic(err)
+		}
+
+		putTestFile(eft, name)
+
+		pt, err := eft.loadPathTrie(testMainRoot(eft))
+		if err != nil {
+			panic(err)
+		}
+
+		hash, err := pt.find(name)
+		if err != nil {
+			panic(err)
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	eft.Lock()
+	defer eft.Unlock()
+
+	eft.begin()
+	defer eft.abort()
+
+	ptb := eft.emptyPathTrie()
+
+	err := ptb.insert(name, hashes[0])
+	if err != nil {
+		panic(err)
+	}
+
+	key := HashString(name)
+
+	// Each side has one of the edits, with the other keys in the slot
+	// pushed into a sub-trie on one side but not the other.
+	merged := func(sub_hash, item_hash [32]byte) [32]byte {
+		sub := ptb.root.emptyChild()
+
+		ent := TrieEntry{Hash: sub_hash}
+		copy(ent.Pkey[:], key[:])
+
+		err := sub.insert(key[:], ent)
+		if err != nil {
+			panic(err)
+		}
+
+		hash, err := sub.save()
+		if err != nil {
+			panic(err)
+		}
+
+		item := TrieEntry{Type: TRIE_TYPE_ITEM, Hash: item_hash}
+		copy(item.Pkey[:], key[:])
+
+		ment, err := ptb.root.mergeInsertChanged(ptb.root,
+			TrieEntry{Type: TRIE_TYPE_MORE, Hash: hash}, []TrieEntry{item})
+		if err != nil {
+			panic(err)
+		}
+
+		mtn, err := ptb.root.loadChild(ment.Hash)
+		if err != nil {
+			panic(err)
+		}
+
+		found, err := mtn.findEntry(key[:])
+		if err != nil {
+			panic(err)
+		}
+
+		return found.Hash
+	}
+
+	if merged(hashes[2], hashes[1]) != hashes[2] {
+		fmt.Println("Newer edit in the sub-trie lost to an older item")
+		tt.Fail()
+	}
+
+	if merged(hashes[1], hashes[2]) != hashes[2] {
+		fmt.Println("Newer item lost to an older edit in the sub-trie")
+		tt.Fail()
+	}
+
+	if merged(hashes[0], hashes[1]) != hashes[1] {
+		fmt.Println("Edit lost to an unchanged item in the sub-trie")
+		tt.Fail()
+	}
+}
+
+func testMainRoot(eft *EFT) [32]byte {
+	eft.Lock()
+	defer eft.Unlock()
+
+	return eft.mainSnap().Root
+}
+
+func testSetMainRoot(eft *EFT, root [32]byte) {
+	eft.Lock()
+	defer eft.Unlock()
+
+	eft.begin()
+
+	snap := eft.mainSnap()
+	snap.Root = root
+
+	eft.commit()
+}
+
+func TestMergeSnapshots(tt *testing.T) {
+	eft0_dir := TmpRandomName()
+	eft1_dir := TmpRandomName()
+	src_dir  := TmpRandomName()
+
+	defer os.RemoveAll(eft0_dir)
+	defer os.RemoveAll(eft1_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft0 := &EFT{Key: [32]byte{}, Dir: eft0_dir}
+	eft1 := &EFT{Key: [32]byte{}, Dir: eft1_dir}
+
+	names := writeTestFiles(src_dir, 2)
+
+	putTestFile(eft0, names[0])
+	_, err := eft0.TakeSnapshot("a")
+	if err != nil {
+		panic(err)
+	}
+
+	syncTestEFTs(eft0, eft1)
+
+	// Remote adds a snapshot while local deletes the synced one.
+	putTestFile(eft1, names[1])
+	_, err = eft1.TakeSnapshot("b")
+	if err != nil {
+		panic(err)
+	}
+
+	err = eft0.DeleteSnapshot(1)
+	if err != nil {
+		panic(err)
+	}
+
+	syncTestEFTs(eft1, eft0)
+
+	snaps, err := eft0.ListSnapshots()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(snaps) != 2 || snaps[1].Desc != "b" {
+		fmt.Println("Wrong snapshots after merge:", len(snaps))
+		tt.Fail()
+	}
+
+	for _, name := range(names) {
+		_, err := eft0.GetInfo(name)
+		if err != nil {
+			fmt.Println("Merged lookup failed for", name)
+			tt.Fail()
+		}
+	}
+}
+
+func TestConvergentMerge(tt *testing.T) {
+	eft0_dir := TmpRandomName()
+	eft1_dir := TmpRandomName()
+	src_dir  := TmpRandomName()
+
+	defer os.RemoveAll(eft0_dir)
+	defer os.RemoveAll(eft1_dir)
+	defer os.RemoveAll(src_dir)
+
+	nonce_key := HashString("nonce")
+
+	eft0 := &EFT{Key: [32]byte{}, Dir: eft0_dir, Convergent: true, NonceKey: nonce_key}
+	eft1 := &EFT{Key: [32]byte{}, Dir: eft1_dir, Convergent: true, NonceKey: nonce_key}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	name := path.Join(src_dir, "big")
+
+	err = ioutil.WriteFile(name, RandomBytes(3 * DATA_SIZE), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	// The same file added on both sides gives the same trie.
+	putTestFile(eft0, name)
+	putTestFile(eft1, name)
+
+	if testMainRoot(eft0) != testMainRoot(eft1) {
+		fmt.Println("Same content gave different roots")
+		tt.Fail()
+	}
+
+	// Saving it again reuses the blocks, and they survive an abort.
+	eft0.Lock()
+	eft0.begin()
+	err = eft0.putItem(eft0.mainSnap(), testFileInfo(name), name)
+	if err != nil {
+		panic(err)
+	}
+	eft0.abort()
+	eft0.Unlock()
+
+	checkTestItem(tt, eft0, name, []byte(testReadFile(name)))
+
+	syncTestEFTs(eft0, eft1)
+
+	if testMainRoot(eft0) != testMainRoot(eft1) {
+		fmt.Println("Merge changed identical trie")
+		tt.Fail()
+	}
+}
+
+func testFileInfo(name string) ItemInfo {
+	info, err := FastItemInfo(name)
+	if err != nil {
+		panic(err)
+	}
+
+	return info
+}
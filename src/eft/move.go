@@ -0,0 +1,135 @@
+package eft
+
+// Moving an item only needs a new item block, since the path is in the
+// item header. The rest of the block is kept, so a small item's data is
+// copied along with it, and for a large item the new block is a new root
+// for the same trie of data blocks. Directories are moved along with
+// everything in them. Each old path gets a tombstone, like a delete, so
+// other devices see the move as a delete and a put of the same blocks.
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+func (eft *EFT) Move(src string, dst string) error {
+	txn, err := eft.Begin()
+	if err != nil {
+		return trace(err)
+	}
+
+	err = txn.Move(src, dst)
+	if err != nil {
+		txn.Abort()
+		return err
+	}
+
+	return txn.Commit()
+}
+
+func (txn *Txn) Move(src string, dst string) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+
+	ents, err := txn.eft.moveItems(txn.snap(), src, dst)
+	if err != nil {
+		return err
+	}
+
+	txn.logs = append(txn.logs, ents...)
+	return nil
+}
+
+func (eft *EFT) moveItems(snap *Snapshot, src string, dst string) ([]LogEntry, error) {
+	src = path.Clean("/" + src)
+	dst = path.Clean("/" + dst)
+
+	if dst == src || strings.HasPrefix(dst, src + "/") {
+		return nil, fmt.Errorf("Can't move %s into itself", src)
+	}
+
+	info, _, err := eft.getTree(snap, src)
+	if err == nil && info.Type == INFO_TOMB {
+		err = ErrNotFound
+	}
+	if err != nil {
+		return nil, err // Could be ErrNotFound
+	}
+
+	infos := []ItemInfo{info}
+
+	// Directories are listed as they're reached.
+	for ii := 0; ii < len(infos); ii++ {
+		if infos[ii].Type != INFO_DIR {
+			continue
+		}
+
+		kids, err := eft.listDir(snap, infos[ii].Path)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		for _, kid := range(kids) {
+			if kid.Type != INFO_TOMB {
+				infos = append(infos, kid)
+			}
+		}
+	}
+
+	ents := make([]LogEntry, 0)
+
+	for _, info := range(infos) {
+		new_path := dst + strings.TrimPrefix(info.Path, src)
+
+		err = eft.moveItem(snap, info.Path, new_path)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		ents = append(ents, newLogEntry(LOG_PUT, new_path))
+
+		err = eft.delItem(snap, info.Path)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		ents = append(ents, newLogEntry(LOG_DEL, info.Path))
+	}
+
+	return ents, nil
+}
+
+func (eft *EFT) moveItem(snap *Snapshot, src string, dst string) error {
+	info, hash, err := eft.getTree(snap, src)
+	if err != nil {
+		return trace(err)
+	}
+
+	data, err := eft.loadBlock(hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	info.Path = dst
+
+	header, err := eft.infoBytes(info)
+	if err != nil {
+		return trace(err)
+	}
+
+	copy(data[0:INFO_SIZE], header)
+
+	new_hash, err := eft.saveBlock(data)
+	if err != nil {
+		return trace(err)
+	}
+
+	snap.Root, err = eft.putTree(snap, info, new_hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestMove(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	sub := path.Join(src_dir, "a", "sub")
+	err := os.MkdirAll(sub, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	small := path.Join(src_dir, "a", "small")
+	large := path.Join(sub, "large")
+
+	err = ioutil.WriteFile(small, []byte("moving along\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	err = ioutil.WriteFile(large, RandomBytes(3 * DATA_SIZE), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, name := range([]string{path.Join(src_dir, "a"), sub, small, large}) {
+		putTestFile(eft, name)
+	}
+
+	old_blocks := testItemBlocks(eft, large)
+
+	src := path.Join(src_dir, "a")
+	dst := path.Join(src_dir, "b")
+
+	err = eft.Move(src, path.Join(src, "sub", "c"))
+	if err == nil {
+		fmt.Println("Moved a directory into itself")
+		tt.Fail()
+	}
+
+	err = eft.Move(path.Join(src_dir, "nothing"), dst)
+	if err != ErrNotFound {
+		fmt.Println("Moved a missing item:", err)
+		tt.Fail()
+	}
+
+	err = eft.Move(src, dst)
+	if err != nil {
+		panic(err)
+	}
+
+	new_small := path.Join(dst, "small")
+	new_large := path.Join(dst, "sub", "large")
+
+	checkTestItem(tt, eft, new_small, testReadBytes(small))
+	checkTestItem(tt, eft, new_large, testReadBytes(large))
+
+	for _, name := range([]string{src, sub, small, large}) {
+		info, err := eft.GetInfo(name)
+		if err != nil || !info.IsTomb() {
+			fmt.Println("No tombstone at", name)
+			tt.Fail()
+		}
+	}
+
+	info, err := eft.GetInfo(path.Join(dst, "sub"))
+	if err != nil || info.Type != INFO_DIR {
+		fmt.Println("Subdirectory not moved")
+		tt.Fail()
+	}
+
+	// The data blocks are shared with the old item.
+	new_blocks := testItemBlocks(eft, new_large)
+
+	if len(new_blocks) != len(old_blocks) {
+		fmt.Println("Wrong number of data blocks after move")
+		tt.Fail()
+	}
+
+	for hash := range(new_blocks) {
+		if !old_blocks[hash] {
+			fmt.Println("Data block rewritten by move")
+			tt.Fail()
+		}
+	}
+
+	report, err := eft.Verify()
+	if err != nil {
+		panic(err)
+	}
+
+	if !report.OK() {
+		fmt.Println("Bad blocks after move:", report.Problems)
+		tt.Fail()
+	}
+}
@@ -0,0 +1,431 @@
+package eft
+
+// Overflow tables let a trie node absorb key collisions without
+// creating a new sub-trie block for each one.
+//
+// When two keys collide in a slot at depth dep, the slot is marked
+// TRIE_TYPE_OVRF and its entries are moved into one of the node's 16
+// overflow tables, selected by the high four bits of key[dep + 1].
+//
+// An overflow table is stored like a regular trie node, except that the
+// entries in its table are kept in no specific order. Each entry records
+// the slot it belongs to in its Resv byte.
+//
+// The OVRF slot entry has no block hash. Its Data field holds a bitmask
+// of the overflow tables containing its entries (bytes 0-2) and the
+// number of those entries (bytes 2-6).
+//
+// Once an overflow table is full, every slot with entries in that table
+// is pushed down into a sub-trie as usual.
+
+import (
+	"encoding/binary"
+	"bytes"
+)
+
+func ovrfIndex(key []byte, dep int) int {
+	return int(key[dep + 1] >> 4)
+}
+
+func (ent *TrieEntry) ovrfMask() uint16 {
+	return binary.LittleEndian.Uint16(ent.Data[0:2])
+}
+
+func (ent *TrieEntry) ovrfCount() uint32 {
+	return binary.LittleEndian.Uint32(ent.Data[2:6])
+}
+
+func (ent *TrieEntry) setOvrf(mask uint16, count uint32) {
+	binary.LittleEndian.PutUint16(ent.Data[0:2], mask)
+	binary.LittleEndian.PutUint32(ent.Data[2:6], count)
+}
+
+func (tn *TrieNode) canOverflow(key []byte) bool {
+	return tn.dep + 1 < len(key)
+}
+
+func (tn *TrieNode) isEmpty() bool {
+	for ii := 0; ii < 256; ii++ {
+		if tn.tab[ii].Type != TRIE_TYPE_NONE {
+			return false
+		}
+	}
+
+	for ii := 0; ii < 16; ii++ {
+		if tn.ovr[ii] != ZERO_HASH {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (tn *TrieNode) loadOverflow(oi int) (*TrieNode, error) {
+	ot := &TrieNode{
+		eft: tn.eft,
+		tri: tn.tri,
+		dep: tn.dep,
+	}
+
+	if tn.ovr[oi] == ZERO_HASH {
+		return ot, nil
+	}
+
+	err := ot.load(tn.ovr[oi])
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return ot, nil
+}
+
+func (tn *TrieNode) saveOverflow(oi int, ot *TrieNode) error {
+	if ot.isEmpty() {
+		tn.ovr[oi] = ZERO_HASH
+		return nil
+	}
+
+	hash, err := ot.save()
+	if err != nil {
+		return trace(err)
+	}
+
+	tn.ovr[oi] = hash
+	return nil
+}
+
+// Tries where keys share long prefixes can keep a later part of the key
+// as the partial key.
+type pkeyOffsetter interface {
+	pkeyOffset() int
+}
+
+func (tn *TrieNode) entryHasKey(ent TrieEntry, key []byte) (bool, error) {
+	// The partial key lets us skip most entries without loading them.
+	zero := [8]byte{}
+	poff := 0
+	if po, ok := tn.tri.(pkeyOffsetter); ok {
+		poff = po.pkeyOffset()
+	}
+
+	plen := len(ent.Pkey)
+	if len(key) < poff + plen {
+		plen = len(key) - poff
+	}
+
+	if ent.Pkey != zero && plen > 0 && !bytes.Equal(ent.Pkey[0:plen], key[poff:poff + plen]) {
+		return false, nil
+	}
+
+	key1, err := tn.tri.KeyBytes(ent)
+	if err != nil {
+		return false, trace(err)
+	}
+
+	return bytes.Equal(key, key1), nil
+}
+
+func (tn *TrieNode) findOverflow(key []byte) (TrieEntry, error) {
+	slot := key[tn.dep]
+
+	ot, err := tn.loadOverflow(ovrfIndex(key, tn.dep))
+	if err != nil {
+		return TrieEntry{}, trace(err)
+	}
+
+	for ii := 0; ii < 256; ii++ {
+		ent := ot.tab[ii]
+
+		if ent.Type != TRIE_TYPE_ITEM || ent.Resv != slot {
+			continue
+		}
+
+		found, err := tn.entryHasKey(ent, key)
+		if err != nil {
+			return TrieEntry{}, trace(err)
+		}
+
+		if found {
+			return ent, nil
+		}
+	}
+
+	return TrieEntry{}, ErrNotFound
+}
+
+func (tn *TrieNode) insertOverflow(key []byte, new_ent TrieEntry) error {
+	slot := key[tn.dep]
+	oi := ovrfIndex(key, tn.dep)
+
+	ot, err := tn.loadOverflow(oi)
+	if err != nil {
+		return trace(err)
+	}
+
+	new_ent.Type = TRIE_TYPE_ITEM
+	new_ent.Resv = slot
+
+	free := -1
+
+	for ii := 0; ii < 256; ii++ {
+		ent := ot.tab[ii]
+
+		if ent.Type == TRIE_TYPE_NONE {
+			if free < 0 {
+				free = ii
+			}
+			continue
+		}
+
+		if ent.Resv != slot {
+			continue
+		}
+
+		found, err := tn.entryHasKey(ent, key)
+		if err != nil {
+			return trace(err)
+		}
+
+		if found {
+			// Replace
+			ot.tab[ii] = new_ent
+			return tn.saveOverflow(oi, ot)
+		}
+	}
+
+	if free < 0 {
+		// Table is full; push its entries down and try again.
+		err = tn.spillOverflow(ot)
+		if err != nil {
+			return trace(err)
+		}
+
+		return tn.insert(key, new_ent)
+	}
+
+	ot.tab[free] = new_ent
+
+	err = tn.saveOverflow(oi, ot)
+	if err != nil {
+		return trace(err)
+	}
+
+	entry := tn.tab[slot]
+	entry.setOvrf(entry.ovrfMask() | (1 << uint(oi)), entry.ovrfCount() + 1)
+	tn.tab[slot] = entry
+
+	return nil
+}
+
+func (tn *TrieNode) removeOverflow(key []byte) error {
+	slot := key[tn.dep]
+	oi := ovrfIndex(key, tn.dep)
+
+	ot, err := tn.loadOverflow(oi)
+	if err != nil {
+		return trace(err)
+	}
+
+	removed := false
+	others := false
+
+	for ii := 0; ii < 256; ii++ {
+		ent := ot.tab[ii]
+
+		if ent.Type != TRIE_TYPE_ITEM || ent.Resv != slot {
+			continue
+		}
+
+		if !removed {
+			found, err := tn.entryHasKey(ent, key)
+			if err != nil {
+				return trace(err)
+			}
+
+			if found {
+				ot.tab[ii] = TrieEntry{}
+				removed = true
+				continue
+			}
+		}
+
+		others = true
+	}
+
+	if !removed {
+		return ErrNotFound
+	}
+
+	err = tn.saveOverflow(oi, ot)
+	if err != nil {
+		return trace(err)
+	}
+
+	entry := tn.tab[slot]
+	mask  := entry.ovrfMask()
+	count := entry.ovrfCount() - 1
+
+	if !others {
+		mask &^= (1 << uint(oi))
+	}
+
+	entry.setOvrf(mask, count)
+	tn.tab[slot] = entry
+
+	switch count {
+	case 0:
+		tn.tab[slot] = TrieEntry{}
+
+	case 1:
+		// A single remaining entry goes back in the main table.
+		rest, err := tn.takeOverflow(slot)
+		if err != nil {
+			return trace(err)
+		}
+
+		tn.tab[slot] = rest[0]
+	}
+
+	return nil
+}
+
+// Get the overflowed entries for a slot without modifying the node.
+func (tn *TrieNode) slotOverflow(slot uint8) ([]TrieEntry, error) {
+	return tn.collectOverflow(slot, false)
+}
+
+// Remove the overflowed entries for a slot from the overflow tables.
+// The slot entry itself is left for the caller to replace.
+func (tn *TrieNode) takeOverflow(slot uint8) ([]TrieEntry, error) {
+	return tn.collectOverflow(slot, true)
+}
+
+func (tn *TrieNode) collectOverflow(slot uint8, take bool) ([]TrieEntry, error) {
+	ents := make([]TrieEntry, 0)
+	mask := tn.tab[slot].ovrfMask()
+
+	for oi := 0; oi < 16; oi++ {
+		if mask & (1 << uint(oi)) == 0 {
+			continue
+		}
+
+		ot, err := tn.loadOverflow(oi)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		for ii := 0; ii < 256; ii++ {
+			ent := ot.tab[ii]
+
+			if ent.Type != TRIE_TYPE_ITEM || ent.Resv != slot {
+				continue
+			}
+
+			ent.Resv = 0
+			ents = append(ents, ent)
+
+			if take {
+				ot.tab[ii] = TrieEntry{}
+			}
+		}
+
+		if take {
+			err = tn.saveOverflow(oi, ot)
+			if err != nil {
+				return nil, trace(err)
+			}
+		}
+	}
+
+	if take {
+		tn.tab[slot].setOvrf(0, 0)
+	}
+
+	return ents, nil
+}
+
+func (tn *TrieNode) spillOverflow(ot *TrieNode) error {
+	slots := make(map[uint8]bool)
+
+	for ii := 0; ii < 256; ii++ {
+		if ot.tab[ii].Type == TRIE_TYPE_ITEM {
+			slots[ot.tab[ii].Resv] = true
+		}
+	}
+
+	for slot, _ := range(slots) {
+		err := tn.spillSlot(slot)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return nil
+}
+
+func (tn *TrieNode) spillSlot(slot uint8) error {
+	ents, err := tn.takeOverflow(slot)
+	if err != nil {
+		return trace(err)
+	}
+
+	next := tn.emptyChild()
+
+	for _, ent := range(ents) {
+		key, err := tn.tri.KeyBytes(ent)
+		if err != nil {
+			return trace(err)
+		}
+
+		err = next.insert(key, ent)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	next_hash, err := next.save()
+	if err != nil {
+		return trace(err)
+	}
+
+	tn.tab[slot] = TrieEntry{
+		Type: TRIE_TYPE_MORE,
+		Hash: next_hash,
+	}
+
+	return nil
+}
+
+func (tn *TrieNode) visitOverflow(fn func(ent *TrieEntry) error) error {
+	for oi := 0; oi < 16; oi++ {
+		if tn.ovr[oi] == ZERO_HASH {
+			continue
+		}
+
+		// The overflow table block itself.
+		err := fn(&TrieEntry{Type: TRIE_TYPE_OVRF, Hash: tn.ovr[oi]})
+		if err != nil {
+			return trace(err)
+		}
+
+		ot, err := tn.loadOverflow(oi)
+		if err != nil {
+			return trace(err)
+		}
+
+		for ii := 0; ii < 256; ii++ {
+			ent := &ot.tab[ii]
+
+			if ent.Type != TRIE_TYPE_ITEM {
+				continue
+			}
+
+			err := fn(ent)
+			if err != nil {
+				return trace(err)
+			}
+		}
+	}
+
+	return nil
+}
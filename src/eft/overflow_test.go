@@ -0,0 +1,220 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestOverflowLargeTrie(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	defer os.RemoveAll(eft_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	eft.Lock()
+	defer eft.Unlock()
+
+	eft.begin()
+	defer eft.commit()
+
+	trie := eft.newLargeTrie(ItemInfo{})
+
+	count := uint64(3000)
+	hashes := make(map[uint64][32]byte)
+
+	for ii := uint64(0); ii < count; ii++ {
+		hash := HashSlice(RandomBytes(16))
+		hashes[ii] = hash
+
+		err := trie.insert(ii, hash)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	for ii := uint64(0); ii < count; ii += 3 {
+		err := trie.remove(ii)
+		if err != nil {
+			panic(err)
+		}
+
+		delete(hashes, ii)
+	}
+
+	for ii := uint64(0); ii < count; ii++ {
+		hash, err := trie.find(ii)
+
+		want, ok := hashes[ii]
+		if !ok {
+			if err != ErrNotFound {
+				fmt.Println("Removed entry still found:", ii)
+				tt.Fail()
+			}
+			continue
+		}
+
+		if err != nil {
+			panic(err)
+		}
+
+		if hash != want {
+			fmt.Println("Wrong hash for entry", ii)
+			tt.Fail()
+		}
+	}
+
+	items := 0
+	err := trie.root.visitEachEntry(func(ent *TrieEntry) error {
+		if ent.Type == TRIE_TYPE_ITEM {
+			items++
+		}
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if items != len(hashes) {
+		fmt.Println("Visited", items, "entries, expected", len(hashes))
+		tt.Fail()
+	}
+}
+
+func TestOverflowSparsePathTrie(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	names := writeTestFiles(src_dir, 300)
+
+	for _, name := range(names) {
+		info, err := FastItemInfo(name)
+		if err != nil {
+			panic(err)
+		}
+
+		err = eft.Put(info, name)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	for _, name := range(names) {
+		_, err := eft.GetInfo(name)
+		if err != nil {
+			fmt.Println("Lookup failed for", name)
+			tt.Fail()
+		}
+	}
+
+	infos, err := eft.ListInfos()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(infos) != len(names) {
+		fmt.Println("Listed", len(infos), "items, expected", len(names))
+		tt.Fail()
+	}
+
+	// 300 random keys in a 256 entry table should fit in the overflow
+	// tables without creating any sub-tries.
+	eft.Lock()
+	pt, err := eft.loadPathTrie(eft.mainSnap().Root)
+	eft.Unlock()
+	if err != nil {
+		panic(err)
+	}
+
+	for ii := 0; ii < 256; ii++ {
+		if pt.root.tab[ii].Type == TRIE_TYPE_MORE {
+			fmt.Println("Unexpected sub-trie in slot", ii)
+			tt.Fail()
+		}
+	}
+}
+
+func TestOverflowMerge(tt *testing.T) {
+	eft0_dir := TmpRandomName()
+	eft1_dir := TmpRandomName()
+	src_dir  := TmpRandomName()
+
+	defer os.RemoveAll(eft0_dir)
+	defer os.RemoveAll(eft1_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft0 := &EFT{Key: [32]byte{}, Dir: eft0_dir}
+	eft1 := &EFT{Key: [32]byte{}, Dir: eft1_dir}
+
+	names := writeTestFiles(src_dir, 400)
+
+	for ii, name := range(names) {
+		info, err := FastItemInfo(name)
+		if err != nil {
+			panic(err)
+		}
+
+		trie := eft0
+		if ii % 2 == 1 {
+			trie = eft1
+		}
+
+		err = trie.Put(info, name)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	cp, err := eft1.MakeCheckpoint()
+	if err != nil {
+		panic(err)
+	}
+	cp.Commit()
+
+	err = eft0.FetchRemote(HexToHash(cp.Hash), testFetchFn(eft1))
+	if err != nil {
+		panic(err)
+	}
+
+	err = eft0.MergeRemote(HexToHash(cp.Hash))
+	if err != nil {
+		panic(err)
+	}
+
+	for _, name := range(names) {
+		_, err := eft0.GetInfo(name)
+		if err != nil {
+			fmt.Println("Merged lookup failed for", name)
+			tt.Fail()
+		}
+	}
+}
+
+func writeTestFiles(dir string, count int) []string {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	names := make([]string, 0)
+
+	for ii := 0; ii < count; ii++ {
+		name := path.Join(dir, fmt.Sprintf("file-%d.txt", ii))
+
+		err := ioutil.WriteFile(name, []byte(name), 0600)
+		if err != nil {
+			panic(err)
+		}
+
+		names = append(names, name)
+	}
+
+	return names
+}
@@ -0,0 +1,627 @@
+package eft
+
+// Keeps blocks in large append-only pack files rather than a file each.
+//
+// A pack is a sequence of fixed size records, each a 32 byte hash then
+// the block. Packs are numbered and only the newest one is written to;
+// a new pack is started once it has PACK_BLOCKS records.
+//
+// The index file is a log of 40 byte records (hash, pack, slot), read
+// into memory when the store is opened. A record with pack PACK_DELETED
+// removes the hash. Blocks are written to their pack before the index,
+// so after a crash any records at the end of the newest pack that aren't
+// in the index are added when the store is opened again.
+//
+// Deleting a block only drops it from the index. Compact copies the live
+// blocks out of packs that are mostly dead and removes those packs.
+//
+// Writes aren't synced to disk one by one. Anything that removes the only
+// other copy of a block, an old pack or a block in another store, calls
+// Sync first.
+
+import (
+	"encoding/binary"
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"path"
+	"sync"
+	"fmt"
+	"os"
+)
+
+var PACK_BLOCKS = uint32(4096) // 64MB packs
+var IMPORT_BATCH = 1024         // Blocks moved between syncs
+
+const PACK_DELETED = 0xFFFFFFFF
+const packRecSize = 32 + BLOCK_SIZE
+
+// Compact packs with at least this fraction of dead blocks.
+var PACK_COMPACT_DEAD = 0.5
+
+type packLoc struct {
+	pack uint32
+	slot uint32
+}
+
+type PackStore struct {
+	Dir string
+
+	index  map[[32]byte]packLoc // nil until loaded
+	counts map[uint32]uint32    // Records in each pack
+	curr   uint32               // Pack being written
+	logs   int                  // Records in the index file
+
+	pfile *os.File // Current pack
+	ifile *os.File // Index, for appending
+	mutex sync.Mutex
+}
+
+func NewPackStore(dir string) *PackStore {
+	return &PackStore{Dir: dir}
+}
+
+func (ps *PackStore) packPath(pack uint32) string {
+	return path.Join(ps.Dir, fmt.Sprintf("%08x.pack", pack))
+}
+
+func (ps *PackStore) indexPath() string {
+	return path.Join(ps.Dir, "index")
+}
+
+func (ps *PackStore) load() error {
+	if ps.index != nil {
+		return nil
+	}
+
+	err := os.MkdirAll(ps.Dir, 0700)
+	if err != nil {
+		return trace(err)
+	}
+
+	index := make(map[[32]byte]packLoc)
+	ps.counts = make(map[uint32]uint32)
+	ps.curr = 0
+	ps.logs = 0
+
+	ents, err := ioutil.ReadDir(ps.Dir)
+	if err != nil {
+		return trace(err)
+	}
+
+	for _, ent := range(ents) {
+		if !strings.HasSuffix(ent.Name(), ".pack") {
+			continue
+		}
+
+		num, err := strconv.ParseUint(strings.TrimSuffix(ent.Name(), ".pack"), 16, 32)
+		if err != nil {
+			continue
+		}
+
+		pack := uint32(num)
+		ps.counts[pack] = uint32(ent.Size() / packRecSize)
+
+		if pack > ps.curr {
+			ps.curr = pack
+		}
+	}
+
+	data, err := ioutil.ReadFile(ps.indexPath())
+	if err != nil && !os.IsNotExist(err) {
+		return trace(err)
+	}
+
+	be := binary.BigEndian
+	indexed := uint32(0) // Records of the current pack seen in the index
+
+	for ii := 0; ii + 40 <= len(data); ii += 40 {
+		hash := [32]byte{}
+		copy(hash[:], data[ii:ii + 32])
+
+		loc := packLoc{
+			pack: be.Uint32(data[ii + 32:ii + 36]),
+			slot: be.Uint32(data[ii + 36:ii + 40]),
+		}
+
+		if loc.pack == PACK_DELETED {
+			delete(index, hash)
+		} else {
+			index[hash] = loc
+		}
+
+		if loc.pack == ps.curr && loc.slot + 1 > indexed {
+			indexed = loc.slot + 1
+		}
+
+		ps.logs += 1
+	}
+
+	ps.index = index
+
+	err = ps.openFiles()
+	if err != nil {
+		ps.index = nil
+		return trace(err)
+	}
+
+	// Drops a partly written record, then indexes any whole ones the
+	// index missed.
+	err = ps.pfile.Truncate(int64(ps.counts[ps.curr]) * packRecSize)
+	if err != nil {
+		return trace(err)
+	}
+
+	for slot := indexed; slot < ps.counts[ps.curr]; slot++ {
+		hash := [32]byte{}
+		_, err = ps.pfile.ReadAt(hash[:], int64(slot) * packRecSize)
+		if err != nil {
+			return trace(err)
+		}
+
+		if _, ok := ps.index[hash]; ok {
+			continue
+		}
+
+		err = ps.setIndex(hash, packLoc{ps.curr, slot})
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return nil
+}
+
+func (ps *PackStore) openFiles() error {
+	var err error
+
+	flags := os.O_CREATE | os.O_RDWR
+	ps.pfile, err = os.OpenFile(ps.packPath(ps.curr), flags, 0600)
+	if err != nil {
+		return trace(err)
+	}
+
+	flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	ps.ifile, err = os.OpenFile(ps.indexPath(), flags, 0600)
+	if err != nil {
+		ps.pfile.Close()
+		return trace(err)
+	}
+
+	return nil
+}
+
+// Closes the open files. The store is loaded again when next used.
+func (ps *PackStore) Close() error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	return ps.close()
+}
+
+func (ps *PackStore) close() error {
+	if ps.index == nil {
+		return nil
+	}
+
+	ps.index = nil
+
+	err := ps.pfile.Close()
+	if err != nil {
+		ps.ifile.Close()
+		return trace(err)
+	}
+
+	return ps.ifile.Close()
+}
+
+func (ps *PackStore) setIndex(hash [32]byte, loc packLoc) error {
+	rec := make([]byte, 40)
+	copy(rec[0:32], hash[:])
+	binary.BigEndian.PutUint32(rec[32:36], loc.pack)
+	binary.BigEndian.PutUint32(rec[36:40], loc.slot)
+
+	_, err := ps.ifile.Write(rec)
+	if err != nil {
+		return trace(err)
+	}
+
+	ps.logs += 1
+
+	if loc.pack == PACK_DELETED {
+		delete(ps.index, hash)
+	} else {
+		ps.index[hash] = loc
+	}
+
+	return nil
+}
+
+func (ps *PackStore) Get(hash [32]byte) ([]byte, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	err := ps.load()
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	loc, ok := ps.index[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	return ps.read(loc)
+}
+
+func (ps *PackStore) read(loc packLoc) ([]byte, error) {
+	file := ps.pfile
+
+	if loc.pack != ps.curr {
+		var err error
+
+		file, err = os.Open(ps.packPath(loc.pack))
+		if err != nil {
+			return nil, trace(err)
+		}
+		defer file.Close()
+	}
+
+	ctxt := make([]byte, BLOCK_SIZE)
+
+	_, err := file.ReadAt(ctxt, int64(loc.slot) * packRecSize + 32)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return ctxt, nil
+}
+
+func (ps *PackStore) Put(hash [32]byte, ctxt []byte) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	err := ps.load()
+	if err != nil {
+		return trace(err)
+	}
+
+	// A block being replaced, for a repair, is written again.
+	loc, ok := ps.index[hash]
+	if ok {
+		old, err := ps.read(loc)
+		if err == nil && bytes.Equal(old, ctxt) {
+			return nil
+		}
+	}
+
+	return ps.write(hash, ctxt)
+}
+
+// Appends a block to the current pack, starting a new one if it's full.
+func (ps *PackStore) write(hash [32]byte, ctxt []byte) error {
+	if len(ctxt) != BLOCK_SIZE {
+		return fmt.Errorf("Bad block size: %d", len(ctxt))
+	}
+
+	if ps.counts[ps.curr] >= PACK_BLOCKS {
+		// Sync only covers the current pack.
+		err := ps.pfile.Sync()
+		if err != nil {
+			return trace(err)
+		}
+
+		err = ps.pfile.Close()
+		if err != nil {
+			return trace(err)
+		}
+
+		ps.curr += 1
+
+		flags := os.O_CREATE | os.O_RDWR
+		ps.pfile, err = os.OpenFile(ps.packPath(ps.curr), flags, 0600)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	slot := ps.counts[ps.curr]
+
+	rec := make([]byte, packRecSize)
+	copy(rec[0:32], hash[:])
+	copy(rec[32:], ctxt)
+
+	_, err := ps.pfile.WriteAt(rec, int64(slot) * packRecSize)
+	if err != nil {
+		return trace(err)
+	}
+
+	ps.counts[ps.curr] = slot + 1
+
+	return ps.setIndex(hash, packLoc{ps.curr, slot})
+}
+
+// Flushes the current pack and the index to disk.
+func (ps *PackStore) Sync() error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	err := ps.load()
+	if err != nil {
+		return trace(err)
+	}
+
+	return ps.sync()
+}
+
+func (ps *PackStore) sync() error {
+	err := ps.pfile.Sync()
+	if err != nil {
+		return trace(err)
+	}
+
+	err = ps.ifile.Sync()
+	if err != nil {
+		return trace(err)
+	}
+
+	// New packs need their directory entry synced too.
+	dir, err := os.Open(ps.Dir)
+	if err != nil {
+		return trace(err)
+	}
+	defer dir.Close()
+
+	err = dir.Sync()
+	if err != nil {
+		return trace(err)
+	}
+
+	return nil
+}
+
+func (ps *PackStore) Has(hash [32]byte) (bool, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	err := ps.load()
+	if err != nil {
+		return false, trace(err)
+	}
+
+	_, ok := ps.index[hash]
+	return ok, nil
+}
+
+func (ps *PackStore) Delete(hash [32]byte) error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	err := ps.load()
+	if err != nil {
+		return trace(err)
+	}
+
+	if _, ok := ps.index[hash]; !ok {
+		return ErrNotFound
+	}
+
+	return ps.setIndex(hash, packLoc{PACK_DELETED, 0})
+}
+
+// Works on a copy of the index, so fn can change the store.
+func (ps *PackStore) Iterate(fn func(hash [32]byte) error) error {
+	ps.mutex.Lock()
+
+	err := ps.load()
+	if err != nil {
+		ps.mutex.Unlock()
+		return trace(err)
+	}
+
+	hashes := make([][32]byte, 0, len(ps.index))
+	for hash := range(ps.index) {
+		hashes = append(hashes, hash)
+	}
+
+	ps.mutex.Unlock()
+
+	for _, hash := range(hashes) {
+		err := fn(hash)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return nil
+}
+
+// Rewrites packs that are mostly dead blocks, then the index if it's
+// mostly old records.
+func (ps *PackStore) Compact() error {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	err := ps.load()
+	if err != nil {
+		return trace(err)
+	}
+
+	live := make(map[uint32][][32]byte)
+	for hash, loc := range(ps.index) {
+		live[loc.pack] = append(live[loc.pack], hash)
+	}
+
+	// Copies can fill the current pack and start new ones. Those, and the
+	// pack that was current, hold blocks that aren't in live.
+	curr := ps.curr
+
+	counts := make(map[uint32]uint32)
+	for pack, count := range(ps.counts) {
+		if pack < curr {
+			counts[pack] = count
+		}
+	}
+
+	for pack, count := range(counts) {
+
+		dead := count - uint32(len(live[pack]))
+		if float64(dead) < PACK_COMPACT_DEAD * float64(count) {
+			continue
+		}
+
+		// The copies are indexed and on disk before the old pack goes away.
+		for _, hash := range(live[pack]) {
+			ctxt, err := ps.read(ps.index[hash])
+			if err != nil {
+				return trace(err)
+			}
+
+			err = ps.write(hash, ctxt)
+			if err != nil {
+				return trace(err)
+			}
+		}
+
+		err = ps.sync()
+		if err != nil {
+			return trace(err)
+		}
+
+		err = os.Remove(ps.packPath(pack))
+		if err != nil {
+			return trace(err)
+		}
+
+		delete(ps.counts, pack)
+	}
+
+	if ps.logs > 2 * len(ps.index) + int(PACK_BLOCKS) {
+		return ps.rewriteIndex()
+	}
+
+	return nil
+}
+
+func (ps *PackStore) rewriteIndex() error {
+	be := binary.BigEndian
+	data := make([]byte, 0, 40 * len(ps.index))
+
+	for hash, loc := range(ps.index) {
+		rec := make([]byte, 40)
+		copy(rec[0:32], hash[:])
+		be.PutUint32(rec[32:36], loc.pack)
+		be.PutUint32(rec[36:40], loc.slot)
+
+		data = append(data, rec...)
+	}
+
+	err := writeReplaceSync(ps.indexPath(), data)
+	if err != nil {
+		return trace(err)
+	}
+
+	err = ps.ifile.Close()
+	if err != nil {
+		return trace(err)
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	ps.ifile, err = os.OpenFile(ps.indexPath(), flags, 0600)
+	if err != nil {
+		ps.pfile.Close()
+		ps.index = nil
+		return trace(err)
+	}
+
+	ps.logs = len(ps.index)
+	return nil
+}
+
+// Moves the blocks of a per-file store into this one. Blocks are only
+// removed from the old store once a batch of them is synced to this one,
+// so this can be run again if it's interrupted.
+func (ps *PackStore) Import(ds *DirStore) (int, error) {
+	moved := 0
+	batch := make([][32]byte, 0, IMPORT_BATCH)
+
+	flush := func() error {
+		err := ps.Sync()
+		if err != nil {
+			return trace(err)
+		}
+
+		for _, hash := range(batch) {
+			err = ds.Delete(hash)
+			if err != nil {
+				return trace(err)
+			}
+		}
+
+		moved += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	err := ds.Iterate(func(hash [32]byte) error {
+		ctxt, err := ds.Get(hash)
+		if err != nil {
+			return trace(err)
+		}
+
+		err = ps.Put(hash, ctxt)
+		if err != nil {
+			return trace(err)
+		}
+
+		batch = append(batch, hash)
+		if len(batch) < IMPORT_BATCH {
+			return nil
+		}
+
+		return flush()
+	})
+	if err != nil {
+		return moved, trace(err)
+	}
+
+	err = flush()
+	if err != nil {
+		return moved, trace(err)
+	}
+
+	err = os.RemoveAll(ds.Dir)
+	if err != nil {
+		return moved, trace(err)
+	}
+
+	return moved, nil
+}
+
+// Like writeReplace, but the data is on disk before it replaces the file.
+func writeReplaceSync(name string, data []byte) error {
+	temp := name + ".tmp"
+
+	file, err := os.Create(temp)
+	if err != nil {
+		return trace(err)
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+
+	if err != nil {
+		return trace(err)
+	}
+
+	err = os.Rename(temp, name)
+	if err != nil {
+		return trace(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,258 @@
+package eft
+
+import (
+	"path/filepath"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestPackStore(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	save_blocks := PACK_BLOCKS
+	PACK_BLOCKS = 8
+	defer func() { PACK_BLOCKS = save_blocks }()
+
+	save_batch := IMPORT_BATCH
+	IMPORT_BATCH = 3
+	defer func() { IMPORT_BATCH = save_batch }()
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	small := path.Join(src_dir, "small")
+	large := path.Join(src_dir, "large")
+
+	err = ioutil.WriteFile(small, []byte("moved into a pack\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	err = ioutil.WriteFile(large, RandomBytes(10 * DATA_SIZE), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	// Start out with a block per file.
+	eft0 := &EFT{Key: [32]byte{}, Dir: eft_dir}
+	putTestFile(eft0, small)
+	putTestFile(eft0, large)
+
+	ps := NewPackStore(path.Join(eft_dir, "packs"))
+
+	moved, err := ps.Import(&DirStore{Dir: path.Join(eft_dir, "blocks")})
+	if err != nil {
+		panic(err)
+	}
+
+	err = ps.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = os.Stat(path.Join(eft_dir, "blocks"))
+	if moved == 0 || err == nil {
+		fmt.Println("Blocks not imported")
+		tt.Fail()
+	}
+
+	// The packs are found without setting a store.
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	checkTestItem(tt, eft, small, testReadBytes(small))
+	checkTestItem(tt, eft, large, testReadBytes(large))
+
+	for ii := 0; ii < 3; ii++ {
+		err = ioutil.WriteFile(large, RandomBytes(10 * DATA_SIZE), 0600)
+		if err != nil {
+			panic(err)
+		}
+
+		putTestFile(eft, large)
+		testCollect(eft)
+	}
+
+	packs, err := filepath.Glob(path.Join(eft_dir, "packs", "*.pack"))
+	if err != nil {
+		panic(err)
+	}
+
+	report, err := eft.Verify()
+	if err != nil {
+		panic(err)
+	}
+
+	if !report.OK() {
+		fmt.Println("Bad blocks in packs:", report.Problems)
+		tt.Fail()
+	}
+
+	// Only the current pack and packs less than half dead are left.
+	limit := 2 * (report.Blocks + 2) / int(PACK_BLOCKS) + 2
+	if len(packs) > limit {
+		fmt.Println("Packs not compacted:", len(packs), "for", report.Blocks, "blocks")
+		tt.Fail()
+	}
+
+	checkTestItem(tt, eft, large, testReadBytes(large))
+
+	// A block written to a pack but not the index is found again.
+	store := eft.Store.(*PackStore)
+
+	ctxt := EncryptBlock(RandomBytes(DATA_SIZE), eft.Key)
+	hash := HashSlice(ctxt)
+
+	err = store.Put(hash, ctxt)
+	if err != nil {
+		panic(err)
+	}
+
+	err = store.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	index := path.Join(eft_dir, "packs", "index")
+
+	sysi, err := os.Stat(index)
+	if err != nil {
+		panic(err)
+	}
+
+	err = os.Truncate(index, sysi.Size() - 40)
+	if err != nil {
+		panic(err)
+	}
+
+	ctxt1, err := store.Get(hash)
+	if err != nil || string(ctxt1) != string(ctxt) {
+		fmt.Println("Unindexed block not recovered")
+		tt.Fail()
+	}
+}
+
+func TestPackImportFailure(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	save_batch := IMPORT_BATCH
+	IMPORT_BATCH = 3
+	defer func() { IMPORT_BATCH = save_batch }()
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	large := path.Join(src_dir, "large")
+
+	err = ioutil.WriteFile(large, RandomBytes(10 * DATA_SIZE), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	eft0 := &EFT{Key: [32]byte{}, Dir: eft_dir}
+	putTestFile(eft0, large)
+
+	// A block file that can't be read stops the import partway.
+	ds := &DirStore{Dir: path.Join(eft_dir, "blocks")}
+	bad := ds.Path(HexToHash("ff" + strings.Repeat("00", 31)))
+
+	err = os.MkdirAll(bad, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	ps := NewPackStore(path.Join(eft_dir, "packs"))
+
+	moved, err := ps.Import(ds)
+	if err == nil {
+		fmt.Println("Import of a bad block succeeded")
+		tt.Fail()
+	}
+
+	if moved == 0 {
+		fmt.Println("No batches moved before the bad block")
+		tt.Fail()
+	}
+
+	// Every block can still be read through both stores.
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir, Store: &FallbackStore{Main: ps, Old: ds}}
+	checkTestItem(tt, eft, large, testReadBytes(large))
+
+	err = ps.Close()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestPackCompactRollover(tt *testing.T) {
+	save_blocks := PACK_BLOCKS
+	PACK_BLOCKS = 4
+	defer func() { PACK_BLOCKS = save_blocks }()
+
+	// Which packs get compacted first depends on map order.
+	for trial := 0; trial < 5; trial++ {
+		dir := TmpRandomName()
+		defer os.RemoveAll(dir)
+
+		ps := NewPackStore(dir)
+		blocks := make(map[[32]byte][]byte)
+
+		// Three full packs and one block in the fourth.
+		for ii := 0; ii < 13; ii++ {
+			ctxt := RandomBytes(BLOCK_SIZE)
+			hash := HashSlice(ctxt)
+
+			err := ps.Put(hash, ctxt)
+			if err != nil {
+				panic(err)
+			}
+
+			// Half of each full pack is dead, so compacting them
+			// fills the fourth pack and starts a fifth.
+			if ii < 12 && ii % 4 < 2 {
+				err = ps.Delete(hash)
+				if err != nil {
+					panic(err)
+				}
+				continue
+			}
+
+			blocks[hash] = ctxt
+		}
+
+		err := ps.Compact()
+		if err != nil {
+			panic(err)
+		}
+
+		for hash, ctxt := range(blocks) {
+			data, err := ps.Get(hash)
+			if err != nil || !bytes.Equal(data, ctxt) {
+				fmt.Println("Block lost in compaction:", err)
+				tt.Fail()
+				return
+			}
+		}
+
+		err = ps.Close()
+		if err != nil {
+			panic(err)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 
 type PathTrie struct {
 	root *TrieNode
+	dirs *DirTrie // Directory index, once loaded
 }
 
 func (pt *PathTrie) KeyBytes(ee TrieEntry) ([]byte, error) {
@@ -49,6 +50,15 @@ func (pt *PathTrie) Equals(pt1 *PathTrie) bool {
 }
 
 func (pt *PathTrie) save() ([32]byte, error) {
+	if pt.dirs != nil {
+		dirs_hash, err := pt.dirs.save()
+		if err != nil {
+			return dirs_hash, trace(err)
+		}
+
+		copy(pt.root.hdr[0:32], dirs_hash[:])
+	}
+
 	return pt.root.save()
 }
 
@@ -62,10 +72,37 @@ func (pt *PathTrie) insert(item_path string, data_hash [32]byte) error {
 
 	entry := TrieEntry{}
 	entry.Hash = data_hash
+	copy(entry.Pkey[:], path_hash[:])
+
+	dirs, err := pt.dirTrie()
+	if err != nil {
+		return trace(err)
+	}
+
+	err = dirs.insert(item_path, data_hash)
+	if err != nil {
+		return trace(err)
+	}
 
 	return pt.root.insert(path_hash[:], entry)
 }
 
+func (pt *PathTrie) remove(item_path string) error {
+	path_hash := HashString(item_path)
+
+	dirs, err := pt.dirTrie()
+	if err != nil {
+		return trace(err)
+	}
+
+	err = dirs.remove(item_path)
+	if err != nil && err != ErrNotFound {
+		return trace(err)
+	}
+
+	return pt.root.remove(path_hash[:])
+}
+
 func (eft *EFT) putTree(snap *Snapshot, info ItemInfo, data_hash [32]byte) ([32]byte, error) {
 	trie := eft.emptyPathTrie()
 
@@ -155,9 +192,26 @@ func (eft *EFT) delTree(snap *Snapshot, item_path string) ([32]byte, error) {
 }
 
 func (pt *PathTrie) visitEachBlock(fn func(hash [32]byte) error) error {
+	if pt.dirsHash() != ZERO_HASH {
+		err := fn(pt.dirsHash())
+		if err != nil {
+			return trace(err)
+		}
+
+		dirs, err := pt.dirTrie()
+		if err != nil {
+			return trace(err)
+		}
+
+		err = dirs.visitEachBlock(fn)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
 	return pt.root.visitEachEntry(func (ent *TrieEntry) error {
 		switch ent.Type {
-		case TRIE_TYPE_MORE:
+		case TRIE_TYPE_MORE, TRIE_TYPE_OVRF:
 			return fn(ent.Hash)
 
 		case TRIE_TYPE_ITEM:
@@ -177,35 +231,48 @@ func (pt *PathTrie) visitEachBlock(fn func(hash [32]byte) error) error {
 }
 
 func (eft *EFT) ListInfos() ([]ItemInfo, error) {
-	eft.Lock()
-	defer eft.Unlock()
+	rv, err := eft.View()
+	if err != nil {
+		return nil, trace(err)
+	}
+	defer rv.Close()
 
-	snap := eft.mainSnap()
+	return rv.ListInfos()
+}
 
-	pt, err := eft.loadPathTrie(snap.Root)
+func (eft *EFT) listInfos(snap *Snapshot) ([]ItemInfo, error) {
+	infos := make([]ItemInfo, 0)
+
+	err := eft.visitTree(snap, func(info ItemInfo, _ [32]byte) error {
+		infos = append(infos, info)
+		return nil
+	})
 	if err != nil {
 		return nil, trace(err)
 	}
 
-	infos := make([]ItemInfo, 0)
+	return infos, nil
+}
+
+// Calls fn with the info and item hash for each item in a snapshot.
+func (eft *EFT) visitTree(snap *Snapshot, fn func(info ItemInfo, hash [32]byte) error) error {
+	pt, err := eft.loadPathTrie(snap.Root)
+	if err != nil {
+		return trace(err)
+	}
 
-	err = pt.root.visitEachEntry(func (ent *TrieEntry) error {
+	return pt.root.visitEachEntry(func (ent *TrieEntry) error {
 		if ent.Type == TRIE_TYPE_ITEM {
 			info, err := eft.loadItemInfo(ent.Hash)
 			if err != nil {
 				return trace(err)
 			}
 
-			infos = append(infos, info)
+			return fn(info, ent.Hash)
 		}
 
 		return nil
 	})
-	if err != nil {
-		return nil, trace(err)
-	}
-
-	return infos, nil
 }
 
 func (pt *PathTrie) debugDump() {
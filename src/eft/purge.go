@@ -0,0 +1,259 @@
+package eft
+
+// Tombstones carry deletes to other devices, so they can't be dropped
+// while some device might still have the old item: a merge would bring
+// it back. Once every device has seen the delete, the tombstone only
+// takes up space and is purged.
+//
+// Devices say when they sync with SYN entries in the update log, written
+// with each checkpoint that changes the root and at least once a day.
+// The device that made a delete uploads it with its next SYN. We don't
+// know which device that was, so we wait until every known device has a
+// SYN after the delete, and then until every device has another SYN
+// after the last of those. By then each of them has merged the delete.
+//
+// Only devices with a SYN still in the log are known. A device that has
+// been away longer than the log keeps entries is forgotten, and when it
+// comes back anything it still has from before a purge is put back as
+// new. Purges are logged with PRG entries so merges don't skip them.
+
+import (
+	"sort"
+	"time"
+)
+
+const TOMB_KEEP = 7 * 24 * time.Hour
+const TOMB_SLOP = 6 * time.Hour // Clock differences and sync time
+const SYN_EVERY = 24 * time.Hour
+
+// Tombstones are only purged at a checkpoint while their delete is still
+// in the log, so a TombKeep longer than LogKeep needs PurgeTombstones.
+func (eft *EFT) tombKeep() time.Duration {
+	if eft.TombKeep == 0 {
+		return TOMB_KEEP
+	}
+	return eft.TombKeep
+}
+
+// Purges every tombstone that is old enough and seen by all known
+// devices, including ones whose delete has aged out of the log.
+func (eft *EFT) PurgeTombstones() (int, error) {
+	eft.Lock()
+	defer eft.Unlock()
+
+	eft.begin()
+
+	count, err := eft.purgeTombs(eft.mainSnap(), true)
+	if err != nil {
+		eft.abort()
+		return 0, trace(err)
+	}
+
+	eft.commit()
+	return count, nil
+}
+
+// Removes tombstones every device has seen. A checkpoint only looks at
+// paths deleted in the log, all looks through the whole tree.
+func (eft *EFT) purgeTombs(snap *Snapshot, all bool) (int, error) {
+	if snap.isEmpty() {
+		return 0, nil
+	}
+
+	ents, err := eft.loadLogEntries(snap.Log)
+	if err != nil {
+		return 0, trace(err)
+	}
+
+	syncs := logDeviceSyncs(ents)
+	if len(syncs) == 0 {
+		return 0, nil
+	}
+
+	cutoff := uint64(time.Now().Add(-eft.tombKeep()).UnixNano())
+
+	var names []string
+
+	if all {
+		err = eft.visitTree(snap, func(info ItemInfo, _ [32]byte) error {
+			if info.IsTomb() {
+				names = append(names, info.Path)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, trace(err)
+		}
+	} else {
+		names = logDeletedBefore(ents, cutoff)
+	}
+
+	trie, err := eft.loadPathTrie(snap.Root)
+	if err != nil {
+		return 0, trace(err)
+	}
+
+	purged := make([]LogEntry, 0)
+
+	for _, name := range(names) {
+		hash, err := trie.find(name)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, trace(err)
+		}
+
+		info, err := eft.loadItemInfo(hash)
+		if err != nil {
+			return 0, trace(err)
+		}
+
+		if !info.IsTomb() || info.ModT > cutoff || !syncs.seenSince(info.ModT) {
+			continue
+		}
+
+		err = trie.remove(name)
+		if err != nil {
+			return 0, trace(err)
+		}
+
+		purged = append(purged, newLogEntry(LOG_PRG, name))
+	}
+
+	if len(purged) == 0 {
+		return 0, nil
+	}
+
+	snap.Root, err = trie.save()
+	if err != nil {
+		return 0, trace(err)
+	}
+
+	err = eft.logEvents(snap, purged)
+	if err != nil {
+		return 0, trace(err)
+	}
+
+	return len(purged), nil
+}
+
+// Whether this device should say it's still syncing.
+func (eft *EFT) syncDue(ents []LogEntry) bool {
+	times := logDeviceSyncs(ents)[eft.Device]
+	if len(times) == 0 {
+		return true
+	}
+
+	last := timeFromUnix(times[len(times) - 1])
+	return time.Since(last) >= SYN_EVERY
+}
+
+// SYN times for each known device, oldest first.
+type deviceSyncs map[string][]uint64
+
+func logDeviceSyncs(ents []LogEntry) deviceSyncs {
+	syncs := make(deviceSyncs)
+
+	for _, ent := range(ents) {
+		if ent.Op == LOG_SYN {
+			syncs[ent.Arg] = append(syncs[ent.Arg], ent.Time)
+		}
+	}
+
+	for _, times := range(syncs) {
+		sort.Sort(syncTimes(times))
+	}
+
+	return syncs
+}
+
+// Whether every device has synced since the last first sync after tt.
+func (ds deviceSyncs) seenSince(tt uint64) bool {
+	if len(ds) == 0 {
+		return false
+	}
+
+	slop := uint64(TOMB_SLOP)
+	seen := uint64(0)
+
+	for _, times := range(ds) {
+		ii := sort.Search(len(times), func(ii int) bool {
+			return times[ii] >= tt + slop
+		})
+
+		if ii == len(times) {
+			return false
+		}
+
+		if times[ii] > seen {
+			seen = times[ii]
+		}
+	}
+
+	for _, times := range(ds) {
+		if times[len(times) - 1] < seen + slop {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Paths whose last log entry is a delete made before cutoff.
+func logDeletedBefore(ents []LogEntry, cutoff uint64) []string {
+	names := make([]string, 0)
+
+	for name, ent := range(logLatestEntries(ents)) {
+		if ent.Op == LOG_DEL && ent.Time <= cutoff {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Paths whose latest entry on either side of a merge is a purge.
+func logPurgedPaths(log0, log1 []LogEntry) []string {
+	ents := append(append([]LogEntry{}, log0...), log1...)
+	names := make([]string, 0)
+
+	for name, ent := range(logLatestEntries(ents)) {
+		if ent.Op == LOG_PRG {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// Removes a purged path from trie if it's still a tombstone there. An
+// item that was put back since the purge is kept.
+func (eft *EFT) dropPurged(trie *PathTrie, item_path string) error {
+	hash, err := trie.find(item_path)
+	if err == ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return trace(err)
+	}
+
+	info, err := eft.loadItemInfo(hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	if !info.IsTomb() {
+		return nil
+	}
+
+	return trie.remove(item_path)
+}
+
+type syncTimes []uint64
+
+func (st syncTimes) Len() int           { return len(st) }
+func (st syncTimes) Less(ii, jj int) bool { return st[ii] < st[jj] }
+func (st syncTimes) Swap(ii, jj int)      { st[ii], st[jj] = st[jj], st[ii] }
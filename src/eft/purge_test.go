@@ -0,0 +1,207 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestPurgeTombstones(tt *testing.T) {
+	src_dir := TmpRandomName()
+	defer os.RemoveAll(src_dir)
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	names := make([]string, 0)
+
+	for ii := 0; ii < 3; ii++ {
+		name := path.Join(src_dir, fmt.Sprintf("f%d", ii))
+		err = ioutil.WriteFile(name, []byte(fmt.Sprintf("file %d\n", ii)), 0600)
+		if err != nil {
+			panic(err)
+		}
+
+		names = append(names, name)
+	}
+
+	// Only eft0 is old enough to purge, so eft1 gets it by merging.
+	eft0 := &EFT{Key: [32]byte{}, Dir: TmpRandomName(), Device: "a"}
+	eft1 := &EFT{Key: [32]byte{}, Dir: TmpRandomName(), Device: "b"}
+
+	eft0.TombKeep = time.Nanosecond
+	eft1.TombKeep = 1000 * time.Hour
+
+	defer os.RemoveAll(eft0.Dir)
+	defer os.RemoveAll(eft1.Dir)
+
+	putTestFile(eft0, names[0])
+	putTestFile(eft0, names[1])
+
+	syncTestEFTs(eft0, eft1)
+	syncTestEFTs(eft1, eft0)
+
+	err = eft0.Del(names[0])
+	if err != nil {
+		panic(err)
+	}
+
+	syncTestEFTs(eft0, eft1)
+	syncTestEFTs(eft1, eft0)
+
+	info, err := eft1.GetInfo(names[0])
+	if err != nil || !info.IsTomb() {
+		fmt.Println("Delete didn't reach the other EFT")
+		tt.Fail()
+	}
+
+	del_t := info.ModT
+	hour := uint64(time.Hour)
+
+	// Both devices have synced once since the delete, but b hasn't
+	// synced after a did.
+	testLogSyncs(eft0, "a", del_t + 7 * hour, del_t + 14 * hour)
+	testLogSyncs(eft0, "b", del_t + 8 * hour)
+	testCollect(eft0)
+
+	info, err = eft0.GetInfo(names[0])
+	if err != nil || !info.IsTomb() {
+		fmt.Println("Tombstone purged before every device saw it")
+		tt.Fail()
+	}
+
+	testLogSyncs(eft0, "b", del_t + 15 * hour)
+	testCollect(eft0)
+
+	_, err = eft0.GetInfo(names[0])
+	if err != ErrNotFound {
+		fmt.Println("Tombstone not purged:", err)
+		tt.Fail()
+	}
+
+	infos, err := eft0.ListDir(src_dir)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(infos) != 1 || infos[0].Path != names[1] {
+		fmt.Println("Purged item still listed:", infos)
+		tt.Fail()
+	}
+
+	// The purge survives a merge with local changes on the other side.
+	putTestFile(eft1, names[2])
+
+	syncTestEFTs(eft0, eft1)
+	syncTestEFTs(eft1, eft0)
+
+	for _, eft := range([]*EFT{eft0, eft1}) {
+		_, err = eft.GetInfo(names[0])
+		if err != ErrNotFound {
+			fmt.Println("Purged tombstone came back:", err)
+			tt.Fail()
+		}
+
+		checkTestItem(tt, eft, names[1], testReadBytes(names[1]))
+		checkTestItem(tt, eft, names[2], testReadBytes(names[2]))
+
+		report, err := eft.Verify()
+		if err != nil {
+			panic(err)
+		}
+
+		if !report.OK() {
+			fmt.Println("Bad blocks after purge:", report.Problems)
+			tt.Fail()
+		}
+	}
+}
+
+func TestPurgeMergeNoBase(tt *testing.T) {
+	src_dir := TmpRandomName()
+	defer os.RemoveAll(src_dir)
+
+	names := writeTestFiles(src_dir, 3)
+
+	eft0 := &EFT{Key: [32]byte{}, Dir: TmpRandomName(), Device: "a"}
+	eft1 := &EFT{Key: [32]byte{}, Dir: TmpRandomName(), Device: "b"}
+
+	eft0.TombKeep = time.Nanosecond
+	eft1.TombKeep = 1000 * time.Hour
+
+	defer os.RemoveAll(eft0.Dir)
+	defer os.RemoveAll(eft1.Dir)
+
+	// Both EFTs delete the same file without ever having synced, so
+	// the first merge has no base and no common checkpoint.
+	putTestFile(eft0, names[0])
+	putTestFile(eft0, names[1])
+
+	putTestFile(eft1, names[0])
+	putTestFile(eft1, names[2])
+
+	err := eft1.Del(names[0])
+	if err != nil {
+		panic(err)
+	}
+
+	err = eft0.Del(names[0])
+	if err != nil {
+		panic(err)
+	}
+
+	info, err := eft0.GetInfo(names[0])
+	if err != nil {
+		panic(err)
+	}
+
+	hour := uint64(time.Hour)
+
+	testLogSyncs(eft0, "a", info.ModT + 7 * hour, info.ModT + 14 * hour)
+	testCollect(eft0)
+
+	_, err = eft0.GetInfo(names[0])
+	if err != ErrNotFound {
+		fmt.Println("Tombstone not purged:", err)
+		tt.Fail()
+	}
+
+	syncTestEFTs(eft0, eft1)
+	syncTestEFTs(eft1, eft0)
+
+	for _, eft := range([]*EFT{eft0, eft1}) {
+		_, err = eft.GetInfo(names[0])
+		if err != ErrNotFound {
+			fmt.Println("Purged tombstone came back in merge without base:", err)
+			tt.Fail()
+		}
+
+		checkTestItem(tt, eft, names[1], testReadBytes(names[1]))
+		checkTestItem(tt, eft, names[2], testReadBytes(names[2]))
+	}
+}
+
+func testLogSyncs(eft *EFT, device string, times ...uint64) {
+	eft.Lock()
+	defer eft.Unlock()
+
+	eft.begin()
+
+	ents := make([]LogEntry, 0)
+	for _, tt := range(times) {
+		ents = append(ents, LogEntry{Time: tt, Op: LOG_SYN, Arg: device})
+	}
+
+	err := eft.logEvents(eft.mainSnap(), ents)
+	if err != nil {
+		eft.abort()
+		panic(err)
+	}
+
+	eft.commit()
+}
@@ -0,0 +1,606 @@
+package eft
+
+// Incremental garbage collection.
+//
+// Each block's reference count is the number of live blocks that point to
+// it, plus one for each time it is a root. A checkpoint adds references
+// from the new roots and drops the ones from the roots counted last time.
+// A block whose count goes from zero to one has its own references added;
+// one whose count drops to zero is dead, and its references are dropped in
+// turn. This only touches blocks that were written or became unreachable
+// since the last checkpoint.
+//
+// Blocks written since then that nothing points to are found from the
+// added list. Anything else, like blocks fetched for a merge that were
+// never used, is left for the full mark and sweep in garbage.go. That runs
+// when the counts are missing or older than GC_FULL_EVERY, and rebuilds
+// them.
+//
+// Counts are stored in refs/XX, one file per first hash byte, as 36 byte
+// records (hash, big-endian uint32 count). refs/roots lists the roots that
+// were counted, and refs/checkpoint the snapshot list saved by the last
+// checkpoint. refs/valid holds the time of the last full collection, and
+// is removed while the other files are rewritten so a crash forces a full
+// collection.
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"bufio"
+	"path"
+	"time"
+	"fmt"
+	"os"
+)
+
+var GC_FULL_EVERY = 7 * 24 * time.Hour
+
+// What a block holds, which says how to find the blocks it refers to.
+const (
+	REF_DATA = iota
+	REF_SNAPS
+	REF_LOG
+	REF_PATH
+	REF_DIR
+	REF_ITEM
+	REF_LARGE
+)
+
+type blockRef struct {
+	kind int
+	hash [32]byte
+}
+
+type refCounts struct {
+	eft    *EFT
+	shards map[byte]map[[32]byte]uint32
+	dirty  map[byte]bool
+	dead   map[[32]byte]bool
+}
+
+func (eft *EFT) refsPath(name string) string {
+	return path.Join(eft.Dir, "refs", name)
+}
+
+func (eft *EFT) newRefCounts() *refCounts {
+	return &refCounts{
+		eft:    eft,
+		shards: make(map[byte]map[[32]byte]uint32),
+		dirty:  make(map[byte]bool),
+		dead:   make(map[[32]byte]bool),
+	}
+}
+
+// Forces the next checkpoint to do a full mark and sweep.
+func (eft *EFT) RequestFullCollect() error {
+	err := os.Remove(eft.refsPath("valid"))
+	if err != nil && !os.IsNotExist(err) {
+		return trace(err)
+	}
+
+	return nil
+}
+
+// Checks that the stored counts can be trusted for an incremental pass.
+func (eft *EFT) refsCurrent() bool {
+	text, err := ioutil.ReadFile(eft.refsPath("valid"))
+	if err != nil {
+		return false
+	}
+
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(text)), 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return time.Since(time.Unix(secs, 0)) < GC_FULL_EVERY
+}
+
+func (rc *refCounts) shard(bb byte) (map[[32]byte]uint32, error) {
+	counts, ok := rc.shards[bb]
+	if ok {
+		return counts, nil
+	}
+
+	counts = make(map[[32]byte]uint32)
+
+	data, err := ioutil.ReadFile(rc.eft.refsPath(fmt.Sprintf("%02x", bb)))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, trace(err)
+	}
+
+	for ii := 0; ii + 36 <= len(data); ii += 36 {
+		hash := [32]byte{}
+		copy(hash[:], data[ii:ii + 32])
+		counts[hash] = binary.BigEndian.Uint32(data[ii + 32:ii + 36])
+	}
+
+	rc.shards[bb] = counts
+	return counts, nil
+}
+
+func (rc *refCounts) get(hash [32]byte) (uint32, error) {
+	counts, err := rc.shard(hash[0])
+	if err != nil {
+		return 0, trace(err)
+	}
+
+	return counts[hash], nil
+}
+
+func (rc *refCounts) set(hash [32]byte, count uint32) error {
+	counts, err := rc.shard(hash[0])
+	if err != nil {
+		return trace(err)
+	}
+
+	if count == 0 {
+		delete(counts, hash)
+	} else {
+		counts[hash] = count
+	}
+
+	rc.dirty[hash[0]] = true
+	return nil
+}
+
+func (rc *refCounts) inc(ref blockRef) error {
+	count, err := rc.get(ref.hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	err = rc.set(ref.hash, count + 1)
+	if err != nil {
+		return trace(err)
+	}
+
+	delete(rc.dead, ref.hash)
+
+	if count > 0 {
+		return nil
+	}
+
+	kids, err := rc.eft.refChildren(ref)
+	if err != nil {
+		return trace(err)
+	}
+
+	for _, kid := range(kids) {
+		err = rc.inc(kid)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return nil
+}
+
+func (rc *refCounts) dec(ref blockRef) error {
+	count, err := rc.get(ref.hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	if count == 0 {
+		return fmt.Errorf("Reference count underflow for %s", HashToHex(ref.hash))
+	}
+
+	err = rc.set(ref.hash, count - 1)
+	if err != nil {
+		return trace(err)
+	}
+
+	if count > 1 {
+		return nil
+	}
+
+	rc.dead[ref.hash] = true
+
+	kids, err := rc.eft.refChildren(ref)
+	if err != nil {
+		return trace(err)
+	}
+
+	for _, kid := range(kids) {
+		err = rc.dec(kid)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return nil
+}
+
+func (rc *refCounts) save(roots []blockRef, full_time int64) error {
+	err := os.MkdirAll(path.Join(rc.eft.Dir, "refs"), 0700)
+	if err != nil {
+		return trace(err)
+	}
+
+	err = rc.eft.RequestFullCollect()
+	if err != nil {
+		return trace(err)
+	}
+
+	for bb := range(rc.dirty) {
+		counts := rc.shards[bb]
+		data := make([]byte, 0, 36 * len(counts))
+
+		for hash, count := range(counts) {
+			var cbytes [4]byte
+			binary.BigEndian.PutUint32(cbytes[:], count)
+
+			data = append(data, hash[:]...)
+			data = append(data, cbytes[:]...)
+		}
+
+		err = writeReplace(rc.eft.refsPath(fmt.Sprintf("%02x", bb)), data)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	text := ""
+	for _, root := range(roots) {
+		text += fmt.Sprintf("%d %s\n", root.kind, HashToHex(root.hash))
+	}
+
+	err = writeReplace(rc.eft.refsPath("roots"), []byte(text))
+	if err != nil {
+		return trace(err)
+	}
+
+	valid := fmt.Sprintf("%d\n", full_time)
+	return writeReplace(rc.eft.refsPath("valid"), []byte(valid))
+}
+
+func writeReplace(name string, data []byte) error {
+	temp := name + ".tmp"
+
+	err := ioutil.WriteFile(temp, data, 0600)
+	if err != nil {
+		return trace(err)
+	}
+
+	err = os.Rename(temp, name)
+	if err != nil {
+		return trace(err)
+	}
+
+	return nil
+}
+
+func (eft *EFT) loadRefRoots() ([]blockRef, error) {
+	text, err := ioutil.ReadFile(eft.refsPath("roots"))
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	roots := make([]blockRef, 0)
+
+	for _, line := range(strings.Split(string(text), "\n")) {
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			continue
+		}
+
+		kind, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		roots = append(roots, blockRef{kind, HexToHash(parts[1])})
+	}
+
+	return roots, nil
+}
+
+// The roots are the saved snapshot list, the snapshots of the transaction
+// about to be committed, and the last synced root.
+func (eft *EFT) refRoots() ([]blockRef, error) {
+	roots := make([]blockRef, 0)
+
+	hash, err := eft.loadSnapsHash()
+	if err != nil && err != ErrNotFound {
+		return nil, trace(err)
+	}
+	if err == nil {
+		roots = append(roots, blockRef{REF_SNAPS, hash})
+	}
+
+	roots = append(roots, snapsRefs(eft.Snaps)...)
+
+	synced, err := eft.loadSyncedHash()
+	if err != nil && err != ErrNotFound {
+		return nil, trace(err)
+	}
+	if err == nil {
+		roots = append(roots, blockRef{REF_SNAPS, synced})
+	}
+
+	for _, pinned := range(eft.pinnedRoots()) {
+		roots = append(roots, blockRef{REF_SNAPS, pinned})
+	}
+
+	return roots, nil
+}
+
+func snapsRefs(snaps []Snapshot) []blockRef {
+	refs := make([]blockRef, 0)
+
+	for _, snap := range(snaps) {
+		if !snap.isEmpty() {
+			refs = append(refs, blockRef{REF_PATH, snap.Root})
+		}
+
+		if snap.Log != ZERO_HASH {
+			refs = append(refs, blockRef{REF_LOG, snap.Log})
+		}
+	}
+
+	return refs
+}
+
+// Gets the blocks a block refers to.
+func (eft *EFT) refChildren(ref blockRef) ([]blockRef, error) {
+	switch ref.kind {
+	case REF_DATA:
+		return []blockRef{}, nil
+
+	case REF_SNAPS:
+		snaps, err := eft.loadSnapsFrom(ref.hash)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		return snapsRefs(snaps), nil
+
+	case REF_LOG:
+		ul, err := eft.loadLog(ref.hash)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		refs := make([]blockRef, 0)
+		for _, sb := range(ul.sealed) {
+			refs = append(refs, blockRef{REF_DATA, sb.Hash})
+		}
+
+		return refs, nil
+
+	case REF_PATH, REF_DIR, REF_LARGE:
+		tn := &TrieNode{eft: eft}
+
+		err := tn.load(ref.hash)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		return tn.refChildren(ref.kind), nil
+
+	case REF_ITEM:
+		refs := make([]blockRef, 0)
+
+		data, err := eft.loadBlock(ref.hash)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		spill := infoSpill(data[0:INFO_SIZE])
+		if spill != ZERO_HASH {
+			refs = append(refs, blockRef{REF_DATA, spill})
+		}
+
+		info, err := eft.infoFromBytes(data[0:INFO_SIZE])
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		if info.Size <= SMALL_MAX {
+			return refs, nil
+		}
+
+		tn := &TrieNode{eft: eft}
+
+		err = tn.load(ref.hash)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		return append(refs, tn.refChildren(REF_LARGE)...), nil
+	}
+
+	return nil, fmt.Errorf("Unknown block kind: %d", ref.kind)
+}
+
+// Children of a trie node or overflow table, given the kind of trie.
+func (tn *TrieNode) refChildren(kind int) []blockRef {
+	refs := make([]blockRef, 0)
+
+	item_kind := REF_ITEM
+	if kind == REF_LARGE {
+		item_kind = REF_DATA
+	}
+
+	if kind == REF_PATH {
+		// Only set in the root node.
+		pt := PathTrie{root: tn}
+		if pt.dirsHash() != ZERO_HASH {
+			refs = append(refs, blockRef{REF_DIR, pt.dirsHash()})
+		}
+	}
+
+	for _, ent := range(tn.tab) {
+		switch ent.Type {
+		case TRIE_TYPE_MORE:
+			refs = append(refs, blockRef{kind, ent.Hash})
+		case TRIE_TYPE_ITEM:
+			refs = append(refs, blockRef{item_kind, ent.Hash})
+		}
+	}
+
+	for _, hash := range(tn.ovr) {
+		if hash != ZERO_HASH {
+			refs = append(refs, blockRef{kind, hash})
+		}
+	}
+
+	return refs
+}
+
+// Blocks written since the last checkpoint, including the current
+// transaction.
+func (eft *EFT) addedBlocks() ([][32]byte, error) {
+	hashes := make([][32]byte, 0)
+
+	for _, name := range([]string{path.Join(eft.Dir, "added"), eft.addedName}) {
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		scan := bufio.NewScanner(file)
+		for scan.Scan() {
+			line := strings.TrimSpace(scan.Text())
+			if len(line) == 64 {
+				hashes = append(hashes, HexToHash(line))
+			}
+		}
+
+		err = scan.Err()
+		file.Close()
+		if err != nil {
+			return nil, trace(err)
+		}
+	}
+
+	return hashes, nil
+}
+
+func (eft *EFT) collectIncremental() (string, error) {
+	old_roots, err := eft.loadRefRoots()
+	if err != nil {
+		return "", trace(err)
+	}
+
+	new_roots, err := eft.refRoots()
+	if err != nil {
+		return "", trace(err)
+	}
+
+	full_time, err := ioutil.ReadFile(eft.refsPath("valid"))
+	if err != nil {
+		return "", trace(err)
+	}
+
+	rc := eft.newRefCounts()
+
+	// Add first, so nothing still in use drops to zero on the way.
+	for _, root := range(new_roots) {
+		err = rc.inc(root)
+		if err != nil {
+			return "", trace(err)
+		}
+	}
+
+	for _, root := range(old_roots) {
+		err = rc.dec(root)
+		if err != nil {
+			return "", trace(err)
+		}
+	}
+
+	added, err := eft.addedBlocks()
+	if err != nil {
+		return "", trace(err)
+	}
+
+	// The snapshot list saved by the last checkpoint was written after
+	// its added list was taken.
+	last, err := eft.loadHashFile("refs/checkpoint")
+	if err == nil {
+		added = append(added, last)
+	}
+
+	for _, hash := range(added) {
+		count, err := rc.get(hash)
+		if err != nil {
+			return "", trace(err)
+		}
+
+		if count == 0 {
+			rc.dead[hash] = true
+		}
+	}
+
+	dead_name := eft.TempName()
+	dead, err := os.Create(dead_name)
+	if err != nil {
+		return "", trace(err)
+	}
+	defer dead.Close()
+
+	for hash := range(rc.dead) {
+		// Blocks from an aborted checkpoint may be gone already.
+		have, err := eft.store().Has(hash)
+		if err != nil {
+			return "", trace(err)
+		}
+		if !have {
+			continue
+		}
+
+		_, err = dead.Write([]byte(hex.EncodeToString(hash[:]) + "\n"))
+		if err != nil {
+			return "", trace(err)
+		}
+	}
+
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(full_time)), 10, 64)
+	if err != nil {
+		return "", trace(err)
+	}
+
+	err = rc.save(new_roots, secs)
+	if err != nil {
+		return "", trace(err)
+	}
+
+	err = eft.removeBlocks(dead)
+	if err != nil {
+		return "", trace(err)
+	}
+
+	return dead_name, nil
+}
+
+// Counts references from scratch, after a full collection.
+func (eft *EFT) rebuildRefs() error {
+	err := os.RemoveAll(path.Join(eft.Dir, "refs"))
+	if err != nil {
+		return trace(err)
+	}
+
+	roots, err := eft.refRoots()
+	if err != nil {
+		return trace(err)
+	}
+
+	rc := eft.newRefCounts()
+
+	for _, root := range(roots) {
+		err = rc.inc(root)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return rc.save(roots, time.Now().Unix())
+}
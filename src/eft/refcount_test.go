@@ -0,0 +1,124 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"strings"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestIncrementalCollect(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	small := path.Join(src_dir, "small")
+	large := path.Join(src_dir, "large")
+
+	err = ioutil.WriteFile(small, []byte("short lived\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	err = ioutil.WriteFile(large, RandomBytes(3 * DATA_SIZE), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, small)
+	putTestFile(eft, large)
+
+	// The first collection is a full one, which sets up the counts.
+	testCollect(eft)
+
+	if !eft.refsCurrent() {
+		fmt.Println("No reference counts after full collection")
+		tt.Fail()
+	}
+
+	old_blocks := testItemBlocks(eft, large)
+
+	err = ioutil.WriteFile(large, RandomBytes(3 * DATA_SIZE), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, large)
+
+	err = eft.Del(small)
+	if err != nil {
+		panic(err)
+	}
+
+	dels := testCollect(eft)
+
+	for hash := range(old_blocks) {
+		_, err := os.Stat(eft.BlockPath(hash))
+		if err == nil || !strings.Contains(dels, HashToHex(hash)) {
+			fmt.Println("Old block not collected")
+			tt.Fail()
+		}
+	}
+
+	report, err := eft.Verify()
+	if err != nil {
+		panic(err)
+	}
+
+	if !report.OK() {
+		fmt.Println("Incremental collection removed live blocks:", report.Problems)
+		tt.Fail()
+	}
+
+	// A full collection should only find the snapshot list and log the
+	// last checkpoint replaced, which are kept for one more round.
+	err = eft.RequestFullCollect()
+	if err != nil {
+		panic(err)
+	}
+
+	dels = testCollect(eft)
+
+	if len(strings.Fields(dels)) > 2 {
+		fmt.Println("Incremental collection missed blocks:", dels)
+		tt.Fail()
+	}
+
+	checkTestItem(tt, eft, large, testReadBytes(large))
+}
+
+// Makes a checkpoint and returns its list of deleted blocks.
+func testCollect(eft *EFT) string {
+	cp, err := eft.MakeCheckpoint()
+	if err != nil {
+		panic(err)
+	}
+	defer cp.Commit()
+
+	dels, err := ioutil.ReadFile(cp.Dels)
+	if err != nil {
+		panic(err)
+	}
+
+	return string(dels)
+}
+
+func testReadBytes(name string) []byte {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
@@ -0,0 +1,69 @@
+package eft
+
+// A local EFT can lose or damage blocks that are safe in the cloud. Repair
+// finds the bad blocks with the same walk as Verify and fetches fresh copies
+// through a FetchFn, which checks them with saveEncBlock.
+//
+// Replacing a broken trie node can uncover more blocks below it, so this
+// repeats until nothing new turns up.
+
+import (
+	"sync/atomic"
+)
+
+func (eft *EFT) setDamaged(damaged bool) {
+	if damaged {
+		atomic.StoreInt32(&eft.damaged, 1)
+	} else {
+		atomic.StoreInt32(&eft.damaged, 0)
+	}
+}
+
+// Reports if a block has failed to load since the last Repair.
+func (eft *EFT) Damaged() bool {
+	return atomic.LoadInt32(&eft.damaged) != 0
+}
+
+// Returns the problems that couldn't be fixed, if any.
+func (eft *EFT) Repair(fetch_fn FetchFn) (VerifyReport, error) {
+	eft.Lock()
+	defer eft.Unlock()
+
+	tried := make(map[[32]byte]bool)
+
+	for {
+		report, err := eft.verify()
+		if err != nil {
+			return report, trace(err)
+		}
+
+		bs, err := eft.NewBlockSet()
+		if err != nil {
+			return report, trace(err)
+		}
+
+		for _, prob := range(report.Problems) {
+			if tried[prob.Hash] {
+				continue
+			}
+			tried[prob.Hash] = true
+
+			err = bs.Add(prob.Hash)
+			if err != nil {
+				return report, trace(err)
+			}
+		}
+
+		if bs.Size() == 0 {
+			// Either everything is good or the remote doesn't have
+			// the rest.
+			eft.setDamaged(false)
+			return report, nil
+		}
+
+		err = eft.fetchBlocks(bs, fetch_fn)
+		if err != nil {
+			return report, trace(err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestRepair(tt *testing.T) {
+	eft0_dir := TmpRandomName()
+	eft1_dir := TmpRandomName()
+	src_dir  := TmpRandomName()
+
+	defer os.RemoveAll(eft0_dir)
+	defer os.RemoveAll(eft1_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft0 := &EFT{Key: [32]byte{}, Dir: eft0_dir}
+	eft1 := &EFT{Key: [32]byte{}, Dir: eft1_dir}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	name := path.Join(src_dir, "large")
+	data := RandomBytes(5 * DATA_SIZE)
+
+	err = ioutil.WriteFile(name, data, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	// eft0 plays the cloud.
+	putTestFile(eft0, name)
+	syncTestEFTs(eft0, eft1)
+
+	bad := make([][32]byte, 0)
+	for hash := range(testItemBlocks(eft1, name)) {
+		bad = append(bad, hash)
+	}
+
+	err = ioutil.WriteFile(eft1.BlockPath(bad[0]), RandomBytes(BLOCK_SIZE), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	err = os.Remove(eft1.BlockPath(bad[1]))
+	if err != nil {
+		panic(err)
+	}
+
+	temp := eft1.TempName()
+	defer os.Remove(temp)
+
+	_, err = eft1.Get(name, temp)
+	if err == nil || !eft1.Damaged() {
+		fmt.Println("Damage not detected")
+		tt.Fail()
+	}
+
+	report, err := eft1.Repair(testFetchFn(eft0))
+	if err != nil {
+		panic(err)
+	}
+
+	if !report.OK() || eft1.Damaged() {
+		fmt.Println("Repair failed:", report.Problems)
+		tt.Fail()
+	}
+
+	checkTestItem(tt, eft1, name, data)
+}
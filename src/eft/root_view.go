@@ -0,0 +1,251 @@
+package eft
+
+// A RootView reads the EFT as of one committed snapshot list without
+// taking the EFT lock, so reads aren't held up by a long transaction like
+// a checkpoint that's being uploaded.
+//
+// Blocks are never changed once written, so the only thing that could
+// break a view is garbage collection. While a view is open its root is
+// pinned, and collections in this process treat pinned roots like the
+// saved snapshot list. Views must be closed to let their blocks go.
+//
+// The snaps file is replaced atomically on commit, so a view always sees
+// a whole root. Changes committed after the view is opened aren't seen.
+// Key rotation switches keys and deletes every old block, so it waits for
+// open views and readers to close, and new views wait until it's done.
+
+import (
+	"encoding/hex"
+	"path"
+	"time"
+	"fmt"
+	"os"
+)
+
+var VIEW_WAIT = 50 * time.Millisecond
+
+type RootView struct {
+	eft   *EFT
+	Hash  [32]byte // Snapshot list, zero for an empty EFT
+	Snaps []Snapshot
+}
+
+// Opens a view of the last committed root.
+func (eft *EFT) View() (*RootView, error) {
+	for {
+		hash, err := eft.loadSnapsHash()
+		if err != nil && err != ErrNotFound {
+			return nil, trace(err)
+		}
+
+		if !eft.pinView(hash) {
+			time.Sleep(VIEW_WAIT)
+			continue
+		}
+
+		// A root replaced before it was pinned may be collected at any
+		// time, so make sure it's still the current one.
+		hash1, err := eft.loadSnapsHash()
+		if err != nil && err != ErrNotFound {
+			eft.unpin(hash)
+			return nil, trace(err)
+		}
+
+		if hash1 != hash {
+			eft.unpin(hash)
+			continue
+		}
+
+		rv := &RootView{eft: eft, Hash: hash}
+
+		if hash == ZERO_HASH {
+			rv.Snaps, _ = eft.defaultSnapsList()
+			return rv, nil
+		}
+
+		rv.Snaps, err = eft.loadSnapsFrom(hash)
+		if err != nil {
+			eft.unpin(hash)
+			return nil, trace(err)
+		}
+
+		return rv, nil
+	}
+}
+
+func (rv *RootView) Close() error {
+	if rv.eft != nil {
+		rv.eft.unpin(rv.Hash)
+		rv.eft = nil
+	}
+
+	return nil
+}
+
+func (rv *RootView) RootHash() string {
+	return hex.EncodeToString(rv.Hash[:])
+}
+
+func (rv *RootView) mainSnap() *Snapshot {
+	return &rv.Snaps[0]
+}
+
+func (rv *RootView) Get(name string, dst_path string) (ItemInfo, error) {
+	err := os.MkdirAll(path.Dir(dst_path), 0755)
+	if err != nil {
+		return ItemInfo{}, trace(err)
+	}
+
+	return rv.eft.getItem(rv.mainSnap(), name, dst_path)
+}
+
+func (rv *RootView) GetInfo(name string) (ItemInfo, error) {
+	info, _, err := rv.eft.getTree(rv.mainSnap(), name)
+	if err != nil {
+		return info, err
+	}
+
+	return info, nil
+}
+
+func (rv *RootView) ListInfos() ([]ItemInfo, error) {
+	return rv.eft.listInfos(rv.mainSnap())
+}
+
+func (rv *RootView) ListDir(dir string) ([]ItemInfo, error) {
+	snap := rv.mainSnap()
+	if snap.isEmpty() {
+		return []ItemInfo{}, nil
+	}
+
+	return rv.eft.listDir(snap, path.Clean("/" + dir))
+}
+
+func (rv *RootView) snapAt(idx int) (*Snapshot, error) {
+	if idx < 0 || idx >= len(rv.Snaps) {
+		return nil, fmt.Errorf("No snapshot at index %d", idx)
+	}
+
+	return &rv.Snaps[idx], nil
+}
+
+func (rv *RootView) GetAt(snap_idx int, name string, dst_path string) (ItemInfo, error) {
+	snap, err := rv.snapAt(snap_idx)
+	if err != nil {
+		return ItemInfo{}, err
+	}
+
+	err = os.MkdirAll(path.Dir(dst_path), 0755)
+	if err != nil {
+		return ItemInfo{}, trace(err)
+	}
+
+	return rv.eft.getItem(snap, name, dst_path)
+}
+
+func (rv *RootView) ListInfosAt(snap_idx int) ([]ItemInfo, error) {
+	snap, err := rv.snapAt(snap_idx)
+	if err != nil {
+		return nil, err
+	}
+
+	return rv.eft.listInfos(snap)
+}
+
+// Opens an item for reading. The reader has its own pin on the root, so
+// it can outlive the view.
+func (rv *RootView) Open(name string) (*ItemReader, error) {
+	info, hash, err := rv.eft.getTree(rv.mainSnap(), name)
+	if err != nil {
+		return nil, err // Could be ErrNotFound
+	}
+
+	ir, err := rv.eft.openItem(info, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	rv.eft.pin(rv.Hash)
+	ir.root = rv.Hash
+	ir.pinned = true
+
+	return ir, nil
+}
+
+func (eft *EFT) pin(hash [32]byte) {
+	eft.smutex.Lock()
+	defer eft.smutex.Unlock()
+
+	if eft.pins == nil {
+		eft.pins = make(map[[32]byte]int)
+	}
+
+	eft.pins[hash] += 1
+}
+
+// Pins a root for a new view, unless views are held.
+func (eft *EFT) pinView(hash [32]byte) bool {
+	eft.smutex.Lock()
+	defer eft.smutex.Unlock()
+
+	if eft.held {
+		return false
+	}
+
+	if eft.pins == nil {
+		eft.pins = make(map[[32]byte]int)
+	}
+
+	eft.pins[hash] += 1
+	return true
+}
+
+// Makes new views wait, then waits for the open ones to close.
+func (eft *EFT) holdViews() {
+	eft.smutex.Lock()
+	eft.held = true
+	eft.smutex.Unlock()
+
+	for {
+		eft.smutex.Lock()
+		open := len(eft.pins)
+		eft.smutex.Unlock()
+
+		if open == 0 {
+			return
+		}
+
+		time.Sleep(VIEW_WAIT)
+	}
+}
+
+func (eft *EFT) releaseViews() {
+	eft.smutex.Lock()
+	eft.held = false
+	eft.smutex.Unlock()
+}
+
+func (eft *EFT) unpin(hash [32]byte) {
+	eft.smutex.Lock()
+	defer eft.smutex.Unlock()
+
+	eft.pins[hash] -= 1
+	if eft.pins[hash] <= 0 {
+		delete(eft.pins, hash)
+	}
+}
+
+// Roots with open views, for garbage collection.
+func (eft *EFT) pinnedRoots() [][32]byte {
+	eft.smutex.Lock()
+	defer eft.smutex.Unlock()
+
+	roots := make([][32]byte, 0, len(eft.pins))
+	for hash := range(eft.pins) {
+		if hash != ZERO_HASH {
+			roots = append(roots, hash)
+		}
+	}
+
+	return roots
+}
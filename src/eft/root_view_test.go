@@ -0,0 +1,251 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"strings"
+	"bytes"
+	"time"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestRootView(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	large := path.Join(src_dir, "large")
+
+	data0 := RandomBytes(3 * DATA_SIZE)
+	err = ioutil.WriteFile(large, data0, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, large)
+
+	rv, err := eft.View()
+	if err != nil {
+		panic(err)
+	}
+
+	old_blocks := testItemBlocks(eft, large)
+
+	err = ioutil.WriteFile(large, RandomBytes(3 * DATA_SIZE), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, large)
+
+	if rv.RootHash() == eft.RootHash1() {
+		fmt.Println("View followed the update")
+		tt.Fail()
+	}
+
+	// The old root survives collections while it's pinned.
+	testCollect(eft)
+	testCollect(eft)
+
+	temp := eft.TempName()
+	defer os.Remove(temp)
+
+	_, err = rv.Get(large, temp)
+	if err != nil {
+		panic(err)
+	}
+
+	if !bytes.Equal(testReadBytes(temp), data0) {
+		fmt.Println("Wrong content in view")
+		tt.Fail()
+	}
+
+	checkTestItem(tt, eft, large, testReadBytes(large))
+
+	// Reads don't wait for the lock.
+	eft.Lock()
+
+	done := make(chan error)
+	go func() {
+		_, err := eft.GetInfo(large)
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			panic(err)
+		}
+	case <-time.After(10 * time.Second):
+		fmt.Println("GetInfo blocked on the lock")
+		tt.Fail()
+	}
+
+	eft.Unlock()
+
+	err = rv.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	testCollect(eft)
+	testCollect(eft)
+
+	for hash := range(old_blocks) {
+		have, err := eft.store().Has(hash)
+		if err != nil {
+			panic(err)
+		}
+
+		if have {
+			fmt.Println("Block of closed view not collected")
+			tt.Fail()
+		}
+	}
+}
+
+func TestCheckpointUnlocked(tt *testing.T) {
+	src_dir := TmpRandomName()
+	defer os.RemoveAll(src_dir)
+
+	names := writeTestFiles(src_dir, 2)
+
+	eft := &EFT{Key: [32]byte{}, Dir: TmpRandomName()}
+	defer os.RemoveAll(eft.Dir)
+
+	putTestFile(eft, names[0])
+
+	cp, err := eft.MakeCheckpoint()
+	if err != nil {
+		panic(err)
+	}
+
+	// The EFT can change while the checkpoint is uploaded.
+	done := make(chan bool)
+	go func() {
+		putTestFile(eft, names[1])
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		fmt.Println("Put blocked by open checkpoint")
+		tt.Fail()
+		return
+	}
+
+	temp := eft.TempName()
+	defer os.Remove(temp)
+
+	_, err = eft.GetAt(0, names[1], temp)
+	if err != nil {
+		panic(err)
+	}
+
+	infos, err := eft.ListInfosAt(0)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(infos) != 2 {
+		fmt.Println("Wrong items listed:", len(infos))
+		tt.Fail()
+	}
+
+	// An aborted checkpoint's blocks go out with the next one.
+	cp.Abort()
+
+	cp, err = eft.MakeCheckpoint()
+	if err != nil {
+		panic(err)
+	}
+	defer cp.Commit()
+
+	adds, err := ioutil.ReadFile(cp.Adds)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, name := range(names) {
+		for hash := range(testItemBlocks(eft, name)) {
+			if !strings.Contains(string(adds), HashToHex(hash)) {
+				fmt.Println("Block missing from added list for", name)
+				tt.Fail()
+			}
+		}
+	}
+}
+
+func TestRotateWaitsForViews(tt *testing.T) {
+	src_dir := TmpRandomName()
+	defer os.RemoveAll(src_dir)
+
+	names := writeTestFiles(src_dir, 1)
+
+	eft := &EFT{Key: [32]byte{}, Dir: TmpRandomName()}
+	defer os.RemoveAll(eft.Dir)
+
+	putTestFile(eft, names[0])
+
+	rv, err := eft.View()
+	if err != nil {
+		panic(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- eft.RotateKey(HashString("new key"), ZERO_HASH)
+	}()
+
+	select {
+	case <-done:
+		fmt.Println("Rotation didn't wait for the open view")
+		tt.Fail()
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	temp := eft.TempName()
+	defer os.Remove(temp)
+
+	_, err = rv.Get(names[0], temp)
+	if err != nil {
+		panic(err)
+	}
+
+	if !bytes.Equal(testReadBytes(temp), testReadBytes(names[0])) {
+		fmt.Println("Wrong content in view during rotation")
+		tt.Fail()
+	}
+
+	rv.Close()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			panic(err)
+		}
+	case <-time.After(10 * time.Second):
+		fmt.Println("Rotation still waiting after the view closed")
+		tt.Fail()
+		return
+	}
+
+	err = eft.FinishKeyRotation()
+	if err != nil {
+		panic(err)
+	}
+
+	checkTestItem(tt, eft, names[0], testReadBytes(names[0]))
+}
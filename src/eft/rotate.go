@@ -0,0 +1,468 @@
+package eft
+
+// Key rotation re-encrypts every block reachable from the snapshot list
+// under a new key. Block hashes are of the ciphertext, so every block
+// that refers to another has to be rewritten too, from the leaves up.
+//
+// Progress is kept in the "rotate" file as one "old new" hash pair per
+// rewritten block, following a line that identifies the new key. A block's
+// contents never change, so after a crash the pairs are still good even if
+// the tree was changed in between, and RotateKey picks up where it left
+// off when called again with the same key.
+//
+// Once the new snapshot list is saved the EFT switches keys, the blocks
+// under the old key are removed, and the new blocks are put in the added
+// list so the next checkpoint uploads all of them. Open views would go on
+// reading old blocks with the new key, so the switch waits for them, and
+// for a checkpoint that's still being uploaded. The last synced root
+// is dropped since the remote doesn't have it under the new key. The
+// progress file stays until FinishKeyRotation, so the caller can save the
+// new key before the record of the rotation goes away.
+//
+// A device that hasn't seen the new key can still upload under the old
+// one. MergeOldKey brings such a root over.
+
+import (
+	"io/ioutil"
+	"strings"
+	"path"
+	"fmt"
+	"os"
+)
+
+type keyRotation struct {
+	src  *EFT // Under the old key
+	dst  *EFT // Under the new key, same directory and store
+	done map[[32]byte][32]byte
+	prog *os.File
+}
+
+func (eft *EFT) rotatePath() string {
+	return path.Join(eft.Dir, "rotate")
+}
+
+func rotateCheck(key [32]byte) string {
+	return HashToHex(HashSlice(append(key[:], []byte("rotate")...)))
+}
+
+func (eft *EFT) RotateKey(new_key [32]byte, nonce_key [32]byte) error {
+	eft.cmutex.Lock()
+	defer eft.cmutex.Unlock()
+
+	eft.Lock()
+	defer eft.Unlock()
+
+	snaps_hash, err := eft.loadSnapsHash()
+	if err == ErrNotFound {
+		eft.Key = new_key
+		eft.NonceKey = nonce_key
+		return nil
+	}
+	if err != nil {
+		return trace(err)
+	}
+
+	kr, err := eft.openRotation(new_key, nonce_key)
+	if err != nil {
+		return trace(err)
+	}
+	defer kr.close()
+
+	// Already switched, but maybe not cleaned up.
+	_, err = kr.dst.loadBlock(snaps_hash)
+	if err == nil {
+		eft.holdViews()
+		defer eft.releaseViews()
+
+		return kr.finish()
+	}
+
+	new_hash, err := kr.rotate(blockRef{REF_SNAPS, snaps_hash})
+	if err != nil {
+		return trace(err)
+	}
+
+	eft.holdViews()
+	defer eft.releaseViews()
+
+	err = eft.saveSnapsHash(new_hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	return kr.finish()
+}
+
+// Removes the progress file, once the caller has saved the new key.
+func (eft *EFT) FinishKeyRotation() error {
+	err := os.Remove(eft.rotatePath())
+	if err != nil && !os.IsNotExist(err) {
+		return trace(err)
+	}
+
+	return nil
+}
+
+// Merges a root that another device uploaded under the old key before it
+// saw the rotation. Its blocks are fetched into a scratch EFT and rotated
+// into this one. The synced root isn't an ancestor of it, so the merge
+// goes by the update logs, which still share the checkpoints from before.
+func (eft *EFT) MergeOldKey(old_key, old_nonce, hash [32]byte, fetch_fn FetchFn) error {
+	old := &EFT{
+		Key: old_key,
+		Dir: eft.TempName(),
+
+		Convergent: eft.Convergent,
+		NonceKey:   old_nonce,
+	}
+	defer os.RemoveAll(old.Dir)
+
+	err := old.FetchRemote(hash, fetch_fn)
+	if err != nil {
+		return trace(err)
+	}
+
+	eft.Lock()
+	defer eft.Unlock()
+
+	eft.begin()
+
+	kr := &keyRotation{
+		src:  old,
+		dst:  eft,
+		done: make(map[[32]byte][32]byte),
+	}
+
+	kr.prog, err = os.Create(old.rotatePath())
+	if err != nil {
+		eft.abort()
+		return trace(err)
+	}
+	defer kr.prog.Close()
+
+	new_hash, err := kr.rotate(blockRef{REF_SNAPS, hash})
+	if err != nil {
+		eft.abort()
+		return trace(err)
+	}
+
+	err = eft.mergeRemote(new_hash, false)
+	if err != nil {
+		eft.abort()
+		return trace(err)
+	}
+
+	return nil
+}
+
+func (eft *EFT) openRotation(new_key [32]byte, nonce_key [32]byte) (*keyRotation, error) {
+	dst := &EFT{
+		Key:   new_key,
+		Dir:   eft.Dir,
+		Store: eft.store(),
+
+		Convergent: eft.Convergent,
+		NonceKey:   nonce_key,
+	}
+
+	kr := &keyRotation{
+		src:  eft,
+		dst:  dst,
+		done: make(map[[32]byte][32]byte),
+	}
+
+	check := rotateCheck(new_key)
+
+	text, err := ioutil.ReadFile(eft.rotatePath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, trace(err)
+	}
+
+	lines := strings.Split(string(text), "\n")
+
+	if len(text) > 0 && strings.TrimSpace(lines[0]) != "key " + check {
+		return nil, fmt.Errorf("Unfinished rotation to a different key")
+	}
+
+	for _, line := range(lines[1:]) {
+		parts := strings.Fields(line)
+		if len(parts) != 2 || len(parts[0]) != 64 || len(parts[1]) != 64 {
+			continue
+		}
+
+		kr.done[HexToHash(parts[0])] = HexToHash(parts[1])
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	kr.prog, err = os.OpenFile(eft.rotatePath(), flags, 0600)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	if len(text) == 0 {
+		_, err = kr.prog.WriteString("key " + check + "\n")
+		if err != nil {
+			kr.prog.Close()
+			return nil, trace(err)
+		}
+	}
+
+	// New blocks are listed in finish, so this list is only needed
+	// for saveBlock.
+	dst.addedName = eft.TempName()
+	dst.added, err = os.Create(dst.addedName)
+	if err != nil {
+		kr.prog.Close()
+		return nil, trace(err)
+	}
+
+	return kr, nil
+}
+
+func (kr *keyRotation) close() {
+	kr.prog.Close()
+	kr.dst.added.Close()
+	os.Remove(kr.dst.addedName)
+}
+
+// Rewrites a block and everything below it, returning the new hash.
+func (kr *keyRotation) rotate(ref blockRef) ([32]byte, error) {
+	if ref.hash == ZERO_HASH {
+		return ZERO_HASH, nil
+	}
+
+	new_hash, ok := kr.done[ref.hash]
+	if ok {
+		return new_hash, nil
+	}
+
+	var err error
+
+	switch ref.kind {
+	case REF_DATA:
+		new_hash, err = kr.rotateData(ref.hash)
+	case REF_SNAPS:
+		new_hash, err = kr.rotateSnaps(ref.hash)
+	case REF_LOG:
+		new_hash, err = kr.rotateLog(ref.hash)
+	case REF_PATH, REF_DIR, REF_LARGE:
+		new_hash, err = kr.rotateNode(ref.hash, ref.kind, false)
+	case REF_ITEM:
+		new_hash, err = kr.rotateItem(ref.hash)
+	default:
+		err = fmt.Errorf("Unknown block kind: %d", ref.kind)
+	}
+	if err != nil {
+		return new_hash, trace(err)
+	}
+
+	_, err = kr.prog.WriteString(HashToHex(ref.hash) + " " + HashToHex(new_hash) + "\n")
+	if err != nil {
+		return new_hash, trace(err)
+	}
+
+	kr.done[ref.hash] = new_hash
+	return new_hash, nil
+}
+
+// Data blocks are resealed as they are. Compressed data is more than
+// DATA_SIZE, so saveBlock compresses it again.
+func (kr *keyRotation) rotateData(hash [32]byte) ([32]byte, error) {
+	data, err := kr.src.loadBlock(hash)
+	if err != nil {
+		return ZERO_HASH, trace(err)
+	}
+
+	new_hash, err := kr.dst.saveBlock(data)
+	if err != nil {
+		return ZERO_HASH, trace(err)
+	}
+
+	return new_hash, nil
+}
+
+func (kr *keyRotation) rotateSnaps(hash [32]byte) ([32]byte, error) {
+	data, err := kr.src.loadBlock(hash)
+	if err != nil {
+		return ZERO_HASH, trace(err)
+	}
+
+	for ii := 0; ii < SNAPS_PER_BLOCK; ii++ {
+		base := ii * SNAP_SIZE
+
+		err = kr.rotateAt(data[base:base + 32], REF_PATH)
+		if err != nil {
+			return ZERO_HASH, trace(err)
+		}
+
+		err = kr.rotateAt(data[base + 32:base + 64], REF_LOG)
+		if err != nil {
+			return ZERO_HASH, trace(err)
+		}
+	}
+
+	return kr.dst.saveBlock(data)
+}
+
+func (kr *keyRotation) rotateLog(hash [32]byte) ([32]byte, error) {
+	ul, err := kr.src.loadLog(hash)
+	if err != nil {
+		return ZERO_HASH, trace(err)
+	}
+
+	for ii := range(ul.sealed) {
+		ul.sealed[ii].Hash, err = kr.rotate(blockRef{REF_DATA, ul.sealed[ii].Hash})
+		if err != nil {
+			return ZERO_HASH, trace(err)
+		}
+	}
+
+	ul.eft = kr.dst
+	return ul.save()
+}
+
+// Item blocks for large items are the root node of their trie, with the
+// item header in place of the node header.
+func (kr *keyRotation) rotateItem(hash [32]byte) ([32]byte, error) {
+	data, err := kr.src.loadBlock(hash)
+	if err != nil {
+		return ZERO_HASH, trace(err)
+	}
+
+	info, err := kr.src.infoFromBytes(data[0:INFO_SIZE])
+	if err != nil {
+		return ZERO_HASH, trace(err)
+	}
+
+	if info.Size > SMALL_MAX {
+		return kr.rotateNode(hash, REF_LARGE, true)
+	}
+
+	err = kr.rotateSpill(data[0:INFO_SIZE])
+	if err != nil {
+		return ZERO_HASH, trace(err)
+	}
+
+	return kr.dst.saveBlock(data)
+}
+
+func (kr *keyRotation) rotateSpill(hdr []byte) error {
+	if infoSpill(hdr) == ZERO_HASH {
+		return nil
+	}
+
+	return kr.rotateAt(hdr[64:96], REF_DATA)
+}
+
+func (kr *keyRotation) rotateNode(hash [32]byte, kind int, is_item bool) ([32]byte, error) {
+	tn := &TrieNode{eft: kr.src}
+
+	err := tn.load(hash)
+	if err != nil {
+		return ZERO_HASH, trace(err)
+	}
+
+	// The path trie root holds the directory index.
+	if kind == REF_PATH {
+		err = kr.rotateAt(tn.hdr[0:32], REF_DIR)
+		if err != nil {
+			return ZERO_HASH, trace(err)
+		}
+	}
+
+	if is_item {
+		err = kr.rotateSpill(tn.hdr[0:INFO_SIZE])
+		if err != nil {
+			return ZERO_HASH, trace(err)
+		}
+	}
+
+	item_kind := REF_ITEM
+	if kind == REF_LARGE {
+		item_kind = REF_DATA
+	}
+
+	for ii := range(tn.tab) {
+		ent := &tn.tab[ii]
+
+		switch ent.Type {
+		case TRIE_TYPE_MORE:
+			ent.Hash, err = kr.rotate(blockRef{kind, ent.Hash})
+		case TRIE_TYPE_ITEM:
+			ent.Hash, err = kr.rotate(blockRef{item_kind, ent.Hash})
+		}
+		if err != nil {
+			return ZERO_HASH, trace(err)
+		}
+	}
+
+	for oi := range(tn.ovr) {
+		tn.ovr[oi], err = kr.rotate(blockRef{kind, tn.ovr[oi]})
+		if err != nil {
+			return ZERO_HASH, trace(err)
+		}
+	}
+
+	tn.eft = kr.dst
+	return tn.save()
+}
+
+// Replaces a hash stored in a block with its rotated version.
+func (kr *keyRotation) rotateAt(field []byte, kind int) error {
+	hash := [32]byte{}
+	copy(hash[:], field)
+
+	new_hash, err := kr.rotate(blockRef{kind, hash})
+	if err != nil {
+		return trace(err)
+	}
+
+	copy(field, new_hash[:])
+	return nil
+}
+
+// Switches to the new key once the new snapshot list is saved.
+func (kr *keyRotation) finish() error {
+	eft := kr.src
+
+	eft.Key = kr.dst.Key
+	eft.NonceKey = kr.dst.NonceKey
+
+	err := os.Remove(path.Join(eft.Dir, "synced"))
+	if err != nil && !os.IsNotExist(err) {
+		return trace(err)
+	}
+
+	// The counts are of the old blocks.
+	err = os.RemoveAll(path.Join(eft.Dir, "refs"))
+	if err != nil {
+		return trace(err)
+	}
+
+	adds_name := eft.TempName()
+	adds, err := os.Create(adds_name)
+	if err != nil {
+		return trace(err)
+	}
+	defer os.Remove(adds_name)
+	defer adds.Close()
+
+	for old_hash, new_hash := range(kr.done) {
+		err = eft.store().Delete(old_hash)
+		if err != nil && err != ErrNotFound {
+			return trace(err)
+		}
+
+		_, err = adds.WriteString(HashToHex(new_hash) + "\n")
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	err = adds.Close()
+	if err != nil {
+		return trace(err)
+	}
+
+	return appendFile(path.Join(eft.Dir, "added"), adds_name)
+}
@@ -0,0 +1,254 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestRotateKey(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	old_key := [32]byte{}
+	eft := &EFT{Key: old_key, Dir: eft_dir, Compress: true}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	small := path.Join(src_dir, "small")
+	large := path.Join(src_dir, "large")
+	plain := path.Join(src_dir, "plain")
+
+	err = ioutil.WriteFile(small, []byte("a small file\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	// Compresses well, so it's stored in packed blocks.
+	packed := make([]byte, 5 * DATA_SIZE)
+	for ii := range(packed) {
+		packed[ii] = byte(ii % 7)
+	}
+
+	err = ioutil.WriteFile(large, packed, 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, small)
+
+	_, err = eft.TakeSnapshot("before large")
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, large)
+
+	eft.Compress = false
+
+	err = ioutil.WriteFile(plain, RandomBytes(3 * DATA_SIZE), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, plain)
+
+	old_blocks := make(map[[32]byte]bool)
+	for _, name := range([]string{small, large, plain}) {
+		for hash := range(testItemBlocks(eft, name)) {
+			old_blocks[hash] = true
+		}
+	}
+
+	new_key := HashString("new key")
+
+	// Rotate part of the tree, as if interrupted.
+	eft.Lock()
+	kr, err := eft.openRotation(new_key, ZERO_HASH)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = kr.rotate(blockRef{REF_PATH, eft.mainSnap().Root})
+	if err != nil {
+		panic(err)
+	}
+
+	kr.close()
+	eft.Unlock()
+
+	err = eft.RotateKey(new_key, ZERO_HASH)
+	if err != nil {
+		panic(err)
+	}
+
+	if eft.Key != new_key {
+		fmt.Println("Key not switched")
+		tt.Fail()
+	}
+
+	for hash := range(old_blocks) {
+		_, err := os.Stat(eft.BlockPath(hash))
+		if err == nil {
+			fmt.Println("Old block not removed")
+			tt.Fail()
+		}
+	}
+
+	report, err := eft.Verify()
+	if err != nil {
+		panic(err)
+	}
+
+	if !report.OK() {
+		fmt.Println("Problems after rotation:", report.Problems)
+		tt.Fail()
+	}
+
+	checkTestItem(tt, eft, small, testReadBytes(small))
+	checkTestItem(tt, eft, large, packed)
+	checkTestItem(tt, eft, plain, testReadBytes(plain))
+
+	infos, err := eft.ListInfosAt(1)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(infos) != 1 || infos[0].Path != small {
+		fmt.Println("Snapshot lost in rotation")
+		tt.Fail()
+	}
+
+	// A restart before the caller saved the new key tries again with
+	// the old one.
+	eft.Key = old_key
+
+	err = eft.RotateKey(new_key, ZERO_HASH)
+	if err != nil {
+		panic(err)
+	}
+
+	checkTestItem(tt, eft, small, testReadBytes(small))
+
+	err = eft.FinishKeyRotation()
+	if err != nil {
+		panic(err)
+	}
+
+	old := &EFT{Key: old_key, Dir: eft_dir}
+
+	// Snapshots that fail to load are treated as empty.
+	old_infos, err := old.ListInfos()
+	if err == nil && len(old_infos) > 0 {
+		fmt.Println("Old key still works")
+		tt.Fail()
+	}
+
+	// Checkpoints still work, with a full collection.
+	testCollect(eft)
+	checkTestItem(tt, eft, large, packed)
+}
+
+func TestRotateKeyTwoDevices(tt *testing.T) {
+	src_dir := TmpRandomName()
+	defer os.RemoveAll(src_dir)
+
+	names := writeTestFiles(src_dir, 4)
+
+	old_key := [32]byte{}
+	new_key := HashString("new key")
+
+	eft0 := &EFT{Key: old_key, Dir: TmpRandomName(), Device: "a"}
+	eft1 := &EFT{Key: old_key, Dir: TmpRandomName(), Device: "b"}
+
+	defer os.RemoveAll(eft0.Dir)
+	defer os.RemoveAll(eft1.Dir)
+
+	putTestFile(eft0, names[0])
+
+	syncTestEFTs(eft0, eft1)
+	syncTestEFTs(eft1, eft0)
+
+	// The other device pushes just before the rotation, so it has to be
+	// merged under the old key first.
+	putTestFile(eft1, names[1])
+	syncTestEFTs(eft1, eft0)
+
+	err := eft0.RotateKey(new_key, ZERO_HASH)
+	if err != nil {
+		panic(err)
+	}
+
+	err = eft0.FinishKeyRotation()
+	if err != nil {
+		panic(err)
+	}
+
+	checkTestItem(tt, eft0, names[1], testReadBytes(names[1]))
+
+	// Then it pushes again under the old key before it sees the new
+	// one, while this side goes on with its own changes.
+	putTestFile(eft1, names[2])
+
+	err = eft1.Del(names[0])
+	if err != nil {
+		panic(err)
+	}
+
+	cp, err := eft1.MakeCheckpoint()
+	if err != nil {
+		panic(err)
+	}
+	cp.Commit()
+
+	// This side uploads to the share under the new key.
+	putTestFile(eft0, names[3])
+
+	cp0, err := eft0.MakeCheckpoint()
+	if err != nil {
+		panic(err)
+	}
+
+	err = cp0.MarkSynced()
+	if err != nil {
+		panic(err)
+	}
+	cp0.Commit()
+
+	err = eft0.MergeOldKey(old_key, ZERO_HASH, HexToHash(cp.Hash), testFetchFn(eft1))
+	if err != nil {
+		panic(err)
+	}
+
+	for _, name := range(names[1:]) {
+		checkTestItem(tt, eft0, name, testReadBytes(name))
+	}
+
+	info, err := eft0.GetInfo(names[0])
+	if err != nil || !info.IsTomb() {
+		fmt.Println("Delete under the old key was lost")
+		tt.Fail()
+	}
+
+	report, err := eft0.Verify()
+	if err != nil {
+		panic(err)
+	}
+
+	if !report.OK() {
+		fmt.Println("Problems after merging old key root:", report.Problems)
+		tt.Fail()
+	}
+
+	// Everything merged is uploaded under the new key.
+	testCollect(eft0)
+	checkTestItem(tt, eft0, names[2], testReadBytes(names[2]))
+}
@@ -19,7 +19,7 @@ func (eft *EFT) saveSmallItem(info ItemInfo, src_path string) ([32]byte, error)
 		if err != nil {
 			return empty, trace(err)
 		}
-	case INFO_DIR:
+	case INFO_DIR, INFO_TOMB:
 		data = make([]byte, 0)
 	case INFO_LINK:
 		link, err := os.Readlink(src_path)
@@ -30,7 +30,12 @@ func (eft *EFT) saveSmallItem(info ItemInfo, src_path string) ([32]byte, error)
 	default:
 		return empty, errors.New("Unknown info.Type")
 	}
-	
+
+	return eft.saveSmallData(info, data)
+}
+
+func (eft *EFT) saveSmallData(info ItemInfo, data []byte) ([32]byte, error) {
+	empty := [32]byte{}
 
 	if uint64(len(data)) > SMALL_MAX {
 		return empty, fmt.Errorf("Maximum size for small item is 12k")
@@ -44,7 +49,10 @@ func (eft *EFT) saveSmallItem(info ItemInfo, src_path string) ([32]byte, error)
 
 	block := make([]byte, DATA_SIZE)
 
-	header := info.Bytes()
+	header, err := eft.infoBytes(info)
+	if err != nil {
+		return empty, trace(err)
+	}
 	copy(block[0:2048], header)
 
 	copy(block[4096:DATA_SIZE], data)
@@ -69,7 +77,10 @@ func (eft *EFT) loadSmallItem(hash [32]byte, dst_path string) (ItemInfo, error)
 		return nilInfo, fmt.Errorf("Bad block size: %d", len(block))
 	}
 
-	info := ItemInfoFromBytes(block[0:2048])
+	info, err := eft.infoFromBytes(block[0:2048])
+	if err != nil {
+		return nilInfo, trace(err)
+	}
 
 	data := block[4096:4096 + info.Size]
 
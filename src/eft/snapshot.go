@@ -5,25 +5,31 @@ import (
 	"encoding/hex"
 	"bytes"
 	"path"
+	"time"
 	"fmt"
 	"strings"
 	"io/ioutil"
 )
 
-// 128 snapshots can be stored in one block
+// 127 snapshots can be stored in one block
 //
-// Adding more than 16 snapshots is disallowed to allow EFTs 
-// with additional snapshots to be merged in.
+// Adding more than 40 snapshots is disallowed to allow EFTs 
+// with additional snapshots to be merged in. That leaves room for
+// the default share retention, which keeps up to 37.
 //
-// If merging would result in more than 128 snapshots, some
+// If merging would result in more than 127 snapshots, some
 // remote snapshots will be discarded.
+//
+// The first snapshot is always the main tree.
 
-const MAX_SNAPS = 16
+const MAX_SNAPS = 40
 const SNAP_SIZE = 128
+var SNAPS_PER_BLOCK = DATA_SIZE / SNAP_SIZE
 
 type Snapshot struct {
 	eft  *EFT
 	Root [32]byte
+	Log  [32]byte // Update log
 	Time uint64
 	Desc string
 }
@@ -35,10 +41,18 @@ func (eft *EFT) defaultSnapsList() ([]Snapshot, error) {
 }
 
 func (eft *EFT) loadSnapsHash() ([32]byte, error) {
+	return eft.loadHashFile("snaps")
+}
+
+func (eft *EFT) saveSnapsHash(hash [32]byte) error {
+	return eft.saveHashFile("snaps", hash)
+}
+
+func (eft *EFT) loadHashFile(name string) ([32]byte, error) {
 	hash := [32]byte{}
 
-	snaps_path := path.Join(eft.Dir, "snaps")
-	hash_text, err := ioutil.ReadFile(snaps_path)
+	hash_path := path.Join(eft.Dir, name)
+	hash_text, err := ioutil.ReadFile(hash_path)
 	if err != nil {
 		return hash, ErrNotFound
 	}
@@ -54,11 +68,12 @@ func (eft *EFT) loadSnapsHash() ([32]byte, error) {
 	return hash, nil
 }
 
-func (eft *EFT) saveSnapsHash(hash [32]byte) error {
-	snaps_path := path.Join(eft.Dir, "snaps")
+// Replaces the file atomically, for readers that don't take the lock.
+func (eft *EFT) saveHashFile(name string, hash [32]byte) error {
+	hash_path := path.Join(eft.Dir, name)
 	hash_text := hex.EncodeToString(hash[:])
 
-	err := ioutil.WriteFile(snaps_path, []byte(hash_text + "\n"), 0600)
+	err := writeReplace(hash_path, []byte(hash_text + "\n"))
 	if err != nil {
 		return trace(err)
 	}
@@ -106,11 +121,12 @@ func (eft *EFT) loadSnapsFrom(hash [32]byte) ([]Snapshot, error) {
 	snaps := make([]Snapshot, 0)
 	zero_hash := make([]byte, 32)
 
-	for ii := 0; ii < 64; ii++ {
+	for ii := 0; ii < SNAPS_PER_BLOCK; ii++ {
 		snap := Snapshot{eft: eft}
 		base := ii * SNAP_SIZE
 
 		copy(snap.Root[:], data[base:base + 32])
+		copy(snap.Log[:], data[base + 32:base + 64])
 	
 		snap.Desc = string(data[base + 64:base + 96])
 		snap.Desc = strings.Trim(snap.Desc, "\x00")
@@ -118,7 +134,8 @@ func (eft *EFT) loadSnapsFrom(hash [32]byte) ([]Snapshot, error) {
 		be := binary.BigEndian
 		snap.Time = be.Uint64(data[base + 96:base + 104])
 
-		if !bytes.Equal(snap.Root[:], zero_hash) {
+		// The main snapshot keeps its place even if it's empty.
+		if ii == 0 || !bytes.Equal(snap.Root[:], zero_hash) {
 			snaps = append(snaps, snap)
 		}
 	}
@@ -138,6 +155,10 @@ func (eft *EFT) saveSnaps(snaps []Snapshot) error {
 		return fmt.Errorf("No snapshots to save")
 	}
 
+	if len(snaps) > SNAPS_PER_BLOCK {
+		return fmt.Errorf("Too many snapshots to save: %d", len(snaps))
+	}
+
 	prev_snaps, err := eft.loadSnaps()
 	if err != nil {
 		return trace(err)
@@ -163,6 +184,7 @@ func (eft *EFT) saveSnaps(snaps []Snapshot) error {
 		base := ii * SNAP_SIZE
 
 		copy(data[base:base + 32], snap.Root[:])
+		copy(data[base + 32:base + 64], snap.Log[:])
 
 		if len(snap.Desc) > 31 {
 			snap.Desc = snap.Desc[0:31]
@@ -208,6 +230,204 @@ func (eft *EFT) mainSnap() *Snapshot {
 	return &eft.Snaps[0]
 }
 
+func (eft *EFT) snapAt(idx int) (*Snapshot, error) {
+	eft.mainSnap()
+
+	if idx < 0 || idx >= len(eft.Snaps) {
+		return nil, fmt.Errorf("No snapshot at index %d", idx)
+	}
+
+	return &eft.Snaps[idx], nil
+}
+
+// Saves the current main tree as a new snapshot, after any existing
+// snapshots.
+func (eft *EFT) TakeSnapshot(desc string) (Snapshot, error) {
+	eft.Lock()
+	defer eft.Unlock()
+
+	eft.begin()
+
+	snap := *eft.mainSnap()
+
+	if len(eft.Snaps) - 1 >= MAX_SNAPS {
+		eft.abort()
+		return Snapshot{}, fmt.Errorf("Can't have more than %d snapshots", MAX_SNAPS)
+	}
+
+	if snap.isEmpty() {
+		eft.abort()
+		return Snapshot{}, fmt.Errorf("Can't snapshot an empty EFT")
+	}
+
+	if len(desc) > 31 {
+		desc = desc[0:31]
+	}
+
+	// The update log is only needed for merging the main tree.
+	snap.Log  = ZERO_HASH
+	snap.Time = uint64(time.Now().UnixNano())
+	snap.Desc = desc
+
+	eft.Snaps = append(eft.Snaps, snap)
+
+	eft.commit()
+
+	return snap, nil
+}
+
+// Lists all snapshots. The first one is the main tree.
+func (eft *EFT) ListSnapshots() ([]Snapshot, error) {
+	eft.Lock()
+	defer eft.Unlock()
+
+	snaps, err := eft.loadSnaps()
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return snaps, nil
+}
+
+func (eft *EFT) GetAt(snap_idx int, name string, dst_path string) (ItemInfo, error) {
+	rv, err := eft.View()
+	if err != nil {
+		return ItemInfo{}, trace(err)
+	}
+	defer rv.Close()
+
+	return rv.GetAt(snap_idx, name, dst_path)
+}
+
+func (eft *EFT) ListInfosAt(snap_idx int) ([]ItemInfo, error) {
+	rv, err := eft.View()
+	if err != nil {
+		return nil, trace(err)
+	}
+	defer rv.Close()
+
+	return rv.ListInfosAt(snap_idx)
+}
+
+// Removes a snapshot. Its blocks are freed by the next garbage collection.
+func (eft *EFT) DeleteSnapshot(snap_idx int) error {
+	eft.Lock()
+	defer eft.Unlock()
+
+	eft.begin()
+
+	_, err := eft.snapAt(snap_idx)
+	if err != nil || snap_idx == 0 {
+		eft.abort()
+		return fmt.Errorf("Can't delete snapshot %d", snap_idx)
+	}
+
+	eft.Snaps = append(eft.Snaps[:snap_idx], eft.Snaps[snap_idx + 1:]...)
+
+	eft.commit()
+	return nil
+}
+
+// Rolls the main tree back to a snapshot. Each change is applied and
+// logged like a regular update, so items added since the snapshot are
+// deleted rather than forgotten and the restore merges like any other
+// change.
+func (eft *EFT) RestoreSnapshot(snap_idx int) error {
+	eft.Lock()
+	defer eft.Unlock()
+
+	eft.begin()
+
+	err := eft.restoreSnap(snap_idx)
+	if err != nil {
+		eft.abort()
+		return trace(err)
+	}
+
+	eft.commit()
+	return nil
+}
+
+func (eft *EFT) restoreSnap(snap_idx int) error {
+	old, err := eft.snapAt(snap_idx)
+	if err != nil {
+		return err
+	}
+
+	if snap_idx == 0 {
+		return nil
+	}
+
+	olds := make(map[string][32]byte)
+
+	err = eft.visitTree(old, func(info ItemInfo, hash [32]byte) error {
+		olds[info.Path] = hash
+		return nil
+	})
+	if err != nil {
+		return trace(err)
+	}
+
+	snap := eft.mainSnap()
+
+	news := make(map[string][32]byte)
+	dels := make([]string, 0)
+
+	err = eft.visitTree(snap, func(info ItemInfo, hash [32]byte) error {
+		news[info.Path] = hash
+
+		_, ok := olds[info.Path]
+		if !ok && !info.IsTomb() {
+			dels = append(dels, info.Path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return trace(err)
+	}
+
+	for _, name := range(dels) {
+		err := eft.delItem(snap, name)
+		if err != nil {
+			return trace(err)
+		}
+
+		err = eft.logEvent(snap, newLogEntry(LOG_DEL, name))
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	pt, err := eft.loadPathTrie(snap.Root)
+	if err != nil {
+		return trace(err)
+	}
+
+	for name, hash := range(olds) {
+		if news[name] == hash {
+			continue
+		}
+
+		err := pt.insert(name, hash)
+		if err != nil {
+			return trace(err)
+		}
+
+		err = eft.logEvent(snap, newLogEntry(LOG_PUT, name))
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	snap.Root, err = pt.save()
+	if err != nil {
+		return trace(err)
+	}
+
+	return nil
+}
+
 func (snap *Snapshot) debugDump(trie *EFT) {
 	fmt.Printf("[Snapshot] %s \n\t@ %s (\"%s\")\n",
 	    hex.EncodeToString(snap.Root[:]),
@@ -0,0 +1,180 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"fmt"
+	"os"
+)
+
+func TestSnapshots(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	names := writeTestFiles(src_dir, 3)
+
+	for _, name := range(names[0:2]) {
+		putTestFile(eft, name)
+	}
+
+	_, err := eft.TakeSnapshot("first")
+	if err != nil {
+		panic(err)
+	}
+
+	// Edit one file, delete the other and add a new one.
+	err = ioutil.WriteFile(names[0], []byte("edited"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	putTestFile(eft, names[0])
+
+	err = eft.Del(names[1])
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, names[2])
+
+	snaps, err := eft.ListSnapshots()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(snaps) != 2 || snaps[1].Desc != "first" {
+		fmt.Println("Snapshot not listed")
+		tt.Fail()
+		return
+	}
+
+	infos, err := eft.ListInfosAt(1)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(infos) != 2 {
+		fmt.Println("Snapshot has", len(infos), "items, expected 2")
+		tt.Fail()
+	}
+
+	// Collect garbage, which should keep the snapshot's blocks.
+	cp, err := eft.MakeCheckpoint()
+	if err != nil {
+		panic(err)
+	}
+	cp.Commit()
+
+	temp := eft.TempName()
+	defer os.Remove(temp)
+
+	_, err = eft.GetAt(1, names[0], temp)
+	if err != nil {
+		panic(err)
+	}
+
+	if testReadFile(temp) != names[0] {
+		fmt.Println("Wrong content read from snapshot")
+		tt.Fail()
+	}
+
+	err = eft.RestoreSnapshot(1)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = eft.Get(names[0], temp)
+	if err != nil {
+		panic(err)
+	}
+
+	if testReadFile(temp) != names[0] {
+		fmt.Println("Restore didn't roll back edit")
+		tt.Fail()
+	}
+
+	info, err := eft.GetInfo(names[1])
+	if err != nil || info.IsTomb() {
+		fmt.Println("Restore didn't bring back deleted file")
+		tt.Fail()
+	}
+
+	info, err = eft.GetInfo(names[2])
+	if err != nil || !info.IsTomb() {
+		fmt.Println("Restore didn't delete new file")
+		tt.Fail()
+	}
+
+	err = eft.DeleteSnapshot(1)
+	if err != nil {
+		panic(err)
+	}
+
+	snaps, err = eft.ListSnapshots()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(snaps) != 1 {
+		fmt.Println("Snapshot not deleted")
+		tt.Fail()
+	}
+
+	err = eft.DeleteSnapshot(0)
+	if err == nil {
+		fmt.Println("Deleted main snapshot")
+		tt.Fail()
+	}
+}
+
+func TestSnapshotLimit(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	names := writeTestFiles(src_dir, 1)
+	putTestFile(eft, names[0])
+
+	for ii := 0; ii < MAX_SNAPS; ii++ {
+		_, err := eft.TakeSnapshot(fmt.Sprintf("snap %d", ii))
+		if err != nil {
+			fmt.Println("Snapshot", ii, "refused:", err)
+			tt.Fail()
+			return
+		}
+	}
+
+	_, err := eft.TakeSnapshot("one too many")
+	if err == nil {
+		fmt.Println("More than MAX_SNAPS snapshots allowed")
+		tt.Fail()
+	}
+
+	snaps, err := eft.ListSnapshots()
+	if err != nil {
+		panic(err)
+	}
+
+	// Plus the main tree.
+	if len(snaps) != MAX_SNAPS + 1 {
+		fmt.Println("Wrong snapshot count:", len(snaps))
+		tt.Fail()
+	}
+}
+
+func testReadFile(name string) string {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		panic(err)
+	}
+
+	return string(data)
+}
@@ -50,3 +50,21 @@ func tryRoundtripFile(eft *EFT, file_name string) error {
 	return nil
 }
 
+
+func testFetchFn(src *EFT) FetchFn {
+	return func(bs *BlockSet) (*BlockArchive, error) {
+		ba, err := NewArchive()
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		err = bs.EachHash(func (hh [32]byte) error {
+			return ba.Add(src, hh)
+		})
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		return ba, nil
+	}
+}
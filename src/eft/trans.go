@@ -184,8 +184,7 @@ func (eft *EFT) removeBlocks(list *os.File) error {
 		line = strings.TrimSpace(line)
 		hash := HexToHash(line)
 
-		b_path := eft.BlockPath(hash)
-		err = os.Remove(b_path)
+		err = eft.store().Delete(hash)
 		if err != nil {
 			return ErrNotFound
 		}
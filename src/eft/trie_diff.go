@@ -0,0 +1,148 @@
+package eft
+
+import (
+	"fmt"
+)
+
+// Gets every item entry stored under a slot, whether directly, in the
+// overflow tables, or in a sub-trie.
+func (tn *TrieNode) slotEntries(slot uint8) ([]TrieEntry, error) {
+	ent := tn.tab[slot]
+
+	switch ent.Type {
+	case TRIE_TYPE_NONE:
+		return []TrieEntry{}, nil
+
+	case TRIE_TYPE_ITEM:
+		return []TrieEntry{ent}, nil
+
+	case TRIE_TYPE_OVRF:
+		return tn.slotOverflow(slot)
+
+	case TRIE_TYPE_MORE:
+		next, err := tn.loadChild(ent.Hash)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		ents := make([]TrieEntry, 0)
+
+		err = next.visitEachEntry(func (ent *TrieEntry) error {
+			if ent.Type == TRIE_TYPE_ITEM {
+				ents = append(ents, *ent)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		return ents, nil
+	}
+
+	return nil, fmt.Errorf("Invalid entry type: %d", ent.Type)
+}
+
+// Calls fn for each key with a different entry in tn0 and tn1, which must
+// be at the same depth of the same kind of trie. Either entry is nil if
+// that side doesn't have the key. Slots with identical entries are
+// skipped, so this only loads the parts of the tries that changed.
+func (tn0 *TrieNode) diffEntries(tn1 *TrieNode, fn func(ent0, ent1 *TrieEntry) error) error {
+	for ii := 0; ii < 256; ii++ {
+		slot := uint8(ii)
+
+		if tn0.sameSlot(tn1, slot) {
+			continue
+		}
+
+		ent0 := tn0.tab[slot]
+		ent1 := tn1.tab[slot]
+
+		if ent0.Type == TRIE_TYPE_MORE && ent1.Type == TRIE_TYPE_MORE {
+			stn0, err := tn0.loadChild(ent0.Hash)
+			if err != nil {
+				return trace(err)
+			}
+
+			stn1, err := tn1.loadChild(ent1.Hash)
+			if err != nil {
+				return trace(err)
+			}
+
+			err = stn0.diffEntries(stn1, fn)
+			if err != nil {
+				return trace(err)
+			}
+
+			continue
+		}
+
+		ents0, err := tn0.slotEntries(slot)
+		if err != nil {
+			return trace(err)
+		}
+
+		ents1, err := tn1.slotEntries(slot)
+		if err != nil {
+			return trace(err)
+		}
+
+		err = tn0.diffEntryLists(ents0, ents1, fn)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return nil
+}
+
+func (tn *TrieNode) diffEntryLists(ents0, ents1 []TrieEntry, fn func(ent0, ent1 *TrieEntry) error) error {
+	keys0 := make(map[string]int)
+
+	for ii, ent := range(ents0) {
+		key, err := tn.KeyBytes(ent)
+		if err != nil {
+			return trace(err)
+		}
+
+		keys0[string(key)] = ii
+	}
+
+	seen := make(map[int]bool)
+
+	for ii := range(ents1) {
+		ent1 := &ents1[ii]
+
+		key, err := tn.KeyBytes(*ent1)
+		if err != nil {
+			return trace(err)
+		}
+
+		jj, ok := keys0[string(key)]
+		if !ok {
+			err = fn(nil, ent1)
+		} else {
+			seen[jj] = true
+
+			if ents0[jj].Hash != ent1.Hash {
+				err = fn(&ents0[jj], ent1)
+			}
+		}
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	for jj := range(ents0) {
+		if seen[jj] {
+			continue
+		}
+
+		err := fn(&ents0[jj], nil)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,273 @@
+package eft
+
+// A Txn makes many changes in one transaction, holding the EFT lock
+// from Begin until Commit or Abort.
+//
+// Each Put or Del rewrites the path and directory trie nodes from the
+// item up to the root. Outside a Txn each of those versions is written
+// out, and all but the last become garbage. In a Txn the nodes are kept
+// in memory, and a node is dropped as soon as it's replaced by a newer
+// version. Commit writes the nodes reachable from the final root, each
+// once, then the update log and the snapshot list.
+//
+// A change that fails while rewriting the trie may already have dropped
+// nodes the current root still points to. After that the Txn can only be
+// aborted: further changes and Commit return ErrTxnFailed.
+
+import (
+	"errors"
+)
+
+var ErrTxnDone = errors.New("EFT: transaction already finished")
+var ErrTxnFailed = errors.New("EFT: transaction failed, must be aborted")
+
+type Txn struct {
+	eft    *EFT
+	logs   []LogEntry
+	done   bool
+	failed bool
+}
+
+type pendingNode struct {
+	ctxt []byte
+	refs int // Parents that point to it
+}
+
+func (eft *EFT) Begin() (*Txn, error) {
+	eft.Lock()
+	eft.begin()
+	eft.mainSnap()
+
+	eft.smutex.Lock()
+	eft.nodes = make(map[[32]byte]*pendingNode)
+	eft.smutex.Unlock()
+
+	return &Txn{eft: eft}, nil
+}
+
+// The main snapshot as changed so far. Unlike mainSnap this doesn't
+// reload the saved list.
+func (txn *Txn) snap() *Snapshot {
+	return &txn.eft.Snaps[0]
+}
+
+func (txn *Txn) check() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+
+	if txn.failed {
+		return ErrTxnFailed
+	}
+
+	return nil
+}
+
+// Whether a change failed partway, so the Txn must be aborted.
+func (txn *Txn) Failed() bool {
+	return txn.failed
+}
+
+func (txn *Txn) Put(info ItemInfo, src_path string) error {
+	err := txn.check()
+	if err != nil {
+		return err
+	}
+
+	eft := txn.eft
+	snap := txn.snap()
+
+	// The Txn is still usable if only saving the data failed.
+	data_hash, err := eft.saveItemData(snap, info, src_path)
+	if err != nil {
+		return trace(err)
+	}
+
+	root, err := eft.putTree(snap, info, data_hash)
+	if err != nil {
+		txn.failed = true
+		return trace(err)
+	}
+	snap.Root = root
+
+	txn.logs = append(txn.logs, newLogEntry(LOG_PUT, info.Path))
+	return nil
+}
+
+func (txn *Txn) Del(name string) error {
+	err := txn.check()
+	if err != nil {
+		return err
+	}
+
+	_, _, err = txn.eft.getTree(txn.snap(), name)
+	if err != nil {
+		return err
+	}
+
+	err = txn.eft.delItem(txn.snap(), name)
+	if err != nil {
+		txn.failed = true
+		return trace(err)
+	}
+
+	txn.logs = append(txn.logs, newLogEntry(LOG_DEL, name))
+	return nil
+}
+
+func (txn *Txn) GetInfo(name string) (ItemInfo, error) {
+	err := txn.check()
+	if err != nil {
+		return ItemInfo{}, err
+	}
+
+	info, _, err := txn.eft.getTree(txn.snap(), name)
+	return info, err
+}
+
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+
+	eft := txn.eft
+	defer eft.Unlock()
+
+	txn.done = true
+	snap := txn.snap()
+
+	if txn.failed {
+		eft.dropNodes()
+		eft.abort()
+		return ErrTxnFailed
+	}
+
+	err := eft.logEvents(snap, txn.logs)
+	if err != nil {
+		eft.dropNodes()
+		eft.abort()
+		return trace(err)
+	}
+
+	if !snap.isEmpty() {
+		err = eft.flushNode(blockRef{REF_PATH, snap.Root})
+		if err != nil {
+			eft.dropNodes()
+			eft.abort()
+			return trace(err)
+		}
+	}
+
+	eft.dropNodes()
+	eft.commit()
+
+	return nil
+}
+
+func (txn *Txn) Abort() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+
+	txn.done = true
+
+	txn.eft.dropNodes()
+	txn.eft.abort()
+	txn.eft.Unlock()
+
+	return nil
+}
+
+// Seals a trie node. In a Txn it's kept in memory, replacing the version
+// it was loaded from.
+func (eft *EFT) saveNode(data []byte, prev [32]byte) ([32]byte, error) {
+	eft.smutex.Lock()
+	batched := eft.nodes != nil
+	eft.smutex.Unlock()
+
+	if !batched {
+		return eft.saveBlock(data)
+	}
+
+	ctxt, err := eft.seal(data)
+	if err != nil {
+		return ZERO_HASH, trace(err)
+	}
+
+	hash := HashSlice(ctxt)
+
+	eft.smutex.Lock()
+	defer eft.smutex.Unlock()
+
+	pn, ok := eft.nodes[hash]
+	if !ok {
+		pn = &pendingNode{ctxt: ctxt}
+		eft.nodes[hash] = pn
+	}
+
+	pn.refs += 1
+
+	old, ok := eft.nodes[prev]
+	if ok {
+		old.refs -= 1
+		if old.refs <= 0 {
+			delete(eft.nodes, prev)
+		}
+	}
+
+	return hash, nil
+}
+
+func (eft *EFT) pendingNode(hash [32]byte) ([]byte, bool) {
+	eft.smutex.Lock()
+	defer eft.smutex.Unlock()
+
+	pn, ok := eft.nodes[hash]
+	if !ok {
+		return nil, false
+	}
+
+	return pn.ctxt, true
+}
+
+// Writes out a pending node and the pending nodes below it. Anything
+// that isn't pending is already stored.
+func (eft *EFT) flushNode(ref blockRef) error {
+	ctxt, ok := eft.pendingNode(ref.hash)
+	if !ok {
+		return nil
+	}
+
+	kids, err := eft.refChildren(ref)
+	if err != nil {
+		return trace(err)
+	}
+
+	for _, kid := range(kids) {
+		if kid.kind != REF_PATH && kid.kind != REF_DIR {
+			continue
+		}
+
+		err = eft.flushNode(kid)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	err = eft.putSealed(ref.hash, ctxt)
+	if err != nil {
+		return trace(err)
+	}
+
+	eft.smutex.Lock()
+	delete(eft.nodes, ref.hash)
+	eft.smutex.Unlock()
+
+	return nil
+}
+
+func (eft *EFT) dropNodes() {
+	eft.smutex.Lock()
+	eft.nodes = nil
+	eft.smutex.Unlock()
+}
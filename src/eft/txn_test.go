@@ -0,0 +1,224 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestTxn(tt *testing.T) {
+	src_dir := TmpRandomName()
+	defer os.RemoveAll(src_dir)
+
+	names := make([]string, 0)
+
+	for ii := 0; ii < 300; ii++ {
+		dir := path.Join(src_dir, fmt.Sprintf("d%d", ii % 7))
+
+		err := os.MkdirAll(dir, 0700)
+		if err != nil {
+			panic(err)
+		}
+
+		name := path.Join(dir, fmt.Sprintf("f%d", ii))
+		err = ioutil.WriteFile(name, []byte(fmt.Sprintf("file %d\n", ii)), 0600)
+		if err != nil {
+			panic(err)
+		}
+
+		names = append(names, name)
+	}
+
+	single := &EFT{Key: [32]byte{}, Dir: TmpRandomName(), Store: NewMemStore()}
+	defer os.RemoveAll(single.Dir)
+
+	for _, name := range(names) {
+		putTestFile(single, name)
+	}
+
+	store := NewMemStore()
+	eft := &EFT{Key: [32]byte{}, Dir: TmpRandomName(), Store: store}
+	defer os.RemoveAll(eft.Dir)
+
+	txn, err := eft.Begin()
+	if err != nil {
+		panic(err)
+	}
+
+	for _, name := range(names) {
+		info, err := FastItemInfo(name)
+		if err != nil {
+			panic(err)
+		}
+
+		err = txn.Put(info, name)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	err = txn.Del(names[0])
+	if err != nil {
+		panic(err)
+	}
+
+	info, err := txn.GetInfo(names[0])
+	if err != nil || !info.IsTomb() {
+		fmt.Println("Delete not seen in transaction")
+		tt.Fail()
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		panic(err)
+	}
+
+	for _, name := range(names[1:]) {
+		checkTestItem(tt, eft, name, testReadBytes(name))
+	}
+
+	info, err = eft.GetInfo(names[0])
+	if err != nil || !info.IsTomb() {
+		fmt.Println("Delete not committed")
+		tt.Fail()
+	}
+
+	// Only the final trie nodes were written.
+	count := testStoreCount(store)
+
+	if count >= testStoreCount(single.Store) / 2 {
+		fmt.Println("Too many blocks for batch:", count, "vs", testStoreCount(single.Store))
+		tt.Fail()
+	}
+
+	report, err := eft.Verify()
+	if err != nil {
+		panic(err)
+	}
+
+	if !report.OK() {
+		fmt.Println("Bad blocks after batch:", report.Problems)
+		tt.Fail()
+	}
+
+	// An aborted batch leaves nothing behind.
+	root := eft.RootHash1()
+
+	txn, err = eft.Begin()
+	if err != nil {
+		panic(err)
+	}
+
+	err = txn.Del(names[1])
+	if err != nil {
+		panic(err)
+	}
+
+	err = txn.Abort()
+	if err != nil {
+		panic(err)
+	}
+
+	if eft.RootHash1() != root || testStoreCount(store) != count {
+		fmt.Println("Aborted batch changed the EFT")
+		tt.Fail()
+	}
+
+	checkTestItem(tt, eft, names[1], testReadBytes(names[1]))
+
+	if txn.Put(info, names[1]) != ErrTxnDone {
+		fmt.Println("Finished transaction still usable")
+		tt.Fail()
+	}
+}
+
+func testStoreCount(store BlockStore) int {
+	count := 0
+
+	err := store.Iterate(func(hash [32]byte) error {
+		count += 1
+		return nil
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	return count
+}
+
+func TestTxnFailed(tt *testing.T) {
+	src_dir := TmpRandomName()
+	defer os.RemoveAll(src_dir)
+
+	names := writeTestFiles(src_dir, 3)
+
+	store := NewMemStore()
+	eft := &EFT{Key: [32]byte{}, Dir: TmpRandomName(), Store: store}
+	defer os.RemoveAll(eft.Dir)
+
+	putTestFile(eft, names[0])
+	putTestFile(eft, names[1])
+
+	txn, err := eft.Begin()
+	if err != nil {
+		panic(err)
+	}
+
+	// Errors before the trie is touched leave the Txn usable.
+	err = txn.Del(names[2])
+	if err != ErrNotFound {
+		fmt.Println("Del of missing item:", err)
+		tt.Fail()
+	}
+
+	err = txn.Put(testFileInfo(names[2]), path.Join(src_dir, "missing"))
+	if err == nil || txn.Failed() {
+		fmt.Println("Put of missing file failed the Txn")
+		tt.Fail()
+	}
+
+	// Losing the root block makes the next Put fail in the trie.
+	root := txn.snap().Root
+
+	ctxt, err := store.Get(root)
+	if err != nil {
+		panic(err)
+	}
+
+	err = store.Delete(root)
+	if err != nil {
+		panic(err)
+	}
+
+	err = txn.Put(testFileInfo(names[2]), names[2])
+	if err == nil || !txn.Failed() {
+		fmt.Println("Put with a missing trie node didn't fail the Txn")
+		tt.Fail()
+	}
+
+	err = store.Put(root, ctxt)
+	if err != nil {
+		panic(err)
+	}
+
+	if txn.Put(testFileInfo(names[2]), names[2]) != ErrTxnFailed {
+		fmt.Println("Failed transaction still usable")
+		tt.Fail()
+	}
+
+	if txn.Commit() != ErrTxnFailed {
+		fmt.Println("Failed transaction committed")
+		tt.Fail()
+	}
+
+	if testMainRoot(eft) != root {
+		fmt.Println("Failed transaction changed the EFT")
+		tt.Fail()
+	}
+
+	checkTestItem(tt, eft, names[0], testReadBytes(names[0]))
+	putTestFile(eft, names[2])
+	checkTestItem(tt, eft, names[2], testReadBytes(names[2]))
+}
@@ -0,0 +1,533 @@
+package eft
+
+// The update log records every change to the main tree of an EFT, so two
+// EFTs can be merged by comparing what happened to each since they last
+// synced. The log is stored in encrypted blocks and referenced from the
+// main snapshot, so it travels with the root.
+//
+// Log root block:
+//   [0,      4]: Number of sealed blocks
+//   [4,      8]: Length of open text
+//   [8,   8008]: Sealed blocks, oldest first (32 byte hash, 8 byte newest time)
+//   [8k,   16k]: Open text
+//
+// Sealed log block:
+//   [0,  4]: Length of text
+//   [4,16k]: Text
+//
+// Entries older than the retention window are dropped a sealed block at
+// a time when a checkpoint is made, or when the root block has no room for
+// another sealed block. If all LOG_SEALED_MAX blocks are still inside the
+// window, adding to the log fails with ErrLogFull.
+//
+// Merges append the remote entries, so the local entries stay in time
+// order followed by the remote ones.
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"errors"
+	"time"
+	"fmt"
+)
+
+const (
+	LOG_PUT = "PUT"
+	LOG_DEL = "DEL"
+	LOG_CPT = "CPT"
+	LOG_SYN = "SYN"
+	LOG_PRG = "PRG"
+)
+
+var ErrLogFull = errors.New("EFT: update log full")
+
+const LOG_KEEP = 30 * 24 * time.Hour
+const LOG_SEALED_MAX = 200
+const LOG_OPEN_BASE = 8192
+
+type LogEntry struct {
+	Time uint64
+	Op   string
+	Arg  string // Path, root hash for CPT, or device for SYN
+}
+
+type logBlockRef struct {
+	Hash [32]byte
+	Time uint64
+}
+
+type UpdateLog struct {
+	eft    *EFT
+	sealed []logBlockRef
+	open   string
+}
+
+var logEscaper   = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n")
+var logUnescaper = strings.NewReplacer("\\\\", "\\", "\\t", "\t", "\\n", "\n")
+
+func (ent LogEntry) String() string {
+	return fmt.Sprintf("%d\t%s\t%s\n", ent.Time, ent.Op, logEscaper.Replace(ent.Arg))
+}
+
+func (ent LogEntry) ModTime() time.Time {
+	return timeFromUnix(ent.Time)
+}
+
+func newLogEntry(op string, arg string) LogEntry {
+	return LogEntry{
+		Time: uint64(time.Now().UnixNano()),
+		Op:   op,
+		Arg:  arg,
+	}
+}
+
+func parseLogText(text string) ([]LogEntry, error) {
+	ents := make([]LogEntry, 0)
+
+	for _, line := range(strings.Split(text, "\n")) {
+		if line == "" {
+			continue
+		}
+
+		parts := strings.SplitN(line, "\t", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("Bad log line: %s", line)
+		}
+
+		tt, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		ent := LogEntry{
+			Time: tt,
+			Op:   parts[1],
+			Arg:  logUnescaper.Replace(parts[2]),
+		}
+		ents = append(ents, ent)
+	}
+
+	return ents, nil
+}
+
+func (eft *EFT) emptyLog() *UpdateLog {
+	return &UpdateLog{
+		eft:    eft,
+		sealed: make([]logBlockRef, 0),
+	}
+}
+
+func (eft *EFT) loadLog(hash [32]byte) (*UpdateLog, error) {
+	ul := eft.emptyLog()
+
+	if hash == ZERO_HASH {
+		return ul, nil
+	}
+
+	data, err := eft.loadBlock(hash)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	be := binary.BigEndian
+
+	count := int(be.Uint32(data[0:4]))
+	size  := int(be.Uint32(data[4:8]))
+
+	if count > LOG_SEALED_MAX || LOG_OPEN_BASE + size > len(data) {
+		return nil, fmt.Errorf("Corrupt update log block")
+	}
+
+	for ii := 0; ii < count; ii++ {
+		base := 8 + 40 * ii
+
+		ref := logBlockRef{}
+		copy(ref.Hash[:], data[base:base + 32])
+		ref.Time = be.Uint64(data[base + 32:base + 40])
+		ul.sealed = append(ul.sealed, ref)
+	}
+
+	ul.open = string(data[LOG_OPEN_BASE:LOG_OPEN_BASE + size])
+
+	return ul, nil
+}
+
+func (ul *UpdateLog) save() ([32]byte, error) {
+	if len(ul.sealed) == 0 && ul.open == "" {
+		return ZERO_HASH, nil
+	}
+
+	be := binary.BigEndian
+	data := make([]byte, DATA_SIZE)
+
+	be.PutUint32(data[0:4], uint32(len(ul.sealed)))
+	be.PutUint32(data[4:8], uint32(len(ul.open)))
+
+	for ii, ref := range(ul.sealed) {
+		base := 8 + 40 * ii
+		copy(data[base:base + 32], ref.Hash[:])
+		be.PutUint64(data[base + 32:base + 40], ref.Time)
+	}
+
+	copy(data[LOG_OPEN_BASE:], []byte(ul.open))
+
+	hash, err := ul.eft.saveBlock(data)
+	if err != nil {
+		return hash, trace(err)
+	}
+
+	return hash, nil
+}
+
+func (ul *UpdateLog) seal() error {
+	if ul.open == "" {
+		return nil
+	}
+
+	ents, err := parseLogText(ul.open)
+	if err != nil {
+		return trace(err)
+	}
+
+	newest := uint64(0)
+	for _, ent := range(ents) {
+		if ent.Time > newest {
+			newest = ent.Time
+		}
+	}
+
+	data := make([]byte, DATA_SIZE)
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(ul.open)))
+	copy(data[4:], []byte(ul.open))
+
+	hash, err := ul.eft.saveBlock(data)
+	if err != nil {
+		return trace(err)
+	}
+
+	if len(ul.sealed) == LOG_SEALED_MAX {
+		// Only a block that has aged out of the retention window can
+		// make room. Dropping a newer one would lose changes a merge
+		// still needs.
+		cutoff := uint64(time.Now().Add(-ul.eft.logKeep()).UnixNano())
+		if ul.sealed[0].Time >= cutoff {
+			return ErrLogFull
+		}
+
+		ul.sealed = ul.sealed[1:]
+	}
+
+	ul.sealed = append(ul.sealed, logBlockRef{Hash: hash, Time: newest})
+	ul.open = ""
+
+	return nil
+}
+
+func (ul *UpdateLog) append(ent LogEntry) error {
+	line := ent.String()
+
+	if len(line) > DATA_SIZE - LOG_OPEN_BASE {
+		return fmt.Errorf("Log entry too long")
+	}
+
+	if LOG_OPEN_BASE + len(ul.open) + len(line) > DATA_SIZE {
+		err := ul.seal()
+		if err == ErrLogFull {
+			return err
+		}
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	ul.open += line
+	return nil
+}
+
+func (ul *UpdateLog) entries() ([]LogEntry, error) {
+	ents := make([]LogEntry, 0)
+
+	for _, ref := range(ul.sealed) {
+		data, err := ul.eft.loadBlock(ref.Hash)
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		size := int(binary.BigEndian.Uint32(data[0:4]))
+		if size > len(data) - 4 {
+			return nil, fmt.Errorf("Corrupt sealed log block")
+		}
+
+		more, err := parseLogText(string(data[4:4 + size]))
+		if err != nil {
+			return nil, trace(err)
+		}
+
+		ents = append(ents, more...)
+	}
+
+	more, err := parseLogText(ul.open)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return append(ents, more...), nil
+}
+
+func (ul *UpdateLog) trim(cutoff uint64) {
+	keep := make([]logBlockRef, 0)
+
+	for _, ref := range(ul.sealed) {
+		if ref.Time >= cutoff {
+			keep = append(keep, ref)
+		}
+	}
+
+	ul.sealed = keep
+}
+
+func (eft *EFT) visitLogBlocks(hash [32]byte, fn func(hash [32]byte) error) error {
+	if hash == ZERO_HASH {
+		return nil
+	}
+
+	err := fn(hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	ul, err := eft.loadLog(hash)
+	if err != nil {
+		return trace(err)
+	}
+
+	for _, ref := range(ul.sealed) {
+		err := fn(ref.Hash)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	return nil
+}
+
+func (eft *EFT) saveLogEntries(ents []LogEntry) ([32]byte, error) {
+	ul := eft.emptyLog()
+
+	for _, ent := range(ents) {
+		err := ul.append(ent)
+		if err != nil {
+			return ZERO_HASH, trace(err)
+		}
+	}
+
+	return ul.save()
+}
+
+func (eft *EFT) loadLogEntries(hash [32]byte) ([]LogEntry, error) {
+	ul, err := eft.loadLog(hash)
+	if err != nil {
+		return nil, trace(err)
+	}
+
+	return ul.entries()
+}
+
+func (eft *EFT) logEvent(snap *Snapshot, ent LogEntry) error {
+	return eft.logEvents(snap, []LogEntry{ent})
+}
+
+func (eft *EFT) logEvents(snap *Snapshot, ents []LogEntry) error {
+	ul, err := eft.loadLog(snap.Log)
+	if err != nil {
+		return trace(err)
+	}
+
+	for _, ent := range(ents) {
+		err = ul.append(ent)
+		if err != nil {
+			return trace(err)
+		}
+	}
+
+	snap.Log, err = ul.save()
+	if err != nil {
+		return trace(err)
+	}
+
+	return nil
+}
+
+func (eft *EFT) logKeep() time.Duration {
+	if eft.LogKeep == 0 {
+		return LOG_KEEP
+	}
+	return eft.LogKeep
+}
+
+// Record a sync point in the log, dropping entries that have aged out.
+func (eft *EFT) logCheckpoint(snap *Snapshot) error {
+	if snap.isEmpty() {
+		return nil
+	}
+
+	ul, err := eft.loadLog(snap.Log)
+	if err != nil {
+		return trace(err)
+	}
+
+	sealed := len(ul.sealed)
+
+	cutoff := time.Now().Add(-eft.logKeep()).UnixNano()
+	ul.trim(uint64(cutoff))
+
+	changed := len(ul.sealed) != sealed
+
+	ents, err := ul.entries()
+	if err != nil {
+		return trace(err)
+	}
+
+	root := HashToHex(snap.Root)
+	last := len(ents) - 1
+
+	// Another device saying it synced isn't a change here.
+	for last >= 0 && ents[last].Op == LOG_SYN {
+		last -= 1
+	}
+
+	new_cpt := last < 0 || ents[last].Op != LOG_CPT || ents[last].Arg != root
+
+	if new_cpt {
+		err = ul.append(newLogEntry(LOG_CPT, root))
+		if err != nil {
+			return trace(err)
+		}
+
+		changed = true
+	}
+
+	if eft.Device != "" && (new_cpt || eft.syncDue(ents)) {
+		err = ul.append(newLogEntry(LOG_SYN, eft.Device))
+		if err != nil {
+			return trace(err)
+		}
+
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+
+	snap.Log, err = ul.save()
+	if err != nil {
+		return trace(err)
+	}
+
+	return nil
+}
+
+func (eft *EFT) ReadLog() ([]LogEntry, error) {
+	eft.Lock()
+	defer eft.Unlock()
+
+	return eft.loadLogEntries(eft.mainSnap().Log)
+}
+
+// Finds the entries in log0 that aren't in log1, ignoring anything older
+// than the oldest entry in log1, which may simply have been trimmed from it.
+func logNewEntries(log0, log1 []LogEntry) []LogEntry {
+	seen := make(map[LogEntry]bool)
+	cutoff := uint64(0)
+
+	for ii, ent := range(log1) {
+		seen[ent] = true
+
+		if ii == 0 || ent.Time < cutoff {
+			cutoff = ent.Time
+		}
+	}
+
+	ents := make([]LogEntry, 0)
+
+	for _, ent := range(log0) {
+		if seen[ent] || ent.Time < cutoff {
+			continue
+		}
+
+		ents = append(ents, ent)
+	}
+
+	return ents
+}
+
+func logHasChanges(ents []LogEntry) bool {
+	for _, ent := range(ents) {
+		if ent.Op != LOG_CPT && ent.Op != LOG_SYN {
+			return true
+		}
+	}
+
+	return false
+}
+
+func logHaveCommonCheckpoint(log0, log1 []LogEntry) bool {
+	cpts := make(map[string]bool)
+
+	for _, ent := range(log0) {
+		if ent.Op == LOG_CPT {
+			cpts[ent.Arg] = true
+		}
+	}
+
+	for _, ent := range(log1) {
+		if ent.Op == LOG_CPT && cpts[ent.Arg] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func logLatestTimes(ents []LogEntry) map[string]uint64 {
+	times := make(map[string]uint64)
+
+	for _, ent := range(ents) {
+		if ent.Op == LOG_CPT || ent.Op == LOG_SYN {
+			continue
+		}
+
+		if ent.Time > times[ent.Arg] {
+			times[ent.Arg] = ent.Time
+		}
+	}
+
+	return times
+}
+
+// The latest entry for each path. Of two entries at the same time, the
+// later one in the list wins.
+func logLatestEntries(ents []LogEntry) map[string]LogEntry {
+	last := make(map[string]LogEntry)
+
+	for _, ent := range(ents) {
+		if ent.Op == LOG_CPT || ent.Op == LOG_SYN {
+			continue
+		}
+
+		prev, ok := last[ent.Arg]
+		if !ok || ent.Time >= prev.Time {
+			last[ent.Arg] = ent
+		}
+	}
+
+	return last
+}
+
+type logEntriesByTime []LogEntry
+
+func (ll logEntriesByTime) Len() int           { return len(ll) }
+func (ll logEntriesByTime) Less(ii, jj int) bool { return ll[ii].Time < ll[jj].Time }
+func (ll logEntriesByTime) Swap(ii, jj int)      { ll[ii], ll[jj] = ll[jj], ll[ii] }
@@ -0,0 +1,330 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"path"
+	"time"
+	"fmt"
+	"os"
+)
+
+func TestLogRoundtrip(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	defer os.RemoveAll(eft_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	eft.Lock()
+	defer eft.Unlock()
+
+	eft.begin()
+	defer eft.commit()
+
+	ents := make([]LogEntry, 0)
+
+	for ii := 0; ii < 1000; ii++ {
+		ent := LogEntry{
+			Time: uint64(ii + 1),
+			Op:   LOG_PUT,
+			Arg:  fmt.Sprintf("/some/rather/long/path/name\twith tab/%d.txt", ii),
+		}
+		ents = append(ents, ent)
+	}
+
+	hash, err := eft.saveLogEntries(ents)
+	if err != nil {
+		panic(err)
+	}
+
+	ul, err := eft.loadLog(hash)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(ul.sealed) == 0 {
+		fmt.Println("Expected log to have sealed blocks")
+		tt.Fail()
+	}
+
+	ents1, err := ul.entries()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(ents1) != len(ents) {
+		fmt.Println("Read", len(ents1), "entries, expected", len(ents))
+		tt.Fail()
+		return
+	}
+
+	for ii := range(ents) {
+		if ents[ii] != ents1[ii] {
+			fmt.Println("Entry mismatch:", ents[ii], ents1[ii])
+			tt.Fail()
+		}
+	}
+
+	ul.trim(ul.sealed[0].Time + 1)
+
+	ents2, err := ul.entries()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(ents2) >= len(ents) || ents2[len(ents2) - 1] != ents[len(ents) - 1] {
+		fmt.Println("Trim didn't drop the oldest block")
+		tt.Fail()
+	}
+}
+
+func TestLogMerge(tt *testing.T) {
+	eft0_dir := TmpRandomName()
+	eft1_dir := TmpRandomName()
+	src_dir  := TmpRandomName()
+
+	defer os.RemoveAll(eft0_dir)
+	defer os.RemoveAll(eft1_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft0 := &EFT{Key: [32]byte{}, Dir: eft0_dir}
+	eft1 := &EFT{Key: [32]byte{}, Dir: eft1_dir}
+
+	names := writeTestFiles(src_dir, 4)
+
+	for _, name := range(names) {
+		putTestFile(eft0, name)
+	}
+
+	// Both sides start from the same synced root.
+	syncTestEFTs(eft0, eft1)
+
+	// Each side adds a file; both edit the same file. The edit on eft0
+	// happens later, but has an older modification time.
+	extra := writeTestFiles(path.Join(src_dir, "extra"), 2)
+	putTestFile(eft0, extra[0])
+	putTestFile(eft1, extra[1])
+
+	err := ioutil.WriteFile(names[0], []byte("from eft1"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	putTestFile(eft1, names[0])
+
+	old := time.Now().Add(-time.Hour)
+	err = ioutil.WriteFile(names[0], []byte("from eft0"), 0600)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Chtimes(names[0], old, old)
+	if err != nil {
+		panic(err)
+	}
+	putTestFile(eft0, names[0])
+
+	syncTestEFTs(eft0, eft1)
+
+	for _, name := range(append(names, extra...)) {
+		_, err := eft1.GetInfo(name)
+		if err != nil {
+			fmt.Println("Merged lookup failed for", name)
+			tt.Fail()
+		}
+	}
+
+	temp := eft1.TempName()
+	defer os.Remove(temp)
+
+	_, err = eft1.Get(names[0], temp)
+	if err != nil {
+		panic(err)
+	}
+
+	data, err := ioutil.ReadFile(temp)
+	if err != nil {
+		panic(err)
+	}
+
+	if string(data) != "from eft0" {
+		fmt.Println("Latest edit didn't win merge:", string(data))
+		tt.Fail()
+	}
+
+	// Merging again with no changes should take the remote root.
+	hash0 := syncTestEFTs(eft1, eft0)
+	hash1 := syncTestEFTs(eft0, eft1)
+
+	if hash0 != hash1 {
+		fmt.Println("Repeated sync didn't converge")
+		tt.Fail()
+	}
+}
+
+func TestLogFull(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	defer os.RemoveAll(eft_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	eft.Lock()
+	defer eft.Unlock()
+
+	eft.begin()
+	defer eft.abort()
+
+	fill := func(tt0 uint64) error {
+		ul := eft.emptyLog()
+
+		// More than LOG_SEALED_MAX blocks of entries.
+		for ii := 0; ii < 200 * LOG_SEALED_MAX; ii++ {
+			ent := LogEntry{
+				Time: tt0 + uint64(ii),
+				Op:   LOG_PUT,
+				Arg:  fmt.Sprintf("/a/path/that/fills/the/log/%d.txt", ii),
+			}
+
+			err := ul.append(ent)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	// Entries that have aged out make room for new ones.
+	old := uint64(time.Now().Add(-2 * eft.logKeep()).UnixNano())
+
+	err := fill(old)
+	if err != nil {
+		fmt.Println("Full log of old entries didn't drop one:", err)
+		tt.Fail()
+	}
+
+	// Recent ones can't be dropped.
+	err = fill(uint64(time.Now().UnixNano()))
+	if err != ErrLogFull {
+		fmt.Println("Full log of recent entries didn't fail:", err)
+		tt.Fail()
+	}
+}
+
+func TestLogMergeKeepsSealed(tt *testing.T) {
+	src_dir := TmpRandomName()
+	defer os.RemoveAll(src_dir)
+
+	names := writeTestFiles(src_dir, 3)
+
+	eft0 := &EFT{Key: [32]byte{}, Dir: TmpRandomName()}
+	eft1 := &EFT{Key: [32]byte{}, Dir: TmpRandomName()}
+
+	defer os.RemoveAll(eft0.Dir)
+	defer os.RemoveAll(eft1.Dir)
+
+	putTestFile(eft0, names[0])
+
+	// Enough entries for a few sealed blocks.
+	eft0.Lock()
+	eft0.begin()
+
+	ents := make([]LogEntry, 0)
+	for ii := 0; ii < 500; ii++ {
+		ents = append(ents, newLogEntry(LOG_PUT, fmt.Sprintf("/some/old/path/%d", ii)))
+	}
+
+	err := eft0.logEvents(eft0.mainSnap(), ents)
+	if err != nil {
+		panic(err)
+	}
+
+	eft0.commit()
+	eft0.Unlock()
+
+	syncTestEFTs(eft0, eft1)
+
+	// Changes on both sides, so the merge can't take either log.
+	putTestFile(eft0, names[1])
+	putTestFile(eft1, names[2])
+
+	sealed := func(eft *EFT) []logBlockRef {
+		eft.Lock()
+		defer eft.Unlock()
+
+		ul, err := eft.loadLog(eft.mainSnap().Log)
+		if err != nil {
+			panic(err)
+		}
+
+		return ul.sealed
+	}
+
+	before := sealed(eft0)
+	if len(before) == 0 {
+		fmt.Println("Expected sealed log blocks")
+		tt.Fail()
+		return
+	}
+
+	syncTestEFTs(eft1, eft0)
+
+	after := sealed(eft0)
+
+	for ii := range(before) {
+		if ii >= len(after) || after[ii] != before[ii] {
+			fmt.Println("Merge sealed the log again")
+			tt.Fail()
+			break
+		}
+	}
+
+	for _, name := range(names) {
+		checkTestItem(tt, eft0, name, testReadBytes(name))
+	}
+}
+
+func putTestFile(eft *EFT, name string) {
+	info, err := FastItemInfo(name)
+	if err != nil {
+		panic(err)
+	}
+
+	err = eft.Put(info, name)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Checkpoints src as if it was uploaded, then merges it into dst.
+// Returns the root of dst.
+func syncTestEFTs(src *EFT, dst *EFT) string {
+	cp, err := src.MakeCheckpoint()
+	if err != nil {
+		panic(err)
+	}
+
+	// The src root is what dst is about to merge, so it's the
+	// common ancestor for the next time src merges.
+	err = cp.MarkSynced()
+	if err != nil {
+		panic(err)
+	}
+	cp.Commit()
+
+	err = dst.FetchRemote(HexToHash(cp.Hash), testFetchFn(src))
+	if err != nil {
+		panic(err)
+	}
+
+	err = dst.MergeRemote(HexToHash(cp.Hash))
+	if err != nil {
+		panic(err)
+	}
+
+	cp, err = dst.MakeCheckpoint()
+	if err != nil {
+		panic(err)
+	}
+	cp.Commit()
+
+	return cp.Hash
+}
@@ -0,0 +1,338 @@
+package eft
+
+// Verify walks everything reachable from the snapshot list and checks each
+// block the way loadBlock would, but keeps going after a failure so every
+// problem is found in one pass. File contents are also checked against the
+// hash in their ItemInfo.
+
+import (
+	"encoding/binary"
+	"crypto/sha256"
+	"fmt"
+)
+
+type VerifyProblem struct {
+	Hash  [32]byte
+	Error string
+	Paths []string // Items depending on the block, or where it was found
+}
+
+type VerifyReport struct {
+	Blocks   int // Distinct blocks checked
+	Items    int // Distinct items checked
+	Problems []VerifyProblem
+}
+
+func (vr *VerifyReport) OK() bool {
+	return len(vr.Problems) == 0
+}
+
+type verifier struct {
+	eft      *EFT
+	checked  map[[32]byte]bool // Block hash => good
+	items    map[[32]byte]bool
+	problems map[[32]byte]int  // Block hash => index in report
+	report   VerifyReport
+}
+
+func (eft *EFT) Verify() (VerifyReport, error) {
+	eft.Lock()
+	defer eft.Unlock()
+
+	return eft.verify()
+}
+
+func (eft *EFT) verify() (VerifyReport, error) {
+	vv := &verifier{
+		eft:      eft,
+		checked:  make(map[[32]byte]bool),
+		items:    make(map[[32]byte]bool),
+		problems: make(map[[32]byte]int),
+	}
+
+	hash, err := eft.loadSnapsHash()
+	if err == ErrNotFound {
+		return vv.report, nil
+	}
+	if err != nil {
+		return vv.report, trace(err)
+	}
+
+	_, ok := vv.checkBlock(hash, "snapshot list")
+	if !ok {
+		return vv.finish(), nil
+	}
+
+	snaps, err := eft.loadSnapsFrom(hash)
+	if err != nil {
+		return vv.report, trace(err)
+	}
+
+	for ii, snap := range(snaps) {
+		vv.verifySnap(ii, snap)
+	}
+
+	return vv.finish(), nil
+}
+
+func (vv *verifier) finish() VerifyReport {
+	vv.report.Blocks = len(vv.checked)
+	vv.report.Items  = len(vv.items)
+	return vv.report
+}
+
+func (vv *verifier) problem(hash [32]byte, msg string, where string) {
+	idx, seen := vv.problems[hash]
+	if !seen {
+		idx = len(vv.report.Problems)
+		vv.problems[hash] = idx
+
+		vv.report.Problems = append(vv.report.Problems, VerifyProblem{
+			Hash:  hash,
+			Error: msg,
+		})
+	}
+
+	prob := &vv.report.Problems[idx]
+
+	for _, pp := range(prob.Paths) {
+		if pp == where {
+			return
+		}
+	}
+
+	prob.Paths = append(prob.Paths, where)
+}
+
+// Checks that a block is present, has the right hash and decrypts. Returns
+// its data if it's good.
+func (vv *verifier) checkBlock(hash [32]byte, where string) ([]byte, bool) {
+	good, seen := vv.checked[hash]
+	if seen && !good {
+		vv.problem(hash, "", where)
+		return nil, false
+	}
+
+	vv.checked[hash] = false
+
+	ctxt, err := vv.eft.store().Get(hash)
+	if err == ErrNotFound {
+		vv.problem(hash, "missing", where)
+		return nil, false
+	}
+	if err != nil {
+		vv.problem(hash, err.Error(), where)
+		return nil, false
+	}
+
+	if HashSlice(ctxt) != hash {
+		vv.problem(hash, "hash mismatch", where)
+		return nil, false
+	}
+
+	data, err := vv.eft.openBlock(ctxt)
+	if err != nil {
+		vv.problem(hash, "can't decrypt: " + err.Error(), where)
+		return nil, false
+	}
+
+	vv.checked[hash] = true
+	return data, true
+}
+
+func (vv *verifier) verifySnap(ii int, snap Snapshot) {
+	where := fmt.Sprintf("snapshot %d", ii)
+
+	if snap.Log != ZERO_HASH {
+		_, ok := vv.checkBlock(snap.Log, where + " log")
+		if ok {
+			ul, err := vv.eft.loadLog(snap.Log)
+			if err != nil {
+				vv.problem(snap.Log, err.Error(), where + " log")
+			} else {
+				for _, ref := range(ul.sealed) {
+					vv.checkBlock(ref.Hash, where + " log")
+				}
+			}
+		}
+	}
+
+	if snap.isEmpty() {
+		return
+	}
+
+	_, ok := vv.checkBlock(snap.Root, where + " path trie")
+	if !ok {
+		return
+	}
+
+	pt, err := vv.eft.loadPathTrie(snap.Root)
+	if err != nil {
+		vv.problem(snap.Root, err.Error(), where + " path trie")
+		return
+	}
+
+	vv.walkTrie(pt.root, where + " path trie", func(ent TrieEntry) {
+		vv.verifyItem(ent.Hash)
+	})
+
+	dirs := pt.dirsHash()
+	if dirs == ZERO_HASH {
+		return
+	}
+
+	_, ok = vv.checkBlock(dirs, where + " directory index")
+	if !ok {
+		return
+	}
+
+	dt, err := vv.eft.loadDirTrie(dirs)
+	if err != nil {
+		vv.problem(dirs, err.Error(), where + " directory index")
+		return
+	}
+
+	// The items are the same as in the path trie.
+	vv.walkTrie(dt.root, where + " directory index", func(ent TrieEntry) {})
+}
+
+// Checks the child nodes and overflow tables below a loaded trie node, and
+// calls fn for each item entry found.
+func (vv *verifier) walkTrie(tn *TrieNode, where string, fn func(ent TrieEntry)) {
+	for oi, hash := range(tn.ovr) {
+		if hash == ZERO_HASH {
+			continue
+		}
+
+		_, ok := vv.checkBlock(hash, where)
+		if !ok {
+			continue
+		}
+
+		ot, err := tn.loadOverflow(oi)
+		if err != nil {
+			vv.problem(hash, err.Error(), where)
+			continue
+		}
+
+		for _, ent := range(ot.tab) {
+			if ent.Type == TRIE_TYPE_ITEM {
+				fn(ent)
+			}
+		}
+	}
+
+	for _, ent := range(tn.tab) {
+		switch ent.Type {
+		case TRIE_TYPE_ITEM:
+			fn(ent)
+
+		case TRIE_TYPE_MORE:
+			_, ok := vv.checkBlock(ent.Hash, where)
+			if !ok {
+				continue
+			}
+
+			next, err := tn.loadChild(ent.Hash)
+			if err != nil {
+				vv.problem(ent.Hash, err.Error(), where)
+				continue
+			}
+
+			vv.walkTrie(next, where, fn)
+		}
+	}
+}
+
+func (vv *verifier) verifyItem(hash [32]byte) {
+	if vv.items[hash] {
+		return
+	}
+	vv.items[hash] = true
+
+	data, ok := vv.checkBlock(hash, "item")
+	if !ok {
+		return
+	}
+
+	spill := infoSpill(data[0:INFO_SIZE])
+	if spill != ZERO_HASH {
+		_, ok := vv.checkBlock(spill, "item")
+		if !ok {
+			return
+		}
+	}
+
+	info, err := vv.eft.infoFromBytes(data[0:INFO_SIZE])
+	if err != nil {
+		vv.problem(hash, "bad item header: " + err.Error(), "item")
+		return
+	}
+
+	if info.Type == INFO_DIR || info.Type == INFO_TOMB {
+		return
+	}
+
+	if info.Size <= SMALL_MAX {
+		vv.checkContent(hash, info, data[4096:4096 + info.Size])
+		return
+	}
+
+	trie, err := vv.eft.loadLargeTrie(hash)
+	if err != nil {
+		vv.problem(hash, err.Error(), info.Path)
+		return
+	}
+
+	ents := make(map[uint64]TrieEntry)
+
+	vv.walkTrie(trie.root, info.Path, func(ent TrieEntry) {
+		ents[binary.LittleEndian.Uint64(ent.Pkey[:])] = ent
+	})
+
+	sha  := sha256.New()
+	left := info.Size
+	good := true
+
+	for ii := uint64(0); left > 0; ii++ {
+		ent, found := ents[ii]
+		if !found {
+			vv.problem(hash, fmt.Sprintf("block %d missing from list", ii), info.Path)
+			return
+		}
+
+		data, ok := vv.checkBlock(ent.Hash, info.Path)
+		if !ok {
+			good = false
+		}
+
+		size := uint64(chunkLen(ent))
+		if size > left {
+			size = left
+		}
+		left -= size
+
+		if good {
+			sha.Write(data[:size])
+		}
+	}
+
+	if good && info.Type == INFO_FILE && info.Hash != ZERO_HASH {
+		sum := [32]byte{}
+		copy(sum[:], sha.Sum(nil))
+
+		if sum != info.Hash {
+			vv.problem(hash, "content doesn't match hash", info.Path)
+		}
+	}
+}
+
+func (vv *verifier) checkContent(hash [32]byte, info ItemInfo, data []byte) {
+	if info.Type != INFO_FILE || info.Hash == ZERO_HASH {
+		return
+	}
+
+	if HashSlice(data) != info.Hash {
+		vv.problem(hash, "content doesn't match hash", info.Path)
+	}
+}
@@ -0,0 +1,87 @@
+package eft
+
+import (
+	"io/ioutil"
+	"testing"
+	"path"
+	"fmt"
+	"os"
+)
+
+func TestVerify(tt *testing.T) {
+	eft_dir := TmpRandomName()
+	src_dir := TmpRandomName()
+
+	defer os.RemoveAll(eft_dir)
+	defer os.RemoveAll(src_dir)
+
+	eft := &EFT{Key: [32]byte{}, Dir: eft_dir}
+
+	err := os.MkdirAll(src_dir, 0700)
+	if err != nil {
+		panic(err)
+	}
+
+	small := path.Join(src_dir, "small")
+	large := path.Join(src_dir, "large")
+
+	err = ioutil.WriteFile(small, []byte("a small file\n"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	err = ioutil.WriteFile(large, RandomBytes(4 * DATA_SIZE), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	putTestFile(eft, small)
+	putTestFile(eft, large)
+
+	report, err := eft.Verify()
+	if err != nil {
+		panic(err)
+	}
+
+	if !report.OK() || report.Items != 2 {
+		fmt.Println("Problems in a good EFT:", report.Problems)
+		tt.Fail()
+	}
+
+	// Damage one data block and remove another.
+	bad := make([][32]byte, 0)
+	for hash := range(testItemBlocks(eft, large)) {
+		bad = append(bad, hash)
+	}
+
+	err = ioutil.WriteFile(eft.BlockPath(bad[0]), RandomBytes(BLOCK_SIZE), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	err = os.Remove(eft.BlockPath(bad[1]))
+	if err != nil {
+		panic(err)
+	}
+
+	report, err = eft.Verify()
+	if err != nil {
+		panic(err)
+	}
+
+	errs := make(map[[32]byte]string)
+
+	for _, prob := range(report.Problems) {
+		errs[prob.Hash] = prob.Error
+
+		if len(prob.Paths) != 1 || prob.Paths[0] != large {
+			fmt.Println("Wrong paths for bad block:", prob.Paths)
+			tt.Fail()
+		}
+	}
+
+	if len(errs) != 2 || errs[bad[0]] != "hash mismatch" || errs[bad[1]] != "missing" {
+		fmt.Println("Wrong problems found:", report.Problems)
+		tt.Fail()
+	}
+}
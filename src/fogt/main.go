@@ -2,8 +2,10 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"encoding/hex"
+	"encoding/json"
 	"github.com/ogier/pflag"
 	"../eft"
 )
@@ -14,9 +16,14 @@ func ShowUsage() {
 	fmt.Fprintf(os.Stderr, "\nCommands:\n")
 	fmt.Fprintf(os.Stderr, "  fogt put \"Documents/pineapple.gif\"\n")
 	fmt.Fprintf(os.Stderr, "  fogt get \"Documents/pineapple.gif\"\n")
+	fmt.Fprintf(os.Stderr, "  fogt cat \"Documents/notes.txt\"\n")
 	fmt.Fprintf(os.Stderr, "  fogt del \"Documents/pineapple.gif\"\n")
+	fmt.Fprintf(os.Stderr, "  fogt mv \"Documents/pineapple.gif\" \"Pictures/pineapple.gif\"\n")
 	fmt.Fprintf(os.Stderr, "  fogt blocks\n")
 	fmt.Fprintf(os.Stderr, "  fogt gc\n")
+	fmt.Fprintf(os.Stderr, "  fogt purge\n")
+	fmt.Fprintf(os.Stderr, "  fogt fsck\n")
+	fmt.Fprintf(os.Stderr, "  fogt diff OLD_ROOT [NEW_ROOT]\n")
 	fmt.Fprintf(os.Stderr, "  fogt ls \"Documents\"\n")
 	fmt.Fprintf(os.Stderr, "  fogt dump\n")
 	fmt.Fprintf(os.Stderr, "\nFlags:\n")
@@ -35,7 +42,7 @@ func main() {
 	//fmt.Println("Eft Key:", *key)
 
 	args := pflag.Args()
-	if len(args) < 1 || len(args) > 2 {
+	if len(args) < 1 || len(args) > 3 {
 		pflag.Usage()
 		os.Exit(1)
 	}
@@ -47,6 +54,21 @@ func main() {
 		Dir: *dir,
 	}
 
+	if cmd == "diff" && len(args) > 1 {
+		diffCmd(trie, args[1:])
+		return
+	}
+
+	if cmd == "mv" && len(args) == 3 {
+		mvCmd(trie, args[1], args[2])
+		return
+	}
+
+	if len(args) > 2 {
+		pflag.Usage()
+		os.Exit(1)
+	}
+
 	if len(args) == 1 {
 		switch cmd {
 		case "gc":
@@ -55,6 +77,10 @@ func main() {
 			dumpCmd(trie)
 		case "blocks":
 			blocksCmd(trie)
+		case "fsck":
+			fsckCmd(trie)
+		case "purge":
+			purgeCmd(trie)
 		default:
 			pflag.Usage()
 			os.Exit(1)
@@ -70,6 +96,8 @@ func main() {
 		putCmd(trie, tgt)
 	case "get":
 		getCmd(trie, tgt)
+	case "cat":
+		catCmd(trie, tgt)
 	case "del":
 		delCmd(trie, tgt)
 	case "ls":
@@ -97,6 +125,11 @@ func dumpCmd(trie *eft.EFT) {
 }
 
 func gcCmd(trie *eft.EFT) {
+	err := trie.RequestFullCollect()
+	if err != nil {
+		panic(err)
+	}
+
 	cp, err := trie.MakeCheckpoint()
 	if err != nil {
 		panic(err)
@@ -105,6 +138,71 @@ func gcCmd(trie *eft.EFT) {
 	cp.Commit()
 }
 
+func purgeCmd(trie *eft.EFT) {
+	count, err := trie.PurgeTombstones()
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("Purged %d tombstones\n", count)
+}
+
+func fsckCmd(trie *eft.EFT) {
+	report, err := trie.Verify()
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("Checked %d blocks in %d items\n", report.Blocks, report.Items)
+
+	for _, prob := range(report.Problems) {
+		fmt.Printf("%s: %s\n", hex.EncodeToString(prob.Hash[:]), prob.Error)
+
+		for _, pp := range(prob.Paths) {
+			fmt.Println("  ", pp)
+		}
+	}
+
+	if !report.OK() {
+		fmt.Println(len(report.Problems), "bad blocks")
+		os.Exit(1)
+	}
+}
+
+// Roots are given as printed by RootHash, defaulting to the current one.
+func diffCmd(trie *eft.EFT, roots []string) {
+	root_a := parseRoot(roots[0])
+
+	var root_b [32]byte
+	if len(roots) > 1 {
+		root_b = parseRoot(roots[1])
+	} else {
+		root_b = parseRoot(trie.RootHash1())
+	}
+
+	changes, err := trie.Diff(root_a, root_b)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, ch := range(changes) {
+		fmt.Printf("%-12s %s\n", ch.Kind, ch.Path)
+	}
+}
+
+func parseRoot(text string) [32]byte {
+	var root [32]byte
+
+	sli, err := hex.DecodeString(text)
+	if err != nil || len(sli) != 32 {
+		fmt.Fprintf(os.Stderr, "Bad root hash: %s\n", text)
+		os.Exit(1)
+	}
+
+	copy(root[:], sli)
+	return root
+}
+
 func putCmd(trie *eft.EFT, tgt string) {
 	info, err := eft.FastItemInfo(tgt)
 	if err != nil {
@@ -137,6 +235,24 @@ func getCmd(trie *eft.EFT, tgt string) {
 	//fmt.Println("Got:", info.String())
 }
 
+func catCmd(trie *eft.EFT, tgt string) {
+	src, err := trie.Open(tgt)
+	if err != nil {
+		if err == eft.ErrNotFound {
+			fmt.Println("Not found")
+			os.Exit(2)
+		} else {
+			panic(err)
+		}
+	}
+	defer src.Close()
+
+	_, err = io.Copy(os.Stdout, src)
+	if err != nil {
+		panic(err)
+	}
+}
+
 func delCmd(trie *eft.EFT, tgt string) {
 	fmt.Println("Del", tgt)
 
@@ -146,6 +262,15 @@ func delCmd(trie *eft.EFT, tgt string) {
 	}
 }
 
+func mvCmd(trie *eft.EFT, src string, dst string) {
+	fmt.Println("Move", src, "to", dst)
+
+	err := trie.Move(src, dst)
+	if err != nil {
+		panic(err)
+	}
+}
+
 func lsCmd(trie *eft.EFT, tgt string) {
 	list, err := trie.ListDir(tgt)
 	if err != nil {
@@ -165,7 +290,10 @@ func blocksCmd(trie *eft.EFT) {
 		 panic(err)
 	}
 
-	for _, bb := range(blocks) {
-		fmt.Println(bb)
+	data, err := json.MarshalIndent(blocks, "", "  ")
+	if err != nil {
+		panic(err)
 	}
+
+	fmt.Println(string(data))
 }
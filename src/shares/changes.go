@@ -9,11 +9,50 @@ import (
 	"../fs"
 )
 
+// New files found by a scan are added SCAN_BATCH at a time in one EFT
+// transaction, so importing a large tree doesn't write a root per file.
+var SCAN_BATCH = 1000
+
+type scanBatch struct {
+	share *Share
+	paths []string
+}
+
+func (ss *Share) newScanBatch() *scanBatch {
+	return &scanBatch{share: ss}
+}
+
+func (sb *scanBatch) add(full_path string) {
+	sb.paths = append(sb.paths, full_path)
+
+	if len(sb.paths) >= SCAN_BATCH {
+		sb.flush()
+	}
+}
+
+func (sb *scanBatch) flush() {
+	if len(sb.paths) == 0 {
+		return
+	}
+
+	go sb.share.copyInBatch(sb.paths)
+	sb.paths = nil
+}
+
 func (ss *Share) gotChange(full_path string) {
+	ss.scanChange(full_path, nil)
+}
+
+// Checks a path against the EFT. A new file goes in the batch if there
+// is one.
+func (ss *Share) scanChange(full_path string, batch *scanBatch) {
 	defer func() {
 		re := recover()
 		if re != nil {
 			fmt.Println("XX - gotChange error:", re)
+			if ss.Trie.Damaged() {
+				ss.RequestSync()
+			}
 			ss.Watcher.Changed(full_path)
 		}
 	}()
@@ -28,7 +67,8 @@ func (ss *Share) gotChange(full_path string) {
 	}
 
 	curr_info, err := ss.Trie.GetInfo(rel_path)
-	if err == eft.ErrNotFound {
+	found := err != eft.ErrNotFound
+	if !found {
 		fmt.Println("XX - (gotChange) Nothing found for", full_path, "(" + rel_path + ")")
 		curr_info.ModT = 0
 		err = nil
@@ -42,6 +82,8 @@ func (ss *Share) gotChange(full_path string) {
 	if curr_info.ModT > stamp {
 		ss.copyOutPath(full_path, rel_path)
 		ss.RequestSync()
+	} else if batch != nil && !found {
+		batch.add(full_path)
 	} else {
 		go ss.copyInPath(full_path, rel_path)
 	}
@@ -58,6 +100,10 @@ func (ss *Share) gotDelete(full_path string, stamp uint64) {
 	}
 	fs.CheckError(err)
 
+	if curr_info.IsTomb() {
+		return
+	}
+
 	if curr_info.ModT > stamp {
 		fmt.Println("XX - Delete older than EFT record; shouldn't happen.")
 		// I guess we revert it.
@@ -73,10 +119,52 @@ func (ss *Share) gotDelete(full_path string, stamp uint64) {
 	ss.RequestSync()
 }
 
+// Handles a rename as a move in the EFT, so the item's data blocks are
+// kept. Returns false if the new path doesn't look like the old item.
+func (ss *Share) gotMove(old_path string, new_path string) bool {
+	old_rel := ss.RelPath(old_path)
+	new_rel := ss.RelPath(new_path)
+
+	sysi, err := os.Lstat(new_path)
+	if err != nil {
+		return false
+	}
+
+	info, err := ss.Trie.GetInfo(old_rel)
+	if err != nil || info.IsTomb() {
+		return false
+	}
+
+	if info.ModT != uint64(sysi.ModTime().UnixNano()) {
+		return false
+	}
+
+	if sysi.Mode().IsRegular() && info.Size != uint64(sysi.Size()) {
+		return false
+	}
+
+	err = ss.Trie.Move(old_rel, new_rel)
+	if err != nil {
+		fmt.Println("XX - Move:", err)
+		return false
+	}
+
+	fmt.Println("XX - Moved", old_rel, "to", new_rel)
+
+	ss.RequestSync()
+	return true
+}
+
 func (ss *Share) copyOutPath(full_path string, rel_path string) {
 	dir := path.Dir(full_path)
 	err := os.MkdirAll(dir, 0700)
 	fs.CheckError(err)
+
+	// The old copy may have been saved read-only.
+	sysi, err := os.Lstat(full_path)
+	if err == nil && sysi.Mode().IsRegular() {
+		os.Chmod(full_path, sysi.Mode().Perm() | 0200)
+	}
 	
 	info, err := ss.Trie.Get(rel_path, full_path)
 	fs.CheckError(err)
@@ -87,6 +175,11 @@ func (ss *Share) copyOutPath(full_path string, rel_path string) {
 	}
 	
 	fmt.Println("XX - Copy out to", full_path)
+
+	err = info.Apply(full_path)
+	if err != nil {
+		fmt.Println("XX - Apply:", err)
+	}
 	
 	err = os.Chtimes(full_path, info.ModTime(), info.ModTime())
 	if err != nil {
@@ -95,6 +188,95 @@ func (ss *Share) copyOutPath(full_path string, rel_path string) {
 	}
 }
 
+// Adds new files in one transaction. Files that are still changing go
+// back to the watcher. This runs in its own goroutine, so errors are
+// logged and the whole batch goes back to the watcher if it can't be
+// committed.
+func (ss *Share) copyInBatch(full_paths []string) {
+	fmt.Println("XX - Copy in batch of", len(full_paths))
+
+	stamps := make(map[string]time.Time)
+	for _, full_path := range(full_paths) {
+		sysi, err := os.Lstat(full_path)
+		if err == nil {
+			stamps[full_path] = sysi.ModTime()
+		}
+	}
+
+	time.Sleep(1 * time.Second)
+
+	txn, err := ss.Trie.Begin()
+	if err != nil {
+		fmt.Println("XX - Copy in batch:", err)
+		ss.requeueBatch(full_paths)
+		return
+	}
+
+	for _, full_path := range(full_paths) {
+		sysi, err := os.Lstat(full_path)
+		if err != nil || sysi.ModTime() != stamps[full_path] {
+			go ss.Watcher.Changed(full_path)
+			continue
+		}
+
+		err = ss.copyInTxn(txn, full_path, sysi)
+		if err != nil && txn.Failed() {
+			fmt.Println("XX - Copy in batch aborted:", err)
+			txn.Abort()
+			ss.requeueBatch(full_paths)
+			return
+		}
+		if err != nil {
+			fmt.Println("XX - Copy in:", err)
+			go ss.Watcher.Changed(full_path)
+		}
+	}
+
+	err = txn.Commit()
+	if err != nil {
+		fmt.Println("XX - Copy in batch commit:", err)
+		ss.requeueBatch(full_paths)
+	}
+}
+
+// Sends every path in a batch back to the watcher, to be copied in again
+// one at a time.
+func (ss *Share) requeueBatch(full_paths []string) {
+	if ss.Trie.Damaged() {
+		ss.RequestSync()
+	}
+
+	for _, full_path := range(full_paths) {
+		go ss.Watcher.Changed(full_path)
+	}
+}
+
+func (ss *Share) copyInTxn(txn *eft.Txn, full_path string, sysi os.FileInfo) error {
+	info, err := eft.NewItemInfo(ss.RelPath(full_path), full_path, sysi)
+	if err != nil {
+		return fs.Trace(err)
+	}
+
+	temp := ss.Trie.TempName()
+	defer os.Remove(temp)
+
+	switch info.Type {
+	case eft.INFO_FILE:
+		err = fs.CopyFile(temp, full_path)
+	case eft.INFO_LINK:
+		err = fs.ReadLink(temp, full_path)
+	case eft.INFO_DIR:
+		err = fs.CopyFile(temp, "/dev/null")
+	default:
+		err = fmt.Errorf("Unknown type: %s", info.TypeName())
+	}
+	if err != nil {
+		return fs.Trace(err)
+	}
+
+	return txn.Put(info, temp)
+}
+
 func (ss *Share) copyInPath(full_path string, rel_path string) {
 	fmt.Println("XX - Copy in from", full_path)
 
@@ -137,6 +319,7 @@ func (ss *Share) copyInPath(full_path string, rel_path string) {
 		fs.PanicHere(fmt.Sprintf("Unknown type: %s", info.TypeName()))
 	}
 
-	err = ss.Trie.Put(info, temp)
+	// Only the changed blocks of an edited large file get saved.
+	err = ss.Trie.Update(info, temp)
 	fs.CheckError(err)
 }
@@ -0,0 +1,217 @@
+package shares
+
+// Snapshots of a share are taken automatically around each sync and
+// pruned on a schedule. By default that's one per hour for a day, one per
+// day for a week and one per week for a month.
+//
+// Each hour, day or week keeps its newest snapshot, and the current one
+// counts, so reaching a whole period back takes an extra bucket: 25
+// hourly, 8 daily and 6 weekly (a month is over four weeks). The newest
+// snapshot is in all three, so that's at most 25 + 7 + 5 = 37, which is
+// why eft.MAX_SNAPS is 40. If a share also has manual snapshots and the
+// total doesn't fit, the oldest automatic ones are dropped.
+//
+// Only snapshots with the AUTO_SNAP_DESC description are managed here, so
+// snapshots taken by hand are never pruned. Since the snapshot list is
+// merged between devices, the schedule is applied to snapshots taken on
+// any device.
+
+import (
+	"sort"
+	"time"
+	"fmt"
+	"../eft"
+	"../fs"
+)
+
+const AUTO_SNAP_DESC = "auto"
+
+type RetentionConfig struct {
+	Hourly int // Number of hourly snapshots to keep
+	Daily  int // Number of daily snapshots to keep
+	Weekly int // Number of weekly snapshots to keep
+}
+
+// Used when a share has no retention config.
+var DefaultRetention = RetentionConfig{
+	Hourly: 25,
+	Daily:  8,
+	Weekly: 6,
+}
+
+func (ss *Share) retention() RetentionConfig {
+	ss.Lock()
+	defer ss.Unlock()
+
+	if ss.Config.Retention == nil {
+		return DefaultRetention
+	}
+
+	return *ss.Config.Retention
+}
+
+func (ss *Share) SetRetention(rc RetentionConfig) {
+	ss.Lock()
+	defer ss.Unlock()
+
+	ss.Config.Retention = &rc
+
+	ss.save()
+}
+
+func snapModTime(snap eft.Snapshot) time.Time {
+	return time.Unix(0, int64(snap.Time))
+}
+
+func hourBucket(tt time.Time) string {
+	return tt.Format("2006-01-02 15")
+}
+
+func dayBucket(tt time.Time) string {
+	return tt.Format("2006-01-02")
+}
+
+func weekBucket(tt time.Time) string {
+	year, week := tt.ISOWeek()
+	return fmt.Sprintf("%d-%d", year, week)
+}
+
+// An automatic snapshot, by its position in the snapshot list. The one
+// about to be taken has index -1.
+type autoSnap struct {
+	time  time.Time
+	index int
+}
+
+// Keeps the newest snapshot in each of the count newest buckets.
+func keepBuckets(autos []autoSnap, count int, bucket func(time.Time) string, keep map[int]bool) {
+	seen := make(map[string]bool)
+
+	for ii, as := range(autos) {
+		if len(seen) >= count {
+			break
+		}
+
+		bb := bucket(as.time)
+		if seen[bb] {
+			continue
+		}
+
+		seen[bb] = true
+		keep[ii] = true
+	}
+}
+
+type autosByNewest []autoSnap
+
+func (as autosByNewest) Len() int           { return len(as) }
+func (as autosByNewest) Less(ii, jj int) bool { return as[ii].time.After(as[jj].time) }
+func (as autosByNewest) Swap(ii, jj int)      { as[ii], as[jj] = as[jj], as[ii] }
+
+// Decides whether to take a new automatic snapshot at time now, and which
+// existing snapshots to delete. Returns the deleted indexes in decreasing
+// order, so they can be deleted one at a time.
+func planRetention(rc RetentionConfig, snaps []eft.Snapshot, now time.Time) (bool, []int) {
+	autos := make([]autoSnap, 0)
+	manual := 0
+
+	// A new snapshot is only needed if there isn't one in the current
+	// bucket of the shortest period.
+	finest := hourBucket
+	if rc.Hourly == 0 {
+		finest = dayBucket
+		if rc.Daily == 0 {
+			finest = weekBucket
+		}
+	}
+
+	current := false
+
+	for ii := 1; ii < len(snaps); ii++ {
+		if snaps[ii].Desc != AUTO_SNAP_DESC {
+			manual++
+			continue
+		}
+
+		tt := snapModTime(snaps[ii])
+		autos = append(autos, autoSnap{tt, ii})
+
+		if finest(tt) == finest(now) {
+			current = true
+		}
+	}
+
+	if !current {
+		autos = append(autos, autoSnap{now, -1})
+	}
+
+	// Snapshots can share a time, so ties keep their list order.
+	sort.Stable(autosByNewest(autos))
+
+	keep := make(map[int]bool)
+	keepBuckets(autos, rc.Hourly, hourBucket, keep)
+	keepBuckets(autos, rc.Daily, dayBucket, keep)
+	keepBuckets(autos, rc.Weekly, weekBucket, keep)
+
+	// Stay within the snapshot limit by dropping the oldest.
+	room := eft.MAX_SNAPS - manual
+	if room < 0 {
+		room = 0
+	}
+
+	take := false
+	dels := make([]int, 0)
+
+	for ii, as := range(autos) {
+		if keep[ii] && room > 0 {
+			room--
+			if as.index < 0 {
+				take = true
+			}
+			continue
+		}
+
+		if as.index >= 0 {
+			dels = append(dels, as.index)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(dels)))
+
+	return take, dels
+}
+
+// Takes and prunes automatic snapshots. Called from sync() after the
+// remote snapshots have been merged in.
+func (ss *Share) applyRetention() error {
+	snaps, err := ss.Trie.ListSnapshots()
+	if err != nil {
+		return fs.Trace(err)
+	}
+
+	if snaps[0].Root == eft.ZERO_HASH {
+		return nil
+	}
+
+	take, dels := planRetention(ss.retention(), snaps, time.Now())
+
+	for _, idx := range(dels) {
+		fmt.Println("XX - Retention: Deleting snapshot from", snapModTime(snaps[idx]))
+
+		err := ss.Trie.DeleteSnapshot(idx)
+		if err != nil {
+			return fs.Trace(err)
+		}
+	}
+
+	if take {
+		fmt.Println("XX - Retention: Taking snapshot")
+
+		_, err := ss.Trie.TakeSnapshot(AUTO_SNAP_DESC)
+		if err != nil {
+			return fs.Trace(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package shares
+
+import (
+	"testing"
+	"time"
+	"fmt"
+	"../eft"
+)
+
+func TestPlanRetention(tt *testing.T) {
+	rc := RetentionConfig{Hourly: 3, Daily: 2, Weekly: 0}
+	now := time.Date(2014, 6, 10, 12, 30, 0, 0, time.Local)
+
+	snaps := []eft.Snapshot{eft.Snapshot{}}
+
+	add := func(ago time.Duration, desc string) {
+		snap := eft.Snapshot{
+			Time: uint64(now.Add(-ago).UnixNano()),
+			Desc: desc,
+		}
+		snaps = append(snaps, snap)
+	}
+
+	add(10 * time.Minute, AUTO_SNAP_DESC) // 1: this hour
+	add(70 * time.Minute, AUTO_SNAP_DESC) // 2: last hour
+	add(80 * time.Minute, AUTO_SNAP_DESC) // 3: last hour, older
+	add(3 * time.Hour, AUTO_SNAP_DESC)    // 4: third hour
+	add(5 * time.Hour, AUTO_SNAP_DESC)    // 5: too old for hourly
+	add(26 * time.Hour, AUTO_SNAP_DESC)   // 6: yesterday
+	add(50 * time.Hour, AUTO_SNAP_DESC)   // 7: too old for daily
+	add(90 * time.Hour, "manual")         // 8: never pruned
+
+	take, dels := planRetention(rc, snaps, now)
+
+	if take {
+		fmt.Println("Took a snapshot with one in the current hour")
+		tt.Fail()
+	}
+
+	want := []int{7, 5, 3}
+
+	if fmt.Sprint(dels) != fmt.Sprint(want) {
+		fmt.Println("Deleted", dels, "expected", want)
+		tt.Fail()
+	}
+
+	take, _ = planRetention(rc, snaps, now.Add(time.Hour))
+	if !take {
+		fmt.Println("Didn't take a snapshot in a new hour")
+		tt.Fail()
+	}
+
+	take, dels = planRetention(RetentionConfig{}, snaps, now)
+	if take || len(dels) != 7 {
+		fmt.Println("Empty retention config should remove all auto snapshots")
+		tt.Fail()
+	}
+}
+
+func TestPlanRetentionSameTime(tt *testing.T) {
+	rc := RetentionConfig{Hourly: 3}
+	now := time.Date(2014, 6, 10, 12, 30, 0, 0, time.Local)
+
+	// Two devices took a snapshot at the same time.
+	at := uint64(now.Add(-70 * time.Minute).UnixNano())
+
+	snaps := []eft.Snapshot{
+		eft.Snapshot{},
+		eft.Snapshot{Time: uint64(now.UnixNano()), Desc: AUTO_SNAP_DESC},
+		eft.Snapshot{Time: at, Desc: AUTO_SNAP_DESC},
+		eft.Snapshot{Time: at, Desc: AUTO_SNAP_DESC},
+	}
+
+	_, dels := planRetention(rc, snaps, now)
+
+	want := []int{3}
+
+	if fmt.Sprint(dels) != fmt.Sprint(want) {
+		fmt.Println("Deleted", dels, "expected", want)
+		tt.Fail()
+	}
+}
+
+func TestDefaultRetention(tt *testing.T) {
+	rc := DefaultRetention
+
+	now := time.Date(2014, 6, 10, 12, 30, 0, 0, time.Local)
+
+	// Run the schedule with a sync every hour for two months.
+	snaps := []eft.Snapshot{eft.Snapshot{}}
+
+	for hh := 0; hh < 24 * 60; hh++ {
+		at := now.Add(time.Duration(hh) * time.Hour)
+
+		take, dels := planRetention(rc, snaps, at)
+
+		for _, idx := range(dels) {
+			snaps = append(snaps[:idx], snaps[idx + 1:]...)
+		}
+
+		if take {
+			snap := eft.Snapshot{Time: uint64(at.UnixNano()), Desc: AUTO_SNAP_DESC}
+			snaps = append(snaps, snap)
+		}
+	}
+
+	end := now.Add(24 * 60 * time.Hour)
+
+	hours := 0
+	days := 0
+	oldest := time.Duration(0)
+
+	for _, snap := range(snaps[1:]) {
+		age := end.Sub(snapModTime(snap))
+
+		if age < 24 * time.Hour {
+			hours++
+		} else if age < 7 * 24 * time.Hour {
+			days++
+		}
+
+		if age > oldest {
+			oldest = age
+		}
+	}
+
+	// Hourly for a day, daily for the rest of the week, weekly back to
+	// a month.
+	if hours < 23 || days < 6 || oldest < 30 * 24 * time.Hour {
+		fmt.Println("Wrong schedule:", hours, "hourly,", days, "daily, oldest", oldest)
+		tt.Fail()
+	}
+
+	if len(snaps) - 1 > eft.MAX_SNAPS {
+		fmt.Println("Kept too many snapshots:", len(snaps) - 1)
+		tt.Fail()
+	}
+}
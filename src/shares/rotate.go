@@ -0,0 +1,232 @@
+package shares
+
+// Replacing a share's key, for when a device that had it is lost.
+//
+// The new key is saved as NewKey first. The next sync still fetches and
+// merges the cloud share under the old key, so changes other devices
+// pushed to it aren't lost. Once that merge is uploaded and marked
+// synced, the root it left is saved as OldRoot and the local EFT is
+// re-encrypted, which can pick up where it left off after a crash. The
+// new key then becomes the share's key, keeping the old one as OldKey.
+// The cloud name of a share is derived from its key, so the following
+// sync creates a new cloud share with the new secrets and uploads every
+// block to it.
+//
+// The new share's secrets name the key it replaced as OldKey. Other
+// devices listing the cloud shares skip the one under that key, and a
+// device that still has it takes the new key as its own NewKey. It then
+// goes through the same steps, so changes it hadn't pushed yet are kept.
+//
+// Until they switch, other devices can still push to the old cloud share,
+// so after each sync to the new one we look at it again. A root other than
+// OldRoot is merged and becomes OldRoot. The old share is deleted once a
+// sync finds it unchanged, or OLD_SHARE_KEEP after the rotation, after
+// which pushes to it are dropped.
+//
+// The secrets of every share are encrypted under a key derived from the
+// master key, which the lost device also has. It can decrypt the new
+// share's secrets, and with them the new key, like any other device.
+// Locking it out completely takes a new master key as well.
+
+import (
+	"encoding/hex"
+	"time"
+	"fmt"
+	"../cloud"
+	"../fs"
+	"../eft"
+)
+
+// Pushes to the old cloud share are merged for this long.
+var OLD_SHARE_KEEP = 24 * time.Hour
+
+func (ss *Share) RotateKey() error {
+	ss.Lock()
+
+	if ss.Config.NewKey != "" || ss.Config.OldKey != "" {
+		ss.Unlock()
+		return fmt.Errorf("Key rotation already in progress")
+	}
+
+	ss.Config.NewKey = fs.RandomHex(32)
+	ss.Unlock()
+
+	ss.save()
+	ss.RequestSync()
+
+	return nil
+}
+
+// Switches to a key another device rotated to. Returns false if this
+// device is in the middle of a rotation of its own.
+func (ss *Share) adoptKey(new_key string) bool {
+	ss.Lock()
+
+	if ss.Config.NewKey != "" || ss.Config.OldKey != "" {
+		ss.Unlock()
+		return false
+	}
+
+	fmt.Println("XX - Taking rotated key for", ss.Config.Name)
+
+	ss.Config.NewKey = new_key
+	ss.Unlock()
+
+	ss.save()
+
+	return true
+}
+
+func (ss *Share) rotationPending() bool {
+	ss.Lock()
+	defer ss.Unlock()
+
+	return ss.Config.NewKey != ""
+}
+
+// Whether the EFT may already be partly under the new key.
+func (ss *Share) rotationStarted() bool {
+	ss.Lock()
+	defer ss.Unlock()
+
+	return ss.Config.NewKey != "" && ss.Config.OldRoot != ""
+}
+
+// Called once old_root is uploaded to the old cloud share and marked
+// synced, so nothing in it is left to merge.
+func (ss *Share) startRotation(old_root string) error {
+	ss.Lock()
+	ss.Config.OldRoot = old_root
+	ss.Unlock()
+
+	ss.save()
+
+	return ss.rotateKey()
+}
+
+// Switches the local EFT and the config to the new key.
+func (ss *Share) rotateKey() error {
+	ss.Lock()
+	new_key := ss.Config.NewKey
+	ss.Unlock()
+
+	fmt.Println("XX - Rotating key for", ss.Name())
+
+	key, err := hex.DecodeString(new_key)
+	if err != nil {
+		return fs.Trace(err)
+	}
+
+	err = ss.Trie.RotateKey(fs.DeriveKey(key, "cipher"), fs.DeriveKey(key, "nonce"))
+	if err != nil {
+		return fs.Trace(err)
+	}
+
+	ss.Lock()
+	ss.Config.OldKey = ss.Config.Key
+	ss.Config.Key = new_key
+	ss.Config.NewKey = ""
+	ss.Config.RotatedAt = time.Now().Unix()
+	ss.Unlock()
+
+	ss.save()
+
+	err = ss.Trie.FinishKeyRotation()
+	if err != nil {
+		return fs.Trace(err)
+	}
+
+	return nil
+}
+
+// Merges anything other devices pushed to the cloud share under the old
+// key since we left it, and deletes it once it stops changing or it's
+// been OLD_SHARE_KEEP. Only called after a sync to the share under the
+// new key.
+func (ss *Share) removeOldShare(cc *cloud.Cloud) error {
+	ss.Lock()
+	old_key := ss.Config.OldKey
+	old_root := ss.Config.OldRoot
+	rotated := time.Unix(ss.Config.RotatedAt, 0)
+	ss.Unlock()
+
+	if old_key == "" {
+		return nil
+	}
+
+	key, err := hex.DecodeString(old_key)
+	if err != nil {
+		return fs.Trace(err)
+	}
+
+	hmac_key := fs.DeriveKey(key, "hmac")
+	name_hmac := hex.EncodeToString(fs.HmacSlice([]byte(ss.Name()), hmac_key[:]))
+
+	sdata, err := cc.GetShare(name_hmac)
+	if err != nil && err != cloud.ErrNotFound {
+		return fs.Trace(err)
+	}
+
+	late := time.Since(rotated) < OLD_SHARE_KEEP
+
+	if err == nil && sdata.Root != "" && sdata.Root != old_root && late {
+		fmt.Println("XX - Merging late changes from old cloud share for", ss.Name())
+
+		fetch_fn := func(bs *eft.BlockSet) (*eft.BlockArchive, error) {
+			return ss.fetchBlocks(cc, name_hmac, bs)
+		}
+
+		err = ss.Trie.MergeOldKey(fs.DeriveKey(key, "cipher"), fs.DeriveKey(key, "nonce"),
+			eft.HexToHash(sdata.Root), fetch_fn)
+		if err != nil {
+			return fs.Trace(err)
+		}
+
+		ss.Lock()
+		ss.Config.OldRoot = sdata.Root
+		ss.Unlock()
+
+		ss.save()
+
+		// Upload the merge, and check the old share again after.
+		ss.RequestSync()
+		return nil
+	}
+
+	if err == nil {
+		if sdata.Root != old_root {
+			fmt.Println("XX - Dropping changes pushed to old cloud share for", ss.Name())
+		}
+
+		fmt.Println("XX - Removing old cloud share for", ss.Name())
+
+		err = cc.DeleteShare(name_hmac)
+		if err != nil && err != cloud.ErrNotFound {
+			return fs.Trace(err)
+		}
+	}
+
+	ss.Lock()
+	ss.Config.OldKey = ""
+	ss.Config.OldRoot = ""
+	ss.Config.RotatedAt = 0
+	ss.Unlock()
+
+	ss.save()
+
+	return nil
+}
+
+// Other devices get the new key in the cloud share's secrets, along with
+// the key it replaced.
+func (ss *Share) publicConfig() ShareConfig {
+	ss.Lock()
+	defer ss.Unlock()
+
+	cfg := *ss.Config
+	cfg.NewKey = ""
+	cfg.OldRoot = ""
+	cfg.RotatedAt = 0
+
+	return cfg
+}
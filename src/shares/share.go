@@ -5,6 +5,7 @@ import (
 	"os"
 	"fmt"
 	"sync"
+	"time"
 	"encoding/hex"
 	"encoding/base64"
 	"encoding/json"
@@ -16,6 +17,17 @@ import (
 type ShareConfig struct {
 	Name string
 	Key  string
+
+	Retention  *RetentionConfig `json:",omitempty"` // nil for the default
+	Chunking   bool             `json:",omitempty"` // Content-defined chunks
+	Convergent bool             `json:",omitempty"` // Content-derived nonces
+	Compress   bool             `json:",omitempty"` // Pack compressed blocks
+	TombDays   int              `json:",omitempty"` // Days to keep tombstones, 0 for the default
+
+	NewKey    string `json:",omitempty"` // Key being rotated to, see rotate.go
+	OldKey    string `json:",omitempty"` // Key of the cloud share to remove, or this one replaced
+	OldRoot   string `json:",omitempty"` // Last root merged from that share
+	RotatedAt int64  `json:",omitempty"` // Unix time of the switch to Key
 }
 
 type Share struct {
@@ -46,9 +58,21 @@ func newShare(name string, key string) *Share {
 		ss.load()
 	}
 
+	settings := config.GetSettings()
+
 	ss.Trie = &eft.EFT{
-		Dir: ss.CacheDir(),
-		Key: ss.CipherKey(),
+		Dir:   ss.CacheDir(),
+		Key:   ss.CipherKey(),
+		Store: ss.blockStore(),
+
+		Device:   settings.Device,
+		TombKeep: time.Duration(ss.Config.TombDays) * 24 * time.Hour,
+
+		Chunking: ss.Config.Chunking,
+		Compress: ss.Config.Compress,
+
+		Convergent: ss.Config.Convergent,
+		NonceKey:   ss.NonceKey(),
 	}
 
 	ss.save()
@@ -73,6 +97,34 @@ func (ss *Share) CacheDir() string {
 	return cache
 }
 
+// Caches keep blocks in pack files. Older caches with a file per block
+// are moved over the first time. If that fails, the blocks not moved yet
+// are read where they are, and the move is tried again next time.
+func (ss *Share) blockStore() eft.BlockStore {
+	ps := eft.NewPackStore(path.Join(ss.CacheDir(), "packs"))
+
+	blocks := path.Join(ss.CacheDir(), "blocks")
+
+	_, err := os.Stat(blocks)
+	if err != nil {
+		return ps
+	}
+
+	fmt.Println("XX - Moving blocks into packs for", ss.Name())
+
+	ds := &eft.DirStore{Dir: blocks}
+
+	moved, err := ps.Import(ds)
+	fmt.Println("XX - Moved", moved, "blocks")
+
+	if err != nil {
+		fmt.Println(fs.Trace(err))
+		return &eft.FallbackStore{Main: ps, Old: ds}
+	}
+
+	return ps
+}
+
 func (ss *Share) ShareDir() string {
 	share_dir := path.Join(config.SyncBase(), ss.Name())
 
@@ -108,6 +160,11 @@ func (ss *Share) CipherKey() [32]byte {
 	return fs.DeriveKey(ss.Key(), "cipher")
 }
 
+// All devices need the same nonce key for their blocks to match.
+func (ss *Share) NonceKey() [32]byte {
+	return fs.DeriveKey(ss.Key(), "nonce")
+}
+
 func (ss *Share) HmacKey() []byte {
 	key := fs.DeriveKey(ss.Key(), "hmac")
 	return key[:]
@@ -128,6 +185,15 @@ func (ss *Share) SetKey(key []byte) {
 
 func (ss *Share) Start() {
 	fmt.Println("XX - Starting share", ss.Name())
+
+	// Finish a rotation cut short before anything uses the EFT.
+	if ss.rotationStarted() {
+		err := ss.rotateKey()
+		if err != nil {
+			fmt.Println(fs.Trace(err))
+		}
+	}
+
 	ss.Watcher = ss.startWatcher()
 	fmt.Println("XX - Watcher started")
 
@@ -192,7 +258,9 @@ func (ss *Share) Secrets() string {
 	settings := config.GetSettings()
 	key := fs.DeriveKey(settings.MasterKey(), "share")
 
-	ptxt, err := json.Marshal(ss.Config)
+	cfg := ss.publicConfig()
+
+	ptxt, err := json.Marshal(&cfg)
 	fs.CheckError(err)
 
 	ctxt := fs.EncryptBytes(ptxt, key)
@@ -177,6 +177,29 @@ func loadList() {
 	}
 }
 
+// After a rotation both the old and the new cloud share are listed until
+// the old one is removed. The new one names the key it replaced, so the
+// old one is left out, whatever order they're listed in.
+func currentConfigs(cfgs []*ShareConfig) []*ShareConfig {
+	replaced := make(map[string]bool)
+
+	for _, cfg := range(cfgs) {
+		if cfg.OldKey != "" {
+			replaced[cfg.OldKey] = true
+		}
+	}
+
+	current := make([]*ShareConfig, 0)
+
+	for _, cfg := range(cfgs) {
+		if !replaced[cfg.Key] {
+			current = append(current, cfg)
+		}
+	}
+
+	return current
+}
+
 func syncList() error {
 	cc, err := cloud.New()
 	if err != nil {
@@ -188,6 +211,8 @@ func syncList() error {
 		return err
 	}
 
+	cfgs := make([]*ShareConfig, 0)
+
 	for _, si := range(sss) {
 		cfg, err := decodeSecrets(si.Secrets)
 		if err != nil {
@@ -195,9 +220,23 @@ func syncList() error {
 			continue
 		}
 
+		cfgs = append(cfgs, cfg)
+	}
+
+	for _, cfg := range(currentConfigs(cfgs)) {
 		ss0, ok := shares[cfg.Name]
 		if ok {
-			if ss0.Config.Key == cfg.Key {
+			// Before the new cloud share is uploaded, only the old
+			// one is listed. A device switching to a rotated key
+			// has it as NewKey until its next sync.
+			cur := ss0.Config
+			if cur.Key == cfg.Key || cur.OldKey == cfg.Key || cur.NewKey == cfg.Key {
+				continue
+			}
+
+			// Rotated on another device, so switch the local EFT
+			// over rather than starting again.
+			if cfg.OldKey == ss0.Config.Key && ss0.adoptKey(cfg.Key) {
 				continue
 			}
 		
@@ -9,13 +9,39 @@ import (
 func TestShares(tt *testing.T) {
 	config.StartTest()
 
-	mgr := GetMgr()
-
-	fmt.Println(mgr.List())
+	fmt.Println(List())
 
 	config.EndTest()
 }
 
+func TestCurrentConfigs(tt *testing.T) {
+	old_cfg := &ShareConfig{Name: "Docs", Key: "aa"}
+	new_cfg := &ShareConfig{Name: "Docs", Key: "bb", OldKey: "aa"}
+	other := &ShareConfig{Name: "Music", Key: "cc"}
+
+	lists := [][]*ShareConfig{
+		[]*ShareConfig{old_cfg, new_cfg, other},
+		[]*ShareConfig{new_cfg, other, old_cfg},
+	}
+
+	for _, cfgs := range(lists) {
+		current := currentConfigs(cfgs)
+
+		if len(current) != 2 {
+			fmt.Println("Expected two current shares, got", len(current))
+			tt.Fail()
+			continue
+		}
+
+		for _, cfg := range(current) {
+			if cfg == old_cfg {
+				fmt.Println("Rotated share still listed")
+				tt.Fail()
+			}
+		}
+	}
+}
+
 /*
 func NotATestYet() {
 	zkey := "00000000000000000000000000000000"
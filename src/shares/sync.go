@@ -76,7 +76,7 @@ func (ss *Share) poll() {
 	}
 }
 
-func (ss *Share) fetchBlocks(cc *cloud.Cloud, bs *eft.BlockSet) (*eft.BlockArchive, error) {
+func (ss *Share) fetchBlocks(cc *cloud.Cloud, name_hmac string, bs *eft.BlockSet) (*eft.BlockArchive, error) {
 	temp_name := ss.Trie.TempName()
 
 	temp, err := os.Create(temp_name)
@@ -99,7 +99,7 @@ func (ss *Share) fetchBlocks(cc *cloud.Cloud, bs *eft.BlockSet) (*eft.BlockArchi
 	
 	ba_path := ss.Trie.TempName()
 	
-	err = cc.FetchBlocks(ss.NameHmac(), temp_name, ba_path)
+	err = cc.FetchBlocks(name_hmac, temp_name, ba_path)
 	if err != nil {
 		return nil, fs.Trace(err)
 	}
@@ -113,6 +113,46 @@ func (ss *Share) fetchBlocks(cc *cloud.Cloud, bs *eft.BlockSet) (*eft.BlockArchi
 	return ba, nil
 }
 
+// Refetches blocks that failed to load, or were found to be bad, from
+// the cloud.
+func (ss *Share) repair(fetch_fn eft.FetchFn) error {
+	fmt.Println("XX - Repairing", ss.Name())
+
+	report, err := ss.Trie.Repair(fetch_fn)
+	if err != nil {
+		return fs.Trace(err)
+	}
+
+	for _, prob := range(report.Problems) {
+		fmt.Println("XX - Can't repair", eft.HashToHex(prob.Hash), prob.Error, prob.Paths)
+	}
+
+	return nil
+}
+
+// The current root, or zero for a new share.
+func (ss *Share) rootHash() [32]byte {
+	text, err := ss.Trie.RootHash()
+	if err != nil {
+		return [32]byte{}
+	}
+
+	return eft.HexToHash(text)
+}
+
+// Prints what a merge changed locally.
+func (ss *Share) logChanges(old_root [32]byte) {
+	changes, err := ss.Trie.Diff(old_root, ss.rootHash())
+	if err != nil {
+		fmt.Println(fs.Trace(err))
+		return
+	}
+
+	for _, ch := range(changes) {
+		fmt.Println("XX - Sync:", ch.Kind, ch.Path)
+	}
+}
+
 func (ss *Share) sync() {
 	sync_success := false
 	defer func() {
@@ -121,6 +161,14 @@ func (ss *Share) sync() {
 		}
 	}()
 
+	if ss.rotationStarted() {
+		err := ss.rotateKey()
+		if err != nil {
+			fmt.Println(fs.Trace(err))
+			return
+		}
+	}
+
 	settings := config.GetSettings()
 	if !settings.Ready() {
 		fmt.Println("Skipping upload, no cloud configured.")
@@ -135,6 +183,15 @@ func (ss *Share) sync() {
 	}
 
 	sdata, err := cc.GetShare(ss.NameHmac())
+	if err == cloud.ErrNotFound && ss.rotationPending() {
+		// Another device already removed the cloud share under the
+		// old key, so there's nothing to merge before switching.
+		err = ss.startRotation(eft.HashToHex(ss.rootHash()))
+		if err != nil {
+			fmt.Println(fs.Trace(err))
+		}
+		return
+	}
 	if err == cloud.ErrNotFound {
 		fmt.Println("XX - Creating share", ss.Name())
 		sdata, err = cc.CreateShare(ss.NameHmac(), ss.Secrets())
@@ -147,7 +204,15 @@ func (ss *Share) sync() {
 
 	// Fetch
 	fetch_fn := func(bs *eft.BlockSet) (*eft.BlockArchive, error) {
-		return ss.fetchBlocks(cc, bs)
+		return ss.fetchBlocks(cc, ss.NameHmac(), bs)
+	}
+
+	if ss.Trie.Damaged() {
+		err = ss.repair(fetch_fn)
+		if err != nil {
+			fmt.Println(fs.Trace(err))
+			return
+		}
 	}
 
 	// Perform merge
@@ -160,13 +225,22 @@ func (ss *Share) sync() {
 			return
 		}
 
+		old_root := ss.rootHash()
+
 		err = ss.Trie.MergeRemote(hash)
 		if err != nil {
 			fmt.Println(fs.Trace(err))
 			return
 		}
+
+		ss.logChanges(old_root)
 	}
 	
+	err = ss.applyRetention()
+	if err != nil {
+		fmt.Println(fs.Trace(err))
+	}
+
 	prev_root := sdata.Root
 
 	// Upload
@@ -174,9 +248,7 @@ func (ss *Share) sync() {
 	fs.CheckError(err)
 
 	defer func() {
-		if sync_success {
-			cp.Commit()
-		} else {
+		if !sync_success {
 			cp.Abort()
 		}
 	}()
@@ -216,12 +288,31 @@ func (ss *Share) sync() {
 		return
 	}
 
+	err = cp.MarkSynced()
+	if err != nil {
+		fmt.Println(fs.Trace(err))
+		return
+	}
+
 	sync_success = true
+	cp.Commit()
 
-	go func() {
-		// Outer func is still holding EFT lock, so this
-		// happens asynchronously.
+	if ss.rotationPending() {
+		// The old cloud share is merged and has our root, so nothing
+		// is lost by switching keys now.
+		err = ss.startRotation(cp.Hash)
+		if err != nil {
+			fmt.Println(fs.Trace(err))
+		}
+		ss.RequestSync()
+	} else {
+		err = ss.removeOldShare(cc)
+		if err != nil {
+			fmt.Println(fs.Trace(err))
+		}
+	}
 
+	go func() {
 		// Actually copy out all the files
 		infos, err := ss.Trie.ListInfos()
 		if err != nil {
@@ -52,7 +52,13 @@ func (ss *Share) startWatcher() *Watcher {
 }
 
 func (ww *Watcher) scanTree(scan_path string) {
-	ww.share.gotChange(scan_path)
+	batch := ww.share.newScanBatch()
+	ww.walkTree(scan_path, batch)
+	batch.flush()
+}
+
+func (ww *Watcher) walkTree(scan_path string, batch *scanBatch) {
+	ww.share.scanChange(scan_path, batch)
 
 	sysi, err := os.Lstat(scan_path)
 	if err != nil || !sysi.Mode().IsDir() {
@@ -69,11 +75,20 @@ func (ww *Watcher) scanTree(scan_path string) {
 
 	for _, ent := range(ents) {
 		next_path := path.Join(scan_path, ent.Name())
-		ww.scanTree(next_path)
+		ww.walkTree(next_path, batch)
 	}
 }
 
+// How long a rename waits for the event with its new name. fsnotify
+// doesn't pass on the cookie that pairs them, so a rename followed
+// by a create that matches the old item is taken to be a move.
+var RENAME_WAIT = 200 * time.Millisecond
+
 func (ww *Watcher) watcherLoop() {
+	moved_from  := "" // Rename waiting for its new name
+	moved_stamp := uint64(0)
+	var moved_wait <-chan time.Time
+
 	for {
 		select {
 		case evt := <-ww.fswatch.Event:
@@ -81,12 +96,33 @@ func (ww *Watcher) watcherLoop() {
 				goto DONE
 			}
 
-			if evt.IsDelete() || evt.IsRename() {
+			if moved_from != "" {
+				from := moved_from
+				moved_from = ""
+
+				if evt.IsCreate() && ww.share.gotMove(from, evt.Name) {
+					ww.scanTree(evt.Name)
+					continue
+				}
+
+				ww.share.gotDelete(from, moved_stamp)
+			}
+
+			if evt.IsRename() {
+				moved_from  = evt.Name
+				moved_stamp = uint64(time.Now().UnixNano())
+				moved_wait  = time.After(RENAME_WAIT)
+			} else if evt.IsDelete() {
 				stamp := uint64(time.Now().UnixNano())
 				ww.share.gotDelete(evt.Name, stamp)
 			} else {
 				ww.scanTree(evt.Name)
 			}
+		case _ = <-moved_wait:
+			if moved_from != "" {
+				ww.share.gotDelete(moved_from, moved_stamp)
+				moved_from = ""
+			}
 		case err := <-ww.fswatch.Error:
 			if err != nil {
 				fmt.Println("XX - error:", err)
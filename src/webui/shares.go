@@ -31,6 +31,12 @@ func serveShares(ww http.ResponseWriter, req *http.Request) {
 			getShare(elems[1], ww, req)
 		case "DELETE":
 			delShare(elems[1], ww, req)
+		case "POST":
+			if len(elems) > 2 && elems[2] == "rotate" {
+				rotateShare(elems[1], ww, req)
+			} else {
+				fs.PanicHere("Bad action: " + req.URL.Path)
+			}
 		default:
 			fs.PanicHere("Bad method: " + req.Method)
 		}
@@ -141,6 +147,15 @@ func delShare(name string, ww http.ResponseWriter, req *http.Request) {
 	ww.WriteHeader(204)
 }
 
+func rotateShare(name string, ww http.ResponseWriter, req *http.Request) {
+	fmt.Println("XX - Rotate key", name)
+
+	err := shares.Get(name).RotateKey()
+	checkError(ww, err)
+
+	ww.WriteHeader(204)
+}
+
 func createShare(ww http.ResponseWriter, req *http.Request) {
 	hdrs := ww.Header()
 	hdrs["Content-Type"] = []string{"application/json"}